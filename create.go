@@ -0,0 +1,415 @@
+/* Copyright (C) Xiang Wang - All Rights Reserved
+ * Unauthorized copying of this file, via any medium is strictly prohibited
+ * Proprietary and confidential
+ * Written by Xiang Wang <xwang1314@gmail.com>, August 2020
+ */
+
+package main
+
+import "github.com/aws/aws-sdk-go/service/ec2"
+import "github.com/aws/aws-sdk-go/aws"
+import "strings"
+import "errors"
+import "util"
+import "fmt"
+import "log"
+import "os"
+
+
+// create implements `ec2fleet create`, which is also what runs when no
+// command is given.
+func create(args []string) {
+    flags := newFlagSet("create", "Provision a fleet and its multi-attach volumes.")
+    inputs := addInputFlags(flags)
+    noRollbackPtr := flags.Bool("no-rollback", false, "Keep the resources created by a failed run for debugging\n(Optional) Default: false\neg. -no-rollback")
+    dryRunPtr     := flags.Bool("dryRun", false, "Check IAM permissions by sending every create call with DryRun, without creating anything\n(Optional) Default: false\neg. -dryRun")
+    stateDirPtr   := flags.String("stateDir", util.StateDirDefault, "Directory where the state file of each run is written\n(Optional) Default: .ec2fleet\neg. -stateDir=/tmp/ec2fleet")
+    flags.Parse(args)
+
+    configs, err := inputs.load()
+    if err != nil {
+        fail(err)
+    }
+
+    provisioner := util.NewDefaultProvisioner()
+    provisioner.DryRun = *dryRunPtr
+    runId := util.NewRunId()
+    r := newRun(provisioner, &util.StateFile{
+        Path: util.StateFilePath(*stateDirPtr, runId),
+        State: &util.RunState{
+            RunId:  runId,
+            Status: util.StatusCreating,
+            Config: configs,
+        },
+    })
+    log.Println("Run ID:", runId)
+    if *dryRunPtr {
+        // Nothing is created, so there is nothing to record or roll back
+        r.stateFile.Path = ""
+        if err := provision(r, configs); err != nil {
+            fail(err)
+        }
+        fmt.Println("Dry run permission report:")
+        fmt.Println(util.FormatDryRunReport(provisioner.DryRunResults()))
+        if provisioner.DryRunFailed() {
+            fail(&util.AWSError{Op: "Dry run", Err: errors.New("Some operations are not permitted.")})
+        }
+        os.Exit(exitOK)
+    }
+    if err := r.createResources(configs, *noRollbackPtr); err != nil {
+        fail(err)
+    }
+    os.Exit(exitOK)
+}
+
+// createResources provisions configs, writing the state file as it goes, and
+// rolls back what it created when that fails unless keep is set.
+func (r *run) createResources(configs util.Configs, keep bool) error {
+    log.Println("State file:", r.stateFile.Path)
+    err := r.stateFile.Save()
+    if err == nil {
+        err = provision(r, configs)
+    }
+    if err != nil {
+        r.stateFile.State.Status = util.StatusFailed
+        r.rollback(keep)
+        return err
+    }
+    r.stateFile.State.Status = util.StatusCreated
+    saveState(r.stateFile)
+    r.commit()
+    return nil
+}
+
+// saveState writes the final run state so `ec2fleet destroy` can find the resources.
+func saveState(stateFile *util.StateFile) {
+    if err := stateFile.Save(); err != nil {
+        log.Println(err)
+        return
+    }
+    log.Println("State saved to", stateFile.Path)
+}
+
+// launchTemplateRequest builds the request for a launch template named name
+// for configs.
+func launchTemplateRequest(name string, configs util.Configs, tags map[string]string) (*ec2.CreateLaunchTemplateInput, error) {
+    input := util.GetCreateLaunchTemplateInput(name,
+                                               configs.AmiId,
+                                               instanceTypeDefault,
+                                               configs.SecurityGroups,
+                                               tags)
+    // Only instant fleets tag their instances themselves
+    if configs.FleetTypeOrDefault() != ec2.FleetTypeInstant {
+        data := input.LaunchTemplateData
+        data.TagSpecifications = append(data.TagSpecifications, util.GetLaunchTemplateTagSpecifications(tags, ec2.ResourceTypeInstance)...)
+    }
+    if err := configs.SetLaunchTemplateOptions(input.LaunchTemplateData); err != nil {
+        return nil, err
+    }
+    return input, nil
+}
+
+// fleetRequest builds the fleet request for configs, placing the nodes by the
+// distribution strategy, each in the AZ of its subnet.
+func fleetRequest(configs util.Configs,
+                  subnetZones map[string]string,
+                  template util.LaunchTemplateRef,
+                  tags map[string]string) *ec2.CreateFleetInput {
+    return util.GetCreateFleetRequestInput(configs.PlaceNodes(subnetZones),
+                                           template,
+                                           subnetZones,
+                                           configs,
+                                           tags)
+}
+
+// run creates resources for one run through p. Every created resource is
+// recorded in saga so a failed step can be undone, and written to stateFile
+// as soon as it exists so it can be destroyed later.
+type run struct {
+    p         *util.Provisioner
+    saga      *util.Saga
+    stateFile *util.StateFile
+    tags      map[string]string
+}
+
+func newRun(p *util.Provisioner, stateFile *util.StateFile) *run {
+    return &run{
+        p:         p,
+        saga:      &util.Saga{},
+        stateFile: stateFile,
+        tags:      util.RunTags(stateFile.State.RunId, stateFile.State.Config.Tags),
+    }
+}
+
+// commit hands the resources of a successful run over to its state file:
+// from then on destroy removes them, and the saga no longer rolls them back.
+func (r *run) commit() {
+    for _, name := range r.saga.Pending() {
+        r.saga.Release(name)
+    }
+}
+
+// rollback undoes everything recorded in the saga, unless keep is set, and
+// saves the resulting status.
+func (r *run) rollback(keep bool) {
+    if keep {
+        log.Println("Rollback disabled, keeping resources:", r.saga.Pending())
+    } else if err := r.saga.Rollback(); err != nil {
+        log.Println(err)
+        r.stateFile.State.Status = util.StatusRollbackFailed
+    } else {
+        r.stateFile.State.Status = util.StatusRolledBack
+    }
+    saveState(r.stateFile)
+}
+
+// provision launches the fleet for configs and attaches every instance to a
+// multi-attach volume in its AZ.
+func provision(r *run, configs util.Configs) error {
+    // According to this resource https://docs.aws.amazon.com/AWSEC2/latest/UserGuide/ebs-volumes-multi.html
+    // Multi-attach volume is available only in us-east-1, us-west-2, eu-west-1, and ap-northeast-2 Regions
+    subnetZones, err := r.p.GetSubnetAvailabilityZones(configs.SubnetIds())
+    if err != nil {
+        return err
+    }
+    instances, err := r.launch(configs, subnetZones)
+    if err != nil {
+        return err
+    }
+    return r.attachVolumes(instances, configs.VolumeSpecs())
+}
+
+// launchTemplate returns the launch template the fleet for configs launches:
+// the existing one configs names, or the run's own. The run's template is
+// created by its first launch, kept as long as the run, and gets a new version
+// whenever its settings change.
+func (r *run) launchTemplate(configs util.Configs) (util.LaunchTemplateRef, error) {
+    if template, ok := configs.ExistingLaunchTemplate(); ok {
+        log.Println("Using launch template", template)
+        return template, nil
+    }
+    p := r.p
+    state := r.stateFile.State
+    input, err := launchTemplateRequest(util.LaunchTemplateName(state.RunId), configs, r.tags)
+    if err != nil {
+        return util.LaunchTemplateRef{}, err
+    }
+    digest := util.LaunchTemplateDigest(input.LaunchTemplateData)
+    if state.LaunchTemplateId != "" {
+        template := util.LaunchTemplateRef{Id: state.LaunchTemplateId, Version: state.LaunchTemplateVersion}
+        if digest == state.LaunchTemplateDigest {
+            return template, nil
+        }
+        log.Println("Launch template settings changed, creating a new version of", state.LaunchTemplateId)
+        template.Version, err = p.CreateLaunchTemplateVersion(state.LaunchTemplateId, input.LaunchTemplateData)
+        if err != nil {
+            return util.LaunchTemplateRef{}, err
+        }
+        state.LaunchTemplateVersion = template.Version
+        state.LaunchTemplateDigest = digest
+        return template, r.stateFile.Save()
+    }
+
+    log.Println("Creating Launch Template with the following parameters:\n", input)
+    response, err := p.CreateLaunchTemplate(input)
+    if err != nil {
+        return util.LaunchTemplateRef{}, err
+    }
+    launchTemplateId := aws.StringValue(response.LaunchTemplate.LaunchTemplateId)
+    r.saga.Record("launch template " + launchTemplateId, func() error {
+        _, err := p.DeleteLaunchTemplate(launchTemplateId)
+        return err
+    })
+    state.LaunchTemplateId = launchTemplateId
+    state.LaunchTemplateVersion = "1"
+    state.LaunchTemplateDigest = digest
+    return util.LaunchTemplateRef{Id: launchTemplateId, Version: "1"}, r.stateFile.Save()
+}
+
+// launch creates the fleets for configs from its launch template and returns
+// the new instances. Each AZ gets a fleet of its own, so that it gets the
+// capacity the distribution placed in it.
+func (r *run) launch(configs util.Configs, subnetZones map[string]string) ([]util.Instance, error) {
+    template, err := r.launchTemplate(configs)
+    if err != nil {
+        return nil, err
+    }
+
+    createFleetInput := fleetRequest(configs, subnetZones, template, r.tags)
+    results := []util.FleetResult{}
+    instances := []util.Instance{}
+    for _, zoneInput := range util.FleetRequestsByZone(createFleetInput) {
+        zoneInstances, zoneResults, err := r.launchFleet(configs, zoneInput, subnetZones)
+        if err != nil {
+            return nil, err
+        }
+        instances = append(instances, zoneInstances...)
+        results = append(results, zoneResults...)
+    }
+    if err := configs.CheckFulfillment(createFleetInput, results); err != nil {
+        return nil, err
+    }
+
+    log.Println("Fleet Instances:\n", instances)
+    return instances, nil
+}
+
+// launchFleet creates the fleet for createFleetInput, then more fleets for
+// the capacity it is short of as the partial fulfillment policy and the
+// fallbacks of configs say, and returns their instances and results.
+func (r *run) launchFleet(configs util.Configs,
+                          createFleetInput *ec2.CreateFleetInput,
+                          subnetZones map[string]string) ([]util.Instance, []util.FleetResult, error) {
+    p := r.p
+    state := r.stateFile.State
+    results := []util.FleetResult{}
+    instances := []util.Instance{}
+    input, fallback := configs.NextFleetRequest(createFleetInput, subnetZones, results)
+    for input != nil {
+        if fallback != "" {
+            log.Println("Falling back to", fallback, "for the missing capacity")
+        }
+        log.Println("Creating EC2 Fleet with the following parameters:\n", input)
+        fleet, err := p.CreateFleet(input)
+        if err != nil {
+            // Out of capacity, the fallbacks may still have some
+            result, ok := util.InsufficientCapacityResult(err, fallback)
+            if !ok {
+                return nil, nil, err
+            }
+            log.Println(err)
+            results = append(results, result)
+            if input, fallback = configs.NextFleetRequest(createFleetInput, subnetZones, results); input == nil && len(instances) == 0 {
+                return nil, nil, err
+            }
+            continue
+        }
+        result := util.ParseFleetOutput(fleet, fallback)
+        fleetId := result.FleetId
+        state.FleetIds = append(state.FleetIds, fleetId)
+        r.saga.Record("fleet " + fleetId, func() error {
+            _, err := p.DeleteFleets([]string{fleetId})
+            return err
+        })
+        if err := r.stateFile.Save(); err != nil {
+            return nil, nil, err
+        }
+        // Request and maintain fleets launch their instances after CreateFleet
+        if configs.FleetTypeOrDefault() != ec2.FleetTypeInstant && !p.DryRun {
+            result.Instances, err = p.WaitForFleetInstances(fleetId)
+            if err != nil {
+                return nil, nil, err
+            }
+        }
+        if err := r.recordInstances(result.Instances); err != nil {
+            return nil, nil, err
+        }
+        instances = append(instances, result.Instances...)
+        results = append(results, result)
+        if len(result.Errors) > 0 {
+            log.Printf("Fleet %s launched %d instances, with errors:\n%s", fleetId, len(result.Instances), util.FormatFleetErrors(result.Errors))
+        }
+        input, fallback = configs.NextFleetRequest(createFleetInput, subnetZones, results)
+    }
+    return instances, results, nil
+}
+
+// recordInstances adds the instances of a fleet to the state and records
+// their termination.
+func (r *run) recordInstances(instances []util.Instance) error {
+    if len(instances) == 0 {
+        return nil
+    }
+    state := r.stateFile.State
+    state.Instances = append(state.Instances, instances...)
+    instanceIds := []string{}
+    for _, instance := range instances {
+        instanceIds = append(instanceIds, instance.InstanceId)
+    }
+    r.saga.Record("fleet instances " + strings.Join(instanceIds, ","), func() error {
+        _, err := r.p.TerminateInstances(instanceIds)
+        return err
+    })
+    return r.stateFile.Save()
+}
+
+// attachVolumes attaches every instance to each shared volume in its AZ,
+// filling the free slots of the run's existing volumes before creating new ones.
+func (r *run) attachVolumes(instances []util.Instance, volumes []util.VolumeSpec) error {
+    for _, volume := range volumes {
+        if err := r.attachVolume(instances, volume); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// attachVolume attaches every instance to a multi-attach volume of one
+// shared volume in its AZ, at the device of the shared volume.
+func (r *run) attachVolume(instances []util.Instance, volume util.VolumeSpec) error {
+    p := r.p
+    state := r.stateFile.State
+    azs := []string{}
+    for _, instance := range instances {
+        azs = append(azs, instance.AvailabilityZone)
+    }
+    existing := []util.Volume{}
+    devices := map[string]string{}
+    for _, v := range state.Volumes {
+        if v.Name == volume.Name {
+            existing = append(existing, v)
+            // Volumes recorded before devices were allocated are at /dev/sdf
+            devices[v.VolumeId] = v.Device
+            if v.Device == "" {
+                devices[v.VolumeId] = "/dev/sdf"
+            }
+        }
+    }
+    for _, group := range util.AssignVolumes(existing, state.AttachmentCounts(), azs) {
+        volumeId := group.VolumeId
+        if volumeId == "" {
+            response, err := p.CreateVolume(volume, group.AvailabilityZone, r.tags)
+            if err != nil {
+                return err
+            }
+            volumeId = *response.VolumeId
+            r.saga.Record("volume " + volumeId, func() error {
+                _, err := p.DeleteVolume(volumeId)
+                return err
+            })
+            state.Volumes = append(state.Volumes, util.Volume{
+                VolumeId:         volumeId,
+                AvailabilityZone: group.AvailabilityZone,
+                Size:             volume.Size,
+                Name:             volume.Name,
+                Device:           volume.Device,
+            })
+            devices[volumeId] = volume.Device
+            if err := r.stateFile.Save(); err != nil {
+                return err
+            }
+        }
+
+        for _, member := range group.Members {
+            instanceId := instances[member].InstanceId
+            log.Println("Attaching", volumeId, "to", instanceId, "at", devices[volumeId], "in", group.AvailabilityZone)
+            attachment, err := p.AttachVolume(instanceId, volumeId, devices[volumeId])
+            if err != nil {
+                return err
+            }
+            state.Attachments = append(state.Attachments, util.Attachment{
+                InstanceId: instanceId,
+                VolumeId:   volumeId,
+                Device:     aws.StringValue(attachment.Device),
+            })
+            r.saga.Record("attachment " + volumeId + " to " + instanceId, func() error {
+                _, err := p.DetachVolume(instanceId, volumeId)
+                return err
+            })
+            if err := r.stateFile.Save(); err != nil {
+                return err
+            }
+        }
+    }
+    return nil
+}
@@ -0,0 +1,297 @@
+package main
+
+import "github.com/aws/aws-sdk-go/service/ec2"
+import "github.com/aws/aws-sdk-go/aws/awserr"
+import "github.com/aws/aws-sdk-go/aws"
+import "path/filepath"
+import "io/ioutil"
+import "reflect"
+import "strings"
+import "testing"
+import "util"
+import "fmt"
+import "os"
+
+
+// fakeEC2 launches an instance for every override of a fleet until its
+// target capacity is met, and logs the calls that change something in the
+// order they are made.
+type fakeEC2 struct {
+    calls     []string
+    instances int
+    volumes   int
+    fleets    int
+    attaches  int
+    // Number of the AttachVolume call that fails, 0 for none
+    failAttach int
+}
+
+func (f *fakeEC2) call(format string, args ...interface{}) {
+    f.calls = append(f.calls, fmt.Sprintf(format, args...))
+}
+
+func (f *fakeEC2) CreateLaunchTemplate(in *ec2.CreateLaunchTemplateInput) (*ec2.CreateLaunchTemplateOutput, error) {
+    f.call("CreateLaunchTemplate %s", aws.StringValue(in.LaunchTemplateName))
+    return &ec2.CreateLaunchTemplateOutput{
+        LaunchTemplate: &ec2.LaunchTemplate{LaunchTemplateId: aws.String("lt-00000000000000001")},
+    }, nil
+}
+
+func (f *fakeEC2) CreateLaunchTemplateVersion(in *ec2.CreateLaunchTemplateVersionInput) (*ec2.CreateLaunchTemplateVersionOutput, error) {
+    f.call("CreateLaunchTemplateVersion %s", aws.StringValue(in.LaunchTemplateId))
+    return &ec2.CreateLaunchTemplateVersionOutput{
+        LaunchTemplateVersion: &ec2.LaunchTemplateVersion{VersionNumber: aws.Int64(2)},
+    }, nil
+}
+
+func (f *fakeEC2) DeleteLaunchTemplate(in *ec2.DeleteLaunchTemplateInput) (*ec2.DeleteLaunchTemplateOutput, error) {
+    f.call("DeleteLaunchTemplate %s", aws.StringValue(in.LaunchTemplateId))
+    return &ec2.DeleteLaunchTemplateOutput{}, nil
+}
+
+func (f *fakeEC2) CreateFleet(in *ec2.CreateFleetInput) (*ec2.CreateFleetOutput, error) {
+    f.fleets++
+    fleetId := fmt.Sprintf("fleet-%d", f.fleets)
+    f.call("CreateFleet %s", fleetId)
+    output := &ec2.CreateFleetOutput{FleetId: aws.String(fleetId)}
+    target := in.TargetCapacitySpecification
+    if aws.Int64Value(target.OnDemandTargetCapacity) < 0 || aws.Int64Value(target.SpotTargetCapacity) < 0 {
+        return nil, awserr.New("InvalidTargetCapacitySpecification", "Target capacities can not be negative.", nil)
+    }
+    onDemand := aws.Int64Value(target.OnDemandTargetCapacity)
+    launched := int64(0)
+    for _, override := range in.LaunchTemplateConfigs[0].Overrides {
+        if launched >= aws.Int64Value(target.TotalTargetCapacity) {
+            break
+        }
+        lifecycle := ec2.InstanceLifecycleSpot
+        if launched < onDemand {
+            lifecycle = "on-demand"
+        }
+        f.instances++
+        output.Instances = append(output.Instances, &ec2.CreateFleetInstance{
+            InstanceIds:  aws.StringSlice([]string{fmt.Sprintf("i-%017x", f.instances)}),
+            InstanceType: override.InstanceType,
+            Lifecycle:    aws.String(lifecycle),
+            LaunchTemplateAndOverrides: &ec2.LaunchTemplateAndOverridesResponse{
+                Overrides: &ec2.FleetLaunchTemplateOverrides{
+                    AvailabilityZone: override.AvailabilityZone,
+                    InstanceType:     override.InstanceType,
+                    SubnetId:         override.SubnetId,
+                    WeightedCapacity: override.WeightedCapacity,
+                },
+            },
+        })
+        launched += int64(aws.Float64Value(override.WeightedCapacity))
+        if override.WeightedCapacity == nil {
+            launched++
+        }
+    }
+    return output, nil
+}
+
+func (f *fakeEC2) CreateVolume(in *ec2.CreateVolumeInput) (*ec2.Volume, error) {
+    f.volumes++
+    volumeId := fmt.Sprintf("vol-%017x", f.volumes)
+    f.call("CreateVolume %s %s", volumeId, aws.StringValue(in.AvailabilityZone))
+    return &ec2.Volume{VolumeId: aws.String(volumeId), AvailabilityZone: in.AvailabilityZone}, nil
+}
+
+func (f *fakeEC2) AttachVolume(in *ec2.AttachVolumeInput) (*ec2.VolumeAttachment, error) {
+    f.call("AttachVolume %s %s", aws.StringValue(in.VolumeId), aws.StringValue(in.InstanceId))
+    f.attaches++
+    if f.attaches == f.failAttach {
+        return nil, awserr.New("VolumeInUse", "The volume is in use.", nil)
+    }
+    return &ec2.VolumeAttachment{Device: in.Device, InstanceId: in.InstanceId, VolumeId: in.VolumeId}, nil
+}
+
+func (f *fakeEC2) DetachVolume(in *ec2.DetachVolumeInput) (*ec2.VolumeAttachment, error) {
+    f.call("DetachVolume %s %s", aws.StringValue(in.VolumeId), aws.StringValue(in.InstanceId))
+    return &ec2.VolumeAttachment{InstanceId: in.InstanceId, VolumeId: in.VolumeId}, nil
+}
+
+func (f *fakeEC2) DeleteVolume(in *ec2.DeleteVolumeInput) (*ec2.DeleteVolumeOutput, error) {
+    f.call("DeleteVolume %s", aws.StringValue(in.VolumeId))
+    return &ec2.DeleteVolumeOutput{}, nil
+}
+
+func (f *fakeEC2) DescribeVolumes(in *ec2.DescribeVolumesInput) (*ec2.DescribeVolumesOutput, error) {
+    return &ec2.DescribeVolumesOutput{
+        Volumes: []*ec2.Volume{{VolumeId: in.VolumeIds[0], State: aws.String("available")}},
+    }, nil
+}
+
+func (f *fakeEC2) TerminateInstances(in *ec2.TerminateInstancesInput) (*ec2.TerminateInstancesOutput, error) {
+    f.call("TerminateInstances %s", strings.Join(aws.StringValueSlice(in.InstanceIds), ","))
+    return &ec2.TerminateInstancesOutput{}, nil
+}
+
+func (f *fakeEC2) DeleteFleets(in *ec2.DeleteFleetsInput) (*ec2.DeleteFleetsOutput, error) {
+    f.call("DeleteFleets %s", strings.Join(aws.StringValueSlice(in.FleetIds), ","))
+    return &ec2.DeleteFleetsOutput{}, nil
+}
+
+func (f *fakeEC2) DescribeFleets(in *ec2.DescribeFleetsInput) (*ec2.DescribeFleetsOutput, error) {
+    return &ec2.DescribeFleetsOutput{}, nil
+}
+
+func (f *fakeEC2) DescribeInstances(in *ec2.DescribeInstancesInput) (*ec2.DescribeInstancesOutput, error) {
+    return &ec2.DescribeInstancesOutput{}, nil
+}
+
+func (f *fakeEC2) DescribeLaunchTemplates(in *ec2.DescribeLaunchTemplatesInput) (*ec2.DescribeLaunchTemplatesOutput, error) {
+    return &ec2.DescribeLaunchTemplatesOutput{}, nil
+}
+
+func (f *fakeEC2) DescribeInstanceStatus(in *ec2.DescribeInstanceStatusInput) (*ec2.DescribeInstanceStatusOutput, error) {
+    return &ec2.DescribeInstanceStatusOutput{
+        InstanceStatuses: []*ec2.InstanceStatus{
+            {InstanceState: &ec2.InstanceState{Name: aws.String("running")}},
+        },
+    }, nil
+}
+
+// DescribeSubnets places subnets named "<az>-<n>" in <az>, eg. us-east-1c-2.
+func (f *fakeEC2) DescribeSubnets(in *ec2.DescribeSubnetsInput) (*ec2.DescribeSubnetsOutput, error) {
+    output := &ec2.DescribeSubnetsOutput{}
+    for _, id := range in.SubnetIds {
+        if i := strings.LastIndex(*id, "-"); i > 0 {
+            output.Subnets = append(output.Subnets, &ec2.Subnet{SubnetId: id, AvailabilityZone: aws.String((*id)[:i])})
+        }
+    }
+    return output, nil
+}
+
+// createConfigs is four nodes over two AZs, one shared volume in each.
+func createConfigs() util.Configs {
+    return util.Configs{
+        Nodes:          4,
+        VolumeSize:     4,
+        AmiId:          "ami-1",
+        SecurityGroups: []string{"sg1"},
+        Subnets:        []string{"us-east-1a-1", "us-east-1b-1", "us-east-1a-1", "us-east-1b-1"},
+        InstanceTypes:  []string{"t3.micro", "t3.micro", "t3.micro", "t3.micro"},
+    }
+}
+
+// newTestRun returns a run of configs against fake, with its state file in
+// dir.
+func newTestRun(fake *fakeEC2, configs util.Configs, dir string) *run {
+    return newRun(util.NewProvisioner(fake), &util.StateFile{
+        Path: util.StateFilePath(dir, "run-1"),
+        State: &util.RunState{
+            RunId:  "run-1",
+            Status: util.StatusCreating,
+            Config: configs,
+        },
+    })
+}
+
+func TestCreate(t *testing.T) {
+    dir, err := ioutil.TempDir("", "ec2fleet")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+    fake := &fakeEC2{}
+    configs := createConfigs()
+    if err := util.ValidateConfigs(configs); err != nil {
+        t.Fatalf("TestCreate failed: %v", err)
+    }
+    r := newTestRun(fake, configs, dir)
+    if err := r.createResources(configs, false); err != nil {
+        t.Fatalf("TestCreate failed: %v", err)
+    }
+    expected := []string{
+        "CreateLaunchTemplate ec2fleet-run-1",
+        "CreateFleet fleet-1",
+        "CreateFleet fleet-2",
+        "CreateVolume vol-00000000000000001 us-east-1a",
+        "AttachVolume vol-00000000000000001 i-00000000000000001",
+        "AttachVolume vol-00000000000000001 i-00000000000000002",
+        "CreateVolume vol-00000000000000002 us-east-1b",
+        "AttachVolume vol-00000000000000002 i-00000000000000003",
+        "AttachVolume vol-00000000000000002 i-00000000000000004",
+    }
+    if !reflect.DeepEqual(fake.calls, expected) {
+        t.Errorf("TestCreate made calls:\n%s\nexpected:\n%s", strings.Join(fake.calls, "\n"), strings.Join(expected, "\n"))
+    }
+
+    // The saved state lists every resource so destroy can find them
+    state, err := util.LoadRunState(r.stateFile.Path)
+    if err != nil {
+        t.Fatalf("TestCreate could not load the state: %v", err)
+    }
+    if state.Status != util.StatusCreated || state.LaunchTemplateId != "lt-00000000000000001" ||
+       !reflect.DeepEqual(state.FleetIds, []string{"fleet-1", "fleet-2"}) ||
+       len(state.Instances) != 4 || len(state.Volumes) != 2 || len(state.Attachments) != 4 {
+        t.Errorf("TestCreate saved state %+v", state)
+    }
+    for _, instance := range state.Instances {
+        if !strings.HasPrefix(instance.SubnetId, instance.AvailabilityZone) {
+            t.Errorf("TestCreate placed %+v outside the AZ of its subnet", instance)
+        }
+    }
+    if state.Attachments[3].Device != "/dev/sdf" {
+        t.Errorf("TestCreate saved attachment %+v", state.Attachments[3])
+    }
+    // The state file owns the resources now, nothing is left to roll back
+    if pending := r.saga.Pending(); len(pending) != 0 {
+        t.Errorf("TestCreate left %v in the saga", pending)
+    }
+}
+
+func TestCreateRollback(t *testing.T) {
+    dir, err := ioutil.TempDir("", "ec2fleet")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+    fake := &fakeEC2{failAttach: 4}
+    configs := createConfigs()
+    r := newTestRun(fake, configs, dir)
+    err = r.createResources(configs, false)
+    if err == nil || !strings.Contains(err.Error(), "VolumeInUse") {
+        t.Fatalf("TestCreateRollback got %v", err)
+    }
+    // Everything created is undone in reverse: the attachments and volumes,
+    // then the instances and fleets, then the launch template
+    expected := []string{
+        "DetachVolume vol-00000000000000002 i-00000000000000003",
+        "DeleteVolume vol-00000000000000002",
+        "DetachVolume vol-00000000000000001 i-00000000000000002",
+        "DetachVolume vol-00000000000000001 i-00000000000000001",
+        "DeleteVolume vol-00000000000000001",
+        "TerminateInstances i-00000000000000003,i-00000000000000004",
+        "DeleteFleets fleet-2",
+        "TerminateInstances i-00000000000000001,i-00000000000000002",
+        "DeleteFleets fleet-1",
+        "DeleteLaunchTemplate lt-00000000000000001",
+    }
+    rollback := fake.calls[len(fake.calls) - len(expected):]
+    if !reflect.DeepEqual(rollback, expected) {
+        t.Errorf("TestCreateRollback made calls:\n%s\nexpected:\n%s", strings.Join(fake.calls, "\n"), strings.Join(expected, "\n"))
+    }
+    state, err := util.LoadRunState(r.stateFile.Path)
+    if err != nil || state.Status != util.StatusRolledBack {
+        t.Errorf("TestCreateRollback saved state %+v, %v", state, err)
+    }
+
+    // Without rollback the resources stay in the state file
+    fake = &fakeEC2{failAttach: 4}
+    r = newTestRun(fake, configs, filepath.Join(dir, "keep"))
+    r.createResources(configs, true)
+    state, err = util.LoadRunState(r.stateFile.Path)
+    if err != nil || state.Status != util.StatusFailed || len(state.Attachments) != 3 || len(state.Instances) != 4 {
+        t.Errorf("TestCreateRollback kept state %+v, %v", state, err)
+    }
+    if len(r.saga.Pending()) != 10 {
+        t.Errorf("TestCreateRollback kept %v", r.saga.Pending())
+    }
+    for _, call := range fake.calls {
+        if strings.HasPrefix(call, "Delete") || strings.HasPrefix(call, "Detach") || strings.HasPrefix(call, "Terminate") {
+            t.Errorf("TestCreateRollback rolled back with -no-rollback: %s", call)
+        }
+    }
+}
@@ -0,0 +1,61 @@
+/* Copyright (C) Xiang Wang - All Rights Reserved
+ * Unauthorized copying of this file, via any medium is strictly prohibited
+ * Proprietary and confidential
+ * Written by Xiang Wang <xwang1314@gmail.com>, August 2020
+ */
+
+package main
+
+import "strings"
+import "bufio"
+import "util"
+import "fmt"
+import "log"
+import "os"
+
+
+// destroy implements `ec2fleet destroy`: it tears down every resource
+// recorded in the state file of a previous run.
+func destroy(args []string) {
+    flags := newFlagSet("destroy", "Tear down every resource of a run: detach and delete its volumes, terminate its instances and delete its fleets.")
+    runs := addRunFlags(flags)
+    yesPtr := flags.Bool("yes", false, "Skip the confirmation prompt\n(Optional) Default: false\neg. -yes")
+    flags.Parse(args)
+
+    provisioner := util.NewDefaultProvisioner()
+    stateFile, err := runs.load(provisioner)
+    if err != nil {
+        fail(err)
+    }
+    state := stateFile.State
+    if state.Empty() {
+        log.Println("Nothing to destroy for run", state.RunId)
+        os.Exit(exitOK)
+    }
+
+    fmt.Println("The following resources will be destroyed:")
+    fmt.Println(util.DestroySummary(state))
+    if !*yesPtr && !confirm("Destroy these resources? [y/N] ") {
+        log.Println("Destroy cancelled.")
+        os.Exit(exitOK)
+    }
+
+    if err := util.DestroyRun(provisioner, stateFile); err != nil {
+        fail(err)
+    }
+    if stateFile.Path != "" {
+        if err := os.Remove(stateFile.Path); err != nil {
+            log.Println("Unable to remove state file", stateFile.Path, err)
+        }
+    }
+    log.Println("Run", state.RunId, "destroyed.")
+    os.Exit(exitOK)
+}
+
+// confirm asks a yes/no question on stdin.
+func confirm(question string) bool {
+    fmt.Print(question)
+    answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+    answer = strings.ToLower(strings.TrimSpace(answer))
+    return answer == "y" || answer == "yes"
+}
@@ -0,0 +1,195 @@
+/* Copyright (C) Xiang Wang - All Rights Reserved
+ * Unauthorized copying of this file, via any medium is strictly prohibited
+ * Proprietary and confidential
+ * Written by Xiang Wang <xwang1314@gmail.com>, August 2020
+ */
+
+package main
+
+import "util"
+import "flag"
+import "log"
+import "os"
+
+
+// inputFlags are the flags that describe the fleet, shared by every
+// command that needs the fleet inputs. Each flag is named after the Configs
+// field it sets.
+type inputFlags struct {
+    flags        *flag.FlagSet
+    configFile   *string
+    configFormat *string
+    profile      *string
+    env          *bool
+}
+
+func addInputFlags(flags *flag.FlagSet) *inputFlags {
+    // mandatory
+    flags.Int("nodes", 0, "Number of Nodes\n(Require)\neg. -nodes=2")
+    flags.String("subnets", "", "Network IDs for each instance to attach to\n(Require)\neg. -subnets=sub1,sub2,...")
+    flags.String("securityGroups", "", "Security group IDs that will be applied on all instances\n(Require)\neg. -securityGroups=sg1,sg2,...")
+    // optional
+    flags.String("instanceTypes", "", "Instance types\n(Optional) Default: t3.micro.\neg. -instanceTypes=t3.micro\nMulti-Attach volume can only be attached to instance types that are Nitro System\nhttps://docs.aws.amazon.com/AWSEC2/latest/UserGuide/instance-types.html#ec2-nitro-instances")
+    flags.Int("volumeSize", 0, "Multi-attach volume size\n(Optional) Default: 3\neg. -volumeSize=4\nMin: 4 GiB, Max: 16384 GiB; io1 needs 1 GiB per 50 IOPS, io2 per 500 IOPS")
+    flags.String("volumeType", "", "Multi-attach volume type: io1 or io2\n(Optional) Default: io1\neg. -volumeType=io2")
+    flags.Int("volumeIops", 0, "Multi-attach volume provisioned IOPS\n(Optional) Default: 200\neg. -volumeIops=1000\nMin: 100, Max: 64000")
+    flags.Bool("volumeEncrypted", false, "Encrypt the multi-attach volumes\n(Optional) Default: false, or the account's EBS encryption by default\neg. -volumeEncrypted")
+    flags.String("volumeKmsKeyId", "", "KMS key encrypting the multi-attach volumes, by key ID, alias or ARN; implies -volumeEncrypted\n(Optional) Default: the aws/ebs key\neg. -volumeKmsKeyId=alias/storage")
+    flags.String("sharedVolumes", "", "Several named multi-attach volumes as JSON, instead of -volumeSize and friends;\nattached at /dev/sdf, /dev/sdg, ... skipping the devices of -blockDevices\n(Optional) Default: empty\neg. -sharedVolumes='[{\"name\": \"data\", \"size\": 500}, {\"name\": \"log\", \"size\": 50, \"type\": \"io2\"}]'")
+    flags.String("tags", "", "Tags applied to the fleet, its instances and its volumes\n(Optional) Default: empty\neg. -tags=team=storage,env=dev")
+    flags.String("distribution", "", "How nodes are spread over their subnets: round-robin, weighted, pack or spread\n(Optional) Default: each node in the subnet listed for it\neg. -distribution=spread")
+    flags.String("subnetWeights", "", "Subnet weights for -distribution=weighted\n(Optional) Default: 1 for every subnet\neg. -subnetWeights=sub1=3,sub2=1")
+    flags.String("subnetZones", "", "AZ of every subnet, for plan -offline\n(Optional) Default: looked up in AWS\neg. -subnetZones=sub1=us-east-1a,sub2=us-east-1b")
+    // purchasing
+    flags.Int("onDemandPercentage", util.OnDemandPercentageDefault, "Percentage of the fleet capacity bought on-demand, the rest is spot\n(Optional)\neg. -onDemandPercentage=50")
+    flags.Int("onDemandCount", 0, "Capacity bought on-demand, instead of -onDemandPercentage\n(Optional) Default: unset\neg. -onDemandCount=2")
+    flags.String("spotAllocationStrategy", util.SpotAllocationDefault, "Spot allocation strategy: lowest-price, diversified, capacity-optimized,\ncapacity-optimized-prioritized or price-capacity-optimized\n(Optional)\neg. -spotAllocationStrategy=capacity-optimized")
+    flags.String("onDemandAllocationStrategy", "", "On-demand allocation strategy: lowest-price or prioritized\n(Optional) Default: the AWS default, lowest-price\neg. -onDemandAllocationStrategy=prioritized")
+    flags.String("maxSpotPrice", "", "Maximum price per spot instance, in USD per hour\n(Optional) Default: the on-demand price\neg. -maxSpotPrice=0.05")
+    flags.String("fleetType", util.FleetTypeDefault, "Fleet type: instant, request or maintain\n(Optional)\neg. -fleetType=maintain")
+    flags.String("defaultCapacityType", util.DefaultCapacityTypeDefault, "Capacity type of the capacity that is neither on-demand nor spot: spot or on-demand\n(Optional)\neg. -defaultCapacityType=on-demand")
+    flags.String("partialFulfillment", "", "What to do when an instant fleet launches less than its target capacity:\naccept, retry (the shortfall, up to 3 times) or rollback\n(Optional) Default: accept\neg. -partialFulfillment=retry")
+    flags.Int("minTargetCapacity", 0, "Capacity below which -partialFulfillment=retry|rollback rolls the run back\n(Optional) Default: the whole target capacity\neg. -minTargetCapacity=3")
+    flags.String("fallbackInstanceTypes", "", "Instance types tried in order for the missing capacity when EC2 runs out of capacity\n(Optional) Default: empty\neg. -fallbackInstanceTypes=t3.small,m5.large")
+    flags.String("fallbackSubnets", "", "Subnets in other AZs tried in order, after -fallbackInstanceTypes\n(Optional) Default: empty\neg. -fallbackSubnets=subnet-3,subnet-4")
+    flags.Bool("fallbackOnDemand", false, "Buy the capacity still missing on-demand, after every other fallback\n(Optional) Default: false\neg. -fallbackOnDemand")
+    // launch template
+    addLaunchTemplateFlags(flags)
+    flags.String("launchTemplateId", "", "Existing launch template to use as is, instead of creating one for the run\n(Optional) Default: create one\neg. -launchTemplateId=lt-0abcd1234efgh5678")
+    flags.String("launchTemplateName", "", "Existing launch template to use as is, by name\n(Optional) Default: create one\neg. -launchTemplateName=storage-nodes")
+    flags.String("launchTemplateVersion", "", "Version of the existing launch template: a number, $Latest or $Default\n(Optional) Default: $Default\neg. -launchTemplateVersion=3")
+    flags.String("nodeGroups", "", "Node groups as JSON, instead of -nodes, -subnets and -instanceTypes\n(Optional) Default: empty\neg. -nodeGroups='[{\"count\": 40, \"subnets\": [\"sub1\", \"sub2\"], \"instanceTypes\": [\"m5.large\"], \"weight\": 2}]'")
+    return &inputFlags{
+        flags:        flags,
+        // Other
+        configFile:   flags.String("configFile", "", "JSON, YAML or TOML config file\n(Optional) Default: empty\neg. -configFile=etc/config.yaml"),
+        configFormat: flags.String("configFormat", "", "Format of the config file, json, yaml or toml\n(Optional) Default: from the file extension\neg. -configFormat=yaml"),
+        profile:      flags.String("profile", "", "Profile of the config file to use on top of its base\n(Optional) Default: the base alone\neg. -profile=perf"),
+        env:          flags.Bool("env", false, "Deprecated: the environment variable of every field, eg. NUMBER_OF_NODES, is always read\nand overrides the config file; see the README for the names\neg. -env"),
+    }
+}
+
+// launchTemplateFlags are the flags of the settings that go into the launch
+// template of a run, which scale also takes for the nodes it adds.
+type launchTemplateFlags struct {
+    flags *flag.FlagSet
+    names map[string]bool
+}
+
+func addLaunchTemplateFlags(flags *flag.FlagSet) *launchTemplateFlags {
+    template := flag.NewFlagSet("launch template", flag.ContinueOnError)
+    template.String("amiId", "", "Amazon Machine Image ID\n(Optional) Default: ami-0bbe28eb2173f6167 (ubuntu-18.04)\neg. -amiId=ami-0bbe28eb2173f6167")
+    template.String("keyName", "", "SSH key pair of the instances\n(Optional) Default: none\neg. -keyName=storage-team")
+    template.String("iamInstanceProfile", "", "IAM instance profile of the instances, by name or ARN\n(Optional) Default: none\neg. -iamInstanceProfile=ec2fleet-node")
+    template.String("userDataFile", "", "File with the user data of the instances, eg. a cloud-init config; it is base64 encoded\n(Optional) Default: none\neg. -userDataFile=etc/cloud-init.yaml")
+    template.Bool("requireImdsv2", false, "Only allow IMDSv2 requests to the instance metadata service\n(Optional) Default: false\neg. -requireImdsv2")
+    template.Bool("detailedMonitoring", false, "Enable detailed CloudWatch monitoring of the instances\n(Optional) Default: false\neg. -detailedMonitoring")
+    template.Bool("ebsOptimized", false, "Launch EBS-optimized instances\n(Optional) Default: false\neg. -ebsOptimized")
+    template.String("blockDevices", "", "Root and data volumes of every instance as JSON\n(Optional) Default: the root volume of the AMI only\neg. -blockDevices='{\"root\": {\"size\": 20}, \"volumes\": [{\"deviceName\": \"/dev/sdg\", \"size\": 100, \"iops\": 4000}]}'")
+    names := map[string]bool{}
+    template.VisitAll(func(f *flag.Flag) {
+        flags.Var(f.Value, f.Name, f.Usage)
+        names[f.Name] = true
+    })
+    return &launchTemplateFlags{flags: flags, names: names}
+}
+
+// apply returns configs with the launch template settings set on the command
+// line, validated.
+func (f *launchTemplateFlags) apply(configs util.Configs) (util.Configs, error) {
+    flagValues := map[string]string{}
+    f.flags.Visit(func(set *flag.Flag) {
+        if f.names[set.Name] {
+            flagValues[set.Name] = set.Value.String()
+        }
+    })
+    // The environment was read when the run was created
+    noEnv := func(string) string { return "" }
+    configs, _, err := util.LoadConfigs(configs, util.ConfigFile{}, noEnv, flagValues)
+    if err != nil {
+        return configs, err
+    }
+    return configs, util.ValidateConfigs(configs)
+}
+
+// load merges the defaults, the config file, the environment and the flags,
+// logs where each value came from, fills in the default instance types and
+// validates the result.
+func (f *inputFlags) load() (util.Configs, error) {
+    flagValues := map[string]string{}
+    f.flags.Visit(func(set *flag.Flag) {
+        flagValues[set.Name] = set.Value.String()
+    })
+    defaults := util.Configs{
+        VolumeSize:             volumeSizeDefault,
+        AmiId:                  amiIdDefault,
+        OnDemandPercentage:     util.OnDemandPercentageDefault,
+        SpotAllocationStrategy: util.SpotAllocationDefault,
+        FleetType:              util.FleetTypeDefault,
+        DefaultCapacityType:    util.DefaultCapacityTypeDefault,
+    }
+    file := util.ConfigFile{Name: *f.configFile, Format: *f.configFormat, Profile: *f.profile}
+    configs, sources, err := util.LoadConfigs(defaults, file, os.Getenv, flagValues)
+    if err != nil {
+        return configs, err
+    }
+    log.Printf("Using config values:\n%s", util.FormatConfigSources(configs, sources))
+
+    if len(configs.NodeGroups) > 0 {
+        if sources["nodes"] == util.SourceDefault {
+            configs.Nodes = configs.NodeGroupsCount()
+        }
+        for i := range configs.NodeGroups {
+            if len(configs.NodeGroups[i].InstanceTypes) == 0 {
+                configs.NodeGroups[i].InstanceTypes = []string{instanceTypeDefault}
+            }
+        }
+    } else if len(configs.InstanceTypes) == 0 {
+        configs.InstanceTypes = make([]string, configs.Nodes)
+        for i := range configs.InstanceTypes {
+            configs.InstanceTypes[i] = instanceTypeDefault
+        }
+    }
+
+    err = util.ValidateConfigs(configs)
+    if  err != nil {
+        return configs, err
+    }
+    return configs, util.ValidateTags(configs.Tags)
+}
+
+// runFlags select the run that status, scale and destroy work on.
+type runFlags struct {
+    runId     *string
+    stateFile *string
+    stateDir  *string
+}
+
+func addRunFlags(flags *flag.FlagSet) *runFlags {
+    return &runFlags{
+        runId:     flags.String("runId", "", "Run ID printed by a previous run\neg. -runId=20200815-142301-9f1c"),
+        stateFile: flags.String("stateFile", "", "State file written by a previous run\neg. -stateFile=.ec2fleet/20200815-142301-9f1c.json"),
+        stateDir:  flags.String("stateDir", util.StateDirDefault, "Directory holding the state files\n(Optional) Default: .ec2fleet"),
+    }
+}
+
+// load reads the state of the selected run. When only a run ID is given and
+// its state file is gone, the resources are looked up by their run ID tag
+// and the returned StateFile has no Path.
+func (f *runFlags) load(p *util.Provisioner) (*util.StateFile, error) {
+    stateFile := &util.StateFile{Path: *f.stateFile}
+    if stateFile.Path == "" {
+        if *f.runId == "" {
+            return nil, &util.ValidationError{Msg: "Either -runId or -stateFile is required."}
+        }
+        stateFile.Path = util.StateFilePath(*f.stateDir, *f.runId)
+        if _, err := os.Stat(stateFile.Path); os.IsNotExist(err) {
+            log.Println("No state file for run", *f.runId, "- looking up resources by tag", util.RunIdTagKey)
+            state, err := p.FindRunResources(*f.runId)
+            return &util.StateFile{State: state}, err
+        }
+    }
+    state, err := util.LoadRunState(stateFile.Path)
+    stateFile.State = state
+    return stateFile, err
+}
@@ -0,0 +1,70 @@
+/* Copyright (C) Xiang Wang - All Rights Reserved
+ * Unauthorized copying of this file, via any medium is strictly prohibited
+ * Proprietary and confidential
+ * Written by Xiang Wang <xwang1314@gmail.com>, August 2020
+ */
+
+package main
+
+import "encoding/json"
+import "util"
+import "fmt"
+import "os"
+
+
+// plan implements `ec2fleet plan`: it prints the resources a run with the
+// same inputs would create. The only AWS call it makes is the read-only
+// DescribeSubnets that resolves the AZ of the subnets subnetZones does not
+// cover; with -offline subnetZones must cover them all and it makes none.
+func plan(args []string) {
+    flags := newFlagSet("plan", "Print the resources a create with the same inputs would make, without creating them.")
+    inputs := addInputFlags(flags)
+    outputPtr := flags.String("output", "table", "Output format, table or json\n(Optional) Default: table\neg. -output=json")
+    offlinePtr := flags.Bool("offline", false, "Take the AZ of every subnet from -subnetZones instead of looking it up in AWS\n(Optional) Default: false\neg. -offline -subnetZones=sub1=us-east-1a,sub2=us-east-1b")
+    flags.Parse(args)
+
+    configs, err := inputs.load()
+    if err != nil {
+        fail(err)
+    }
+    var subnetZones map[string]string
+    if *offlinePtr {
+        subnetZones, err = configs.OfflineSubnetZones()
+    } else {
+        subnetZones, err = configs.ResolveSubnetZones(func(subnets []string) (map[string]string, error) {
+            return util.NewDefaultProvisioner().GetSubnetAvailabilityZones(subnets)
+        })
+    }
+    if err != nil {
+        fail(err)
+    }
+    tags := util.RunTags("<run ID>", configs.Tags)
+    templateRequest, err := launchTemplateRequest(util.LaunchTemplateName("<run ID>"), configs, tags)
+    if err != nil {
+        fail(err)
+    }
+    template, existing := configs.ExistingLaunchTemplate()
+    if !existing {
+        template = util.LaunchTemplateRef{Id: "<launch template ID>", Version: "1"}
+    }
+    fleetPlan := util.NewPlan(templateRequest,
+                              fleetRequest(configs, subnetZones, template, tags),
+                              configs.VolumeSpecs(),
+                              tags)
+    if existing {
+        fleetPlan.LaunchTemplate = util.PlanLaunchTemplate{Name: template.String(), Existing: true}
+    }
+    switch *outputPtr {
+    case "table":
+        fmt.Print(util.FormatPlan(fleetPlan))
+    case "json":
+        data, err := json.MarshalIndent(fleetPlan, "", "    ")
+        if err != nil {
+            fail(err)
+        }
+        fmt.Println(string(data))
+    default:
+        fail(&util.ValidationError{Msg: "Invalid output format " + *outputPtr + ", must be table or json."})
+    }
+    os.Exit(exitOK)
+}
@@ -0,0 +1,103 @@
+/* Copyright (C) Xiang Wang - All Rights Reserved
+ * Unauthorized copying of this file, via any medium is strictly prohibited
+ * Proprietary and confidential
+ * Written by Xiang Wang <xwang1314@gmail.com>, August 2020
+ */
+
+package main
+
+import "util"
+import "log"
+import "os"
+
+
+// scale implements `ec2fleet scale`: it grows or shrinks the fleet of a run
+// to the given number of nodes.
+func scale(args []string) {
+    flags := newFlagSet("scale", "Grow or shrink the fleet of a run to the given number of nodes.")
+    runs := addRunFlags(flags)
+    nodesPtr      := flags.Int("nodes", 0, "Number of nodes the run should have\n(Require)\neg. -nodes=4")
+    noRollbackPtr := flags.Bool("no-rollback", false, "Keep the resources created by a failed scale up for debugging\n(Optional) Default: false\neg. -no-rollback")
+    // The nodes a scale up adds launch from a new version of the run's
+    // launch template when these change
+    templateFlags := addLaunchTemplateFlags(flags)
+    flags.Parse(args)
+
+    provisioner := util.NewDefaultProvisioner()
+    stateFile, err := runs.load(provisioner)
+    if err != nil {
+        fail(err)
+    }
+    state := stateFile.State
+    if stateFile.Path == "" {
+        fail(&util.ValidationError{Msg: "Scaling needs the state file of the run."})
+    }
+    if state.Status != util.StatusCreated {
+        fail(&util.ValidationError{Msg: "Run " + state.RunId + " is " + state.Status + ", only created runs can be scaled."})
+    }
+    if err := util.Scalable(state); err != nil {
+        fail(err)
+    }
+    if *nodesPtr <= 0 {
+        fail(&util.ValidationError{Msg: "Number of nodes is invalid."})
+    }
+
+    current := len(state.Instances)
+    target := *nodesPtr
+    log.Println("Scaling run", state.RunId, "from", current, "to", target, "nodes")
+    switch {
+    case target == current:
+        log.Println("Run already has", current, "nodes.")
+    case target < current:
+        if err := util.ShrinkRun(provisioner, stateFile, current - target); err != nil {
+            fail(err)
+        }
+        state.Config.RemoveNodes(current - target)
+    default:
+        configs, err := templateFlags.apply(state.Config)
+        if err != nil {
+            fail(err)
+        }
+        if err := scaleUp(provisioner, stateFile, configs, target, *noRollbackPtr); err != nil {
+            fail(err)
+        }
+    }
+    saveState(stateFile)
+    os.Exit(exitOK)
+}
+
+// scaleUp adds nodes to the run of stateFile until it has target, launching
+// them with configs, which then replaces the config of the run. Only the
+// resources of the scale up are rolled back when it fails, unless keep is
+// set.
+func scaleUp(p *util.Provisioner, stateFile *util.StateFile, configs util.Configs, target int, keep bool) error {
+    state := stateFile.State
+    // New nodes cycle through the placements of the run
+    subnetZones, err := p.GetSubnetAvailabilityZones(configs.SubnetIds())
+    if err != nil {
+        return err
+    }
+    nodes := configs.PlaceNodes(subnetZones)
+    added := []util.FleetNode{}
+    for i := len(state.Instances); i < target; i++ {
+        added = append(added, nodes[i % len(nodes)])
+    }
+    r := newRun(p, stateFile)
+    before := *state
+    if err := provision(r, configs.WithNodes(added)); err != nil {
+        if keep {
+            log.Println("Rollback disabled, keeping resources:", r.saga.Pending())
+        } else if rollbackErr := r.saga.Rollback(); rollbackErr != nil {
+            log.Println(rollbackErr)
+            state.Status = util.StatusRollbackFailed
+        } else {
+            *state = before
+        }
+        saveState(stateFile)
+        return err
+    }
+    configs.AddNodes(added)
+    state.Config = configs
+    r.commit()
+    return nil
+}
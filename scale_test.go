@@ -0,0 +1,83 @@
+package main
+
+import "io/ioutil"
+import "strings"
+import "testing"
+import "flag"
+import "util"
+import "os"
+
+
+func TestScaleUpNewTemplateVersion(t *testing.T) {
+    dir, err := ioutil.TempDir("", "ec2fleet")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+    fake := &fakeEC2{}
+    configs := createConfigs()
+    r := newTestRun(fake, configs, dir)
+    if err := r.createResources(configs, false); err != nil {
+        t.Fatalf("TestScaleUpNewTemplateVersion create failed: %v", err)
+    }
+    state := r.stateFile.State
+
+    // Unchanged settings keep the version the run was created with
+    fake.calls = nil
+    if err := scaleUp(util.NewProvisioner(fake), r.stateFile, state.Config, 5, false); err != nil {
+        t.Fatalf("TestScaleUpNewTemplateVersion failed: %v", err)
+    }
+    if strings.Contains(strings.Join(fake.calls, "\n"), "LaunchTemplate") || state.LaunchTemplateVersion != "1" {
+        t.Errorf("TestScaleUpNewTemplateVersion changed the template without new settings: %v", fake.calls)
+    }
+
+    // Only the launch template flags apply, -nodes is the target
+    flags := flag.NewFlagSet("scale", flag.ContinueOnError)
+    flags.Int("nodes", 0, "")
+    templateFlags := addLaunchTemplateFlags(flags)
+    if err := flags.Parse([]string{"-nodes=6", "-amiId=ami-2"}); err != nil {
+        t.Fatal(err)
+    }
+    changed, err := templateFlags.apply(state.Config)
+    if err != nil || changed.AmiId != "ami-2" || changed.Nodes != state.Config.Nodes {
+        t.Fatalf("TestScaleUpNewTemplateVersion applied the flags as %+v, %v", changed, err)
+    }
+    fake.calls = nil
+    if err := scaleUp(util.NewProvisioner(fake), r.stateFile, changed, 6, false); err != nil {
+        t.Fatalf("TestScaleUpNewTemplateVersion failed: %v", err)
+    }
+    if len(fake.calls) == 0 || fake.calls[0] != "CreateLaunchTemplateVersion lt-00000000000000001" {
+        t.Errorf("TestScaleUpNewTemplateVersion made calls %v", fake.calls)
+    }
+    saved, err := util.LoadRunState(r.stateFile.Path)
+    if err != nil || saved.LaunchTemplateVersion != "2" || len(saved.Instances) != 6 {
+        t.Errorf("TestScaleUpNewTemplateVersion saved state %+v, %v", saved, err)
+    }
+    if state.Config.AmiId != "ami-2" || state.Config.Nodes != 6 {
+        t.Errorf("TestScaleUpNewTemplateVersion left the config %+v", state.Config)
+    }
+}
+
+func TestScaleUpOnDemandCount(t *testing.T) {
+    dir, err := ioutil.TempDir("", "ec2fleet")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+    fake := &fakeEC2{}
+    configs := createConfigs()
+    count := 2
+    configs.OnDemandCount = &count
+    r := newTestRun(fake, configs, dir)
+    if err := r.createResources(configs, false); err != nil {
+        t.Fatalf("TestScaleUpOnDemandCount create failed: %v", err)
+    }
+    // The run has its on-demand nodes, the new one is spot
+    if err := scaleUp(util.NewProvisioner(fake), r.stateFile, r.stateFile.State.Config, 5, false); err != nil {
+        t.Fatalf("TestScaleUpOnDemandCount failed: %v", err)
+    }
+    state := r.stateFile.State
+    if len(state.Instances) != 5 || state.Instances[4].Lifecycle != "spot" || *state.Config.OnDemandCount != 2 {
+        t.Errorf("TestScaleUpOnDemandCount got %+v", state.Instances)
+    }
+}
@@ -0,0 +1,211 @@
+/* Copyright (C) Xiang Wang - All Rights Reserved
+ * Unauthorized copying of this file, via any medium is strictly prohibited
+ * Proprietary and confidential
+ * Written by Xiang Wang <xwang1314@gmail.com>, August 2020
+ */
+
+package util
+
+import "github.com/aws/aws-sdk-go/service/ec2"
+import "github.com/aws/aws-sdk-go/aws"
+import "strings"
+import "regexp"
+import "fmt"
+
+
+const (
+    // Root device of the default, Ubuntu, AMI
+    RootDeviceNameDefault = "/dev/sda1"
+    DataVolumeTypeDefault = ec2.VolumeTypeGp3
+)
+
+var deviceName = regexp.MustCompile(`^/dev/(sd[a-z][0-9]*|xvd[a-z]{1,2})$`)
+
+// volumeLimits are the EBS limits of one volume type: size in GiB, IOPS, and
+// the most IOPS per GiB. Types without IOPS limits do not take an IOPS value.
+type volumeLimits struct {
+    minSize, maxSize             int
+    minIops, maxIops             int
+    iopsPerGib                   int
+    iopsRequired                 bool
+    minThroughput, maxThroughput int
+}
+
+var ebsLimits = map[string]volumeLimits{
+    ec2.VolumeTypeGp2:      {minSize: 1, maxSize: 16384},
+    ec2.VolumeTypeGp3:      {minSize: 1, maxSize: 16384, minIops: 3000, maxIops: 16000, iopsPerGib: 500, minThroughput: 125, maxThroughput: 1000},
+    ec2.VolumeTypeIo1:      {minSize: 4, maxSize: 16384, minIops: 100, maxIops: 64000, iopsPerGib: 50, iopsRequired: true},
+    ec2.VolumeTypeIo2:      {minSize: 4, maxSize: 16384, minIops: 100, maxIops: 64000, iopsPerGib: 500, iopsRequired: true},
+    ec2.VolumeTypeSt1:      {minSize: 125, maxSize: 16384},
+    ec2.VolumeTypeSc1:      {minSize: 125, maxSize: 16384},
+    ec2.VolumeTypeStandard: {minSize: 1, maxSize: 1024},
+}
+
+// BlockDevice is one EBS volume of every instance. Zero values keep the
+// defaults: the AMI's for the root volume, gp3 and deleted with the instance
+// for data volumes.
+type BlockDevice struct {
+    DeviceName          string `json:"deviceName,omitempty" yaml:"deviceName" toml:"deviceName"`
+    // GiB
+    Size                int    `json:"size,omitempty" yaml:"size" toml:"size"`
+    Type                string `json:"type,omitempty" yaml:"type" toml:"type"`
+    Iops                int    `json:"iops,omitempty" yaml:"iops" toml:"iops"`
+    // MiB/s, gp3 only
+    Throughput          int    `json:"throughput,omitempty" yaml:"throughput" toml:"throughput"`
+    Encrypted           bool   `json:"encrypted,omitempty" yaml:"encrypted" toml:"encrypted"`
+    DeleteOnTermination *bool  `json:"deleteOnTermination,omitempty" yaml:"deleteOnTermination" toml:"deleteOnTermination"`
+}
+
+// BlockDevices are the root volume and the data volumes of every instance,
+// set in the launch template.
+type BlockDevices struct {
+    Root    *BlockDevice  `json:"root,omitempty" yaml:"root" toml:"root"`
+    Volumes []BlockDevice `json:"volumes,omitempty" yaml:"volumes" toml:"volumes"`
+}
+
+// mapping converts d to a launch template block device mapping.
+func (d BlockDevice) mapping(deviceName, volumeType string, deleteOnTermination bool) *ec2.LaunchTemplateBlockDeviceMappingRequest {
+    ebs := &ec2.LaunchTemplateEbsBlockDeviceRequest{}
+    if d.Size > 0 {
+        ebs.VolumeSize = aws.Int64(int64(d.Size))
+    }
+    if volumeType != "" {
+        ebs.VolumeType = aws.String(volumeType)
+    }
+    if d.Iops > 0 {
+        ebs.Iops = aws.Int64(int64(d.Iops))
+    }
+    if d.Throughput > 0 {
+        ebs.Throughput = aws.Int64(int64(d.Throughput))
+    }
+    if d.Encrypted {
+        ebs.Encrypted = aws.Bool(true)
+    }
+    if d.DeleteOnTermination != nil {
+        deleteOnTermination = *d.DeleteOnTermination
+    }
+    ebs.DeleteOnTermination = aws.Bool(deleteOnTermination)
+    return &ec2.LaunchTemplateBlockDeviceMappingRequest{DeviceName: aws.String(deviceName), Ebs: ebs}
+}
+
+// blockDevice converts a launch template block device mapping back.
+func blockDevice(mapping *ec2.LaunchTemplateBlockDeviceMappingRequest) BlockDevice {
+    ebs := mapping.Ebs
+    if ebs == nil {
+        ebs = &ec2.LaunchTemplateEbsBlockDeviceRequest{}
+    }
+    return BlockDevice{
+        DeviceName:          aws.StringValue(mapping.DeviceName),
+        Size:                int(aws.Int64Value(ebs.VolumeSize)),
+        Type:                aws.StringValue(ebs.VolumeType),
+        Iops:                int(aws.Int64Value(ebs.Iops)),
+        Throughput:          int(aws.Int64Value(ebs.Throughput)),
+        Encrypted:           aws.BoolValue(ebs.Encrypted),
+        DeleteOnTermination: ebs.DeleteOnTermination,
+    }
+}
+
+// String describes d in one line, eg. "/dev/sdg: 100 GiB gp3, 3000 iops".
+func (d BlockDevice) String() string {
+    parts := []string{}
+    if d.Size > 0 {
+        parts = append(parts, fmt.Sprintf("%d GiB", d.Size))
+    }
+    parts = append(parts, orDefault(d.Type, "AMI type"))
+    if d.Iops > 0 {
+        parts = append(parts, fmt.Sprintf("%d iops", d.Iops))
+    }
+    if d.Throughput > 0 {
+        parts = append(parts, fmt.Sprintf("%d MiB/s", d.Throughput))
+    }
+    if d.Encrypted {
+        parts = append(parts, "encrypted")
+    }
+    if d.DeleteOnTermination != nil && !*d.DeleteOnTermination {
+        parts = append(parts, "kept on termination")
+    }
+    return d.DeviceName + ": " + strings.Join(parts, ", ")
+}
+
+// Mappings returns the launch template block device mappings of b.
+func (b *BlockDevices) Mappings() []*ec2.LaunchTemplateBlockDeviceMappingRequest {
+    if b == nil {
+        return nil
+    }
+    mappings := []*ec2.LaunchTemplateBlockDeviceMappingRequest{}
+    if root := b.Root; root != nil {
+        mappings = append(mappings, root.mapping(orDefault(root.DeviceName, RootDeviceNameDefault), root.Type, true))
+    }
+    for _, volume := range b.Volumes {
+        mappings = append(mappings, volume.mapping(volume.DeviceName, orDefault(volume.Type, DataVolumeTypeDefault), true))
+    }
+    return mappings
+}
+
+// validate checks d against the limits of its volume type.
+func (d BlockDevice) validate(name, volumeType string) ValidationErrors {
+    errs := ValidationErrors{}
+    limits, ok := ebsLimits[volumeType]
+    if !ok {
+        return append(errs, &ValidationError{Msg: fmt.Sprintf("%s: invalid volume type %q, must be one of gp2, gp3, io1, io2, st1, sc1 or standard.", name, volumeType)})
+    }
+    if d.Size != 0 && (d.Size < limits.minSize || d.Size > limits.maxSize) {
+        errs = append(errs, &ValidationError{Msg: fmt.Sprintf("%s: %s size must be between %d-%d GiB inclusively.", name, volumeType, limits.minSize, limits.maxSize)})
+    }
+    switch {
+    case limits.maxIops == 0 && d.Iops != 0:
+        errs = append(errs, &ValidationError{Msg: fmt.Sprintf("%s: %s volumes do not take iops.", name, volumeType)})
+    case limits.iopsRequired && d.Iops == 0:
+        errs = append(errs, &ValidationError{Msg: fmt.Sprintf("%s: %s volumes need iops.", name, volumeType)})
+    case d.Iops != 0 && (d.Iops < limits.minIops || d.Iops > limits.maxIops):
+        errs = append(errs, &ValidationError{Msg: fmt.Sprintf("%s: %s iops must be between %d-%d inclusively.", name, volumeType, limits.minIops, limits.maxIops)})
+    case d.Iops != 0 && d.Size != 0 && d.Iops > limits.iopsPerGib * d.Size:
+        errs = append(errs, &ValidationError{Msg: fmt.Sprintf("%s: %s volumes allow at most %d iops per GiB, %d for %d GiB.", name, volumeType, limits.iopsPerGib, limits.iopsPerGib * d.Size, d.Size)})
+    }
+    switch {
+    case limits.maxThroughput == 0 && d.Throughput != 0:
+        errs = append(errs, &ValidationError{Msg: fmt.Sprintf("%s: only gp3 volumes take throughput.", name)})
+    case d.Throughput != 0 && (d.Throughput < limits.minThroughput || d.Throughput > limits.maxThroughput):
+        errs = append(errs, &ValidationError{Msg: fmt.Sprintf("%s: %s throughput must be between %d-%d MiB/s inclusively.", name, volumeType, limits.minThroughput, limits.maxThroughput)})
+    }
+    return errs
+}
+
+// validateBlockDevices checks the device names, sizes and IOPS of the block devices.
+func validateBlockDevices(c Configs) ValidationErrors {
+    errs := ValidationErrors{}
+    b := c.BlockDevices
+    if b == nil {
+        return errs
+    }
+    used := map[string]string{}
+    checkName := func(name, device string) {
+        if !deviceName.MatchString(device) {
+            errs = append(errs, &ValidationError{Msg: fmt.Sprintf("%s: invalid device name %q, eg. /dev/sdg or /dev/xvdg.", name, device)})
+        } else if other, ok := used[device]; ok {
+            errs = append(errs, &ValidationError{Msg: fmt.Sprintf("%s: device %s is already used by %s.", name, device, other)})
+        }
+        used[device] = name
+    }
+    if root := b.Root; root != nil {
+        checkName("Root volume", orDefault(root.DeviceName, RootDeviceNameDefault))
+        // The AMI decides the type of the root volume when none is given
+        switch {
+        case root.Type != "":
+            errs = append(errs, root.validate("Root volume", root.Type)...)
+        case root.Iops != 0 || root.Throughput != 0:
+            errs = append(errs, &ValidationError{Msg: "Root volume: iops and throughput need a type."})
+        case root.Size < 0 || root.Size > 16384:
+            errs = append(errs, &ValidationError{Msg: "Root volume: size must be between 1-16384 GiB inclusively."})
+        }
+    }
+    for i, volume := range b.Volumes {
+        name := fmt.Sprintf("Block device %d", i + 1)
+        checkName(name, volume.DeviceName)
+        if volume.Size <= 0 {
+            errs = append(errs, &ValidationError{Msg: name + ": needs a size."})
+        }
+        errs = append(errs, volume.validate(name, orDefault(volume.Type, DataVolumeTypeDefault))...)
+    }
+    return errs
+}
@@ -0,0 +1,110 @@
+package util
+
+import "github.com/aws/aws-sdk-go/aws"
+import "path/filepath"
+import "io/ioutil"
+import "strings"
+import "os"
+import "testing"
+
+
+func TestBlockDevicesMappings(t *testing.T) {
+    keep := false
+    configs := purchasingConfigs()
+    configs.BlockDevices = &BlockDevices{
+        Root: &BlockDevice{Size: 20, Encrypted: true},
+        Volumes: []BlockDevice{
+            {DeviceName: "/dev/sdg", Size: 100, Iops: 4000, Throughput: 250},
+            {DeviceName: "/dev/sdh", Size: 500, Type: "st1", DeleteOnTermination: &keep},
+        },
+    }
+    if err := ValidateConfigs(configs); err != nil {
+        t.Fatalf("TestBlockDevicesMappings failed: %v", err)
+    }
+    template := GetCreateLaunchTemplateInput("name", "ami-1", "t3.micro", []string{"sg1"}, nil)
+    configs.SetLaunchTemplateOptions(template.LaunchTemplateData)
+    mappings := template.LaunchTemplateData.BlockDeviceMappings
+    if len(mappings) != 3 {
+        t.Fatalf("TestBlockDevicesMappings got %v", mappings)
+    }
+    root, data, cold := mappings[0], mappings[1].Ebs, mappings[2].Ebs
+    if aws.StringValue(root.DeviceName) != RootDeviceNameDefault || root.Ebs.VolumeType != nil || aws.Int64Value(root.Ebs.VolumeSize) != 20 ||
+       !aws.BoolValue(root.Ebs.Encrypted) || !aws.BoolValue(root.Ebs.DeleteOnTermination) {
+        t.Errorf("TestBlockDevicesMappings root %v", root)
+    }
+    if aws.StringValue(data.VolumeType) != "gp3" || aws.Int64Value(data.Iops) != 4000 || aws.Int64Value(data.Throughput) != 250 {
+        t.Errorf("TestBlockDevicesMappings data volume %v", data)
+    }
+    if aws.StringValue(cold.VolumeType) != "st1" || aws.BoolValue(cold.DeleteOnTermination) {
+        t.Errorf("TestBlockDevicesMappings st1 volume %v", cold)
+    }
+
+    fleet := GetCreateFleetRequestInput(configs.FleetNodes(), LaunchTemplateRef{Id: "lt-1", Version: "1"}, map[string]string{"sub1": "us-east-1a"}, configs, nil)
+    table := FormatPlan(NewPlan(template, fleet, []VolumeSpec{{Size: 4}}, nil))
+    if !strings.Contains(table, "/dev/sdg: 100 GiB, gp3, 4000 iops, 250 MiB/s") || !strings.Contains(table, "/dev/sdh: 500 GiB, st1, kept on termination") {
+        t.Errorf("TestBlockDevicesMappings plan:\n%s", table)
+    }
+}
+
+func TestBlockDevicesValidate(t *testing.T) {
+    configs := purchasingConfigs()
+    configs.BlockDevices = &BlockDevices{
+        Root: &BlockDevice{Iops: 3000},
+        Volumes: []BlockDevice{
+            {DeviceName: "/dev/sda1", Size: 10},
+            {DeviceName: "sdg", Size: 10},
+            {DeviceName: "/dev/sdh", Size: 4, Type: "io1"},
+            {DeviceName: "/dev/sdi", Size: 4, Type: "io2", Iops: 4000},
+            {DeviceName: "/dev/sdj", Size: 100, Type: "gp2", Throughput: 200},
+            {DeviceName: "/dev/sdj", Size: 100, Type: "gp4"},
+            {DeviceName: "/dev/sdk", Size: 20000},
+        },
+    }
+    errs, ok := ValidateConfigs(configs).(ValidationErrors)
+    expected := []string{
+        "Root volume: iops and throughput need a type.",
+        "Block device 1: device /dev/sda1 is already used by Root volume.",
+        "Block device 2: invalid device name \"sdg\"",
+        "Block device 3: io1 volumes need iops.",
+        "Block device 4: io2 volumes allow at most 500 iops per GiB, 2000 for 4 GiB.",
+        "Block device 5: only gp3 volumes take throughput.",
+        "Block device 6: device /dev/sdj is already used by Block device 5.",
+        "Block device 6: invalid volume type \"gp4\"",
+        "Block device 7: gp3 size must be between 1-16384 GiB inclusively.",
+    }
+    if !ok || len(errs) != len(expected) {
+        t.Fatalf("TestBlockDevicesValidate got %v", errs)
+    }
+    for i, msg := range expected {
+        if !strings.HasPrefix(errs[i].Error(), msg) {
+            t.Errorf("TestBlockDevicesValidate error %d: got %q, expected %q", i, errs[i], msg)
+        }
+    }
+}
+
+func TestBlockDevicesConfigFile(t *testing.T) {
+    dir, err := ioutil.TempDir("", "ec2fleet")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+    yamlFile := filepath.Join(dir, "config.yaml")
+    ioutil.WriteFile(yamlFile, []byte("blockDevices:\n  root: {size: 20, type: gp3}\n  volumes:\n    - {deviceName: /dev/sdg, size: 100}\n"), 0644)
+    tomlFile := filepath.Join(dir, "config.toml")
+    ioutil.WriteFile(tomlFile, []byte("[blockDevices.root]\nsize = 20\ntype = \"gp3\"\n[[blockDevices.volumes]]\ndeviceName = \"/dev/sdg\"\nsize = 100\n"), 0644)
+    for _, filename := range []string{yamlFile, tomlFile} {
+        configs, _, err := LoadConfigs(Configs{}, ConfigFile{Name: filename}, func(string) string { return "" }, nil)
+        if err != nil {
+            t.Fatalf("TestBlockDevicesConfigFile %s failed: %v", filename, err)
+        }
+        b := configs.BlockDevices
+        if b == nil || b.Root.Size != 20 || len(b.Volumes) != 1 || b.Volumes[0].DeviceName != "/dev/sdg" {
+            t.Errorf("TestBlockDevicesConfigFile %s got %+v", filename, b)
+        }
+    }
+    configs, _, err := LoadConfigs(Configs{}, ConfigFile{}, func(string) string { return "" },
+                                   map[string]string{"blockDevices": `{"volumes": [{"deviceName": "/dev/sdg", "size": 100}]}`})
+    if err != nil || configs.BlockDevices.Volumes[0].Size != 100 {
+        t.Errorf("TestBlockDevicesConfigFile flag got %+v, %v", configs.BlockDevices, err)
+    }
+}
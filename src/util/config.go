@@ -0,0 +1,183 @@
+/* Copyright (C) Xiang Wang - All Rights Reserved
+ * Unauthorized copying of this file, via any medium is strictly prohibited
+ * Proprietary and confidential
+ * Written by Xiang Wang <xwang1314@gmail.com>, August 2020
+ */
+
+package util
+
+import "encoding/json"
+import "strconv"
+import "reflect"
+import "strings"
+import "sort"
+import "fmt"
+
+
+// Where a config value came from, from lowest to highest precedence
+const (
+    SourceDefault = "default"
+    SourceFile    = "file"
+    SourceEnv     = "env"
+    SourceFlag    = "flag"
+)
+
+// ConfigSources maps the name of every Configs field, as used in the JSON
+// config file and on the command line, to the source of its final value.
+type ConfigSources map[string]string
+
+// LoadConfigs merges defaults, the config file, environment variables and
+// flags, in that order of precedence. Each Configs field is named by its json
+// tag in the file and on the command line, and by its env tag in the
+// environment. flagValues holds only the flags set on the command line.
+func LoadConfigs(defaults Configs,
+                 file ConfigFile,
+                 getenv func(string) string,
+                 flagValues map[string]string) (Configs, ConfigSources, error) {
+    configs := defaults
+    sources := ConfigSources{}
+    value := reflect.ValueOf(&configs).Elem()
+    fields := value.Type()
+    for i := 0; i < fields.NumField(); i++ {
+        sources[configName(fields.Field(i))] = SourceDefault
+    }
+
+    if file.Name != "" {
+        fileConfigs, fileSources, err := readConfigFile(file, getenv)
+        if err != nil {
+            return configs, sources, err
+        }
+        fileValue := reflect.ValueOf(fileConfigs)
+        for i := 0; i < fields.NumField(); i++ {
+            name := configName(fields.Field(i))
+            if source, ok := fileSources[name]; ok {
+                value.Field(i).Set(fileValue.Field(i))
+                sources[name] = source
+            }
+        }
+    } else if file.Profile != "" {
+        return configs, sources, &ValidationError{Msg: "A profile needs a config file, use -configFile"}
+    }
+
+    for i := 0; i < fields.NumField(); i++ {
+        env := fields.Field(i).Tag.Get("env")
+        if env == "" {
+            continue
+        }
+        if str := getenv(env); str != "" {
+            if err := setConfigField(value.Field(i), str); err != nil {
+                return configs, sources, &ValidationError{Msg: "Invalid value for environment variable " + env, Err: err}
+            }
+            sources[configName(fields.Field(i))] = SourceEnv
+        }
+    }
+
+    for i := 0; i < fields.NumField(); i++ {
+        name := configName(fields.Field(i))
+        if str, ok := flagValues[name]; ok {
+            if err := setConfigField(value.Field(i), str); err != nil {
+                return configs, sources, &ValidationError{Msg: "Invalid value for flag -" + name, Err: err}
+            }
+            sources[name] = SourceFlag
+        }
+    }
+    return configs, sources, nil
+}
+
+// ConfigFieldNames returns the names of every Configs field.
+func ConfigFieldNames() []string {
+    names := []string{}
+    fields := reflect.TypeOf(Configs{})
+    for i := 0; i < fields.NumField(); i++ {
+        names = append(names, configName(fields.Field(i)))
+    }
+    return names
+}
+
+// FormatConfigSources renders every config value with its source.
+func FormatConfigSources(configs Configs, sources ConfigSources) string {
+    lines := []string{}
+    value := reflect.ValueOf(configs)
+    fields := value.Type()
+    for i := 0; i < fields.NumField(); i++ {
+        name := configName(fields.Field(i))
+        lines = append(lines, fmt.Sprintf("  %-16s %-12s %v", name, sources[name], formatConfigField(value.Field(i))))
+    }
+    return strings.Join(lines, "\n")
+}
+
+func configName(field reflect.StructField) string {
+    return strings.Split(field.Tag.Get("json"), ",")[0]
+}
+
+// setConfigField parses the string form used by flags and environment
+// variables: lists are comma separated, maps are key=value pairs and
+// anything else is given as JSON.
+func setConfigField(field reflect.Value, str string) error {
+    switch field.Kind() {
+    case reflect.String:
+        field.SetString(str)
+    case reflect.Int, reflect.Int64:
+        n, err := strconv.ParseInt(str, 10, 64)
+        if err != nil {
+            return err
+        }
+        field.SetInt(n)
+    case reflect.Bool:
+        b, err := strconv.ParseBool(str)
+        if err != nil {
+            return err
+        }
+        field.SetBool(b)
+    case reflect.Float64:
+        f, err := strconv.ParseFloat(str, 64)
+        if err != nil {
+            return err
+        }
+        field.SetFloat(f)
+    case reflect.Slice:
+        if field.Type().Elem().Kind() != reflect.String {
+            return json.Unmarshal([]byte(str), field.Addr().Interface())
+        }
+        field.Set(reflect.ValueOf(strings.Split(str, ",")))
+    case reflect.Map:
+        pairs, err := ParseTags(str)
+        if err != nil {
+            return err
+        }
+        values := reflect.MakeMap(field.Type())
+        for key, pair := range pairs {
+            value := reflect.New(field.Type().Elem()).Elem()
+            if err := setConfigField(value, pair); err != nil {
+                return err
+            }
+            values.SetMapIndex(reflect.ValueOf(key), value)
+        }
+        field.Set(values)
+    default:
+        return json.Unmarshal([]byte(str), field.Addr().Interface())
+    }
+    return nil
+}
+
+func formatConfigField(field reflect.Value) string {
+    switch field.Kind() {
+    case reflect.Slice:
+        if field.Type().Elem().Kind() == reflect.String {
+            return strings.Join(field.Interface().([]string), ",")
+        }
+        data, _ := json.Marshal(field.Interface())
+        return string(data)
+    case reflect.Struct, reflect.Ptr:
+        data, _ := json.Marshal(field.Interface())
+        return string(data)
+    case reflect.Map:
+        pairs := []string{}
+        for _, key := range field.MapKeys() {
+            pairs = append(pairs, fmt.Sprintf("%v=%v", key, field.MapIndex(key)))
+        }
+        sort.Strings(pairs)
+        return strings.Join(pairs, ",")
+    }
+    return fmt.Sprint(field.Interface())
+}
@@ -0,0 +1,414 @@
+package util
+
+import "path/filepath"
+import "io/ioutil"
+import "reflect"
+import "strings"
+import "errors"
+import "os"
+import "testing"
+
+
+func TestConfigLayers(t *testing.T) {
+    dir, err := ioutil.TempDir("", "ec2fleet")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+    filename := filepath.Join(dir, "config.json")
+    ioutil.WriteFile(filename, []byte(`{"nodes": 2, "amiId": "ami-file", "subnets": ["sub1", "sub2"]}`), 0644)
+    env := map[string]string{"NUMBER_OF_NODES": "3", "SUBNET_IDS": "sub1,sub2,sub3", "TAGS": "team=storage"}
+    flags := map[string]string{"nodes": "4"}
+
+    configs, sources, err := LoadConfigs(Configs{VolumeSize: 3, AmiId: "ami-default"}, ConfigFile{Name: filename},
+                                         func(name string) string { return env[name] }, flags)
+    if err != nil {
+        t.Fatalf("TestConfigLayers failed: %v", err)
+    }
+    if configs.Nodes != 4 || sources["nodes"] != SourceFlag {
+        t.Errorf("TestConfigLayers nodes %d from %s", configs.Nodes, sources["nodes"])
+    }
+    if len(configs.Subnets) != 3 || sources["subnets"] != SourceEnv {
+        t.Errorf("TestConfigLayers subnets %v from %s", configs.Subnets, sources["subnets"])
+    }
+    if configs.AmiId != "ami-file" || sources["amiId"] != SourceFile {
+        t.Errorf("TestConfigLayers amiId %s from %s", configs.AmiId, sources["amiId"])
+    }
+    if configs.VolumeSize != 3 || sources["volumeSize"] != SourceDefault {
+        t.Errorf("TestConfigLayers volumeSize %d from %s", configs.VolumeSize, sources["volumeSize"])
+    }
+    if configs.Tags["team"] != "storage" || sources["tags"] != SourceEnv {
+        t.Errorf("TestConfigLayers tags %v from %s", configs.Tags, sources["tags"])
+    }
+}
+
+func TestConfigLayersEnvTagNames(t *testing.T) {
+    // Only the names of the env tags are read, not the field names
+    env := map[string]string{"NODES": "7", "nodes": "7", "AMIID": "ami-generic", "AMI_ID": "ami-env"}
+    read := map[string]bool{}
+    configs, sources, err := LoadConfigs(Configs{Nodes: 2}, ConfigFile{}, func(name string) string {
+        read[name] = true
+        return env[name]
+    }, nil)
+    if err != nil || configs.Nodes != 2 || configs.AmiId != "ami-env" || sources["amiId"] != SourceEnv {
+        t.Errorf("TestConfigLayersEnvTagNames got %+v, %v", configs, err)
+    }
+    // Every field has an env name of its own
+    fields := reflect.TypeOf(Configs{})
+    names := map[string]bool{}
+    for i := 0; i < fields.NumField(); i++ {
+        name := fields.Field(i).Tag.Get("env")
+        if name == "" || names[name] {
+            t.Errorf("TestConfigLayersEnvTagNames field %s has env name %q", fields.Field(i).Name, name)
+        }
+        names[name] = true
+    }
+    if !reflect.DeepEqual(read, names) {
+        t.Errorf("TestConfigLayersEnvTagNames read %v", read)
+    }
+}
+
+func TestConfigLayersInvalidValue(t *testing.T) {
+    _, _, err := LoadConfigs(Configs{}, ConfigFile{}, func(string) string { return "" }, map[string]string{"nodes": "two"})
+    if err == nil {
+        t.Errorf("TestConfigLayersInvalidValue accepted -nodes=two")
+    }
+}
+
+func TestConfigEveryFieldHasEnv(t *testing.T) {
+    fields := reflect.TypeOf(Configs{})
+    for i := 0; i < fields.NumField(); i++ {
+        if fields.Field(i).Tag.Get("env") == "" {
+            t.Errorf("TestConfigEveryFieldHasEnv: %s has no env tag", fields.Field(i).Name)
+        }
+    }
+}
+
+func TestConfigFileStrict(t *testing.T) {
+    dir, err := ioutil.TempDir("", "ec2fleet")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+    filename := filepath.Join(dir, "config.json")
+    getenv := func(string) string { return "" }
+
+    ioutil.WriteFile(filename, []byte("{\n  \"nodes\": 2,\n  \"instanceType\": [\"t3.micro\"]\n}"), 0644)
+    _, _, err = LoadConfigs(Configs{}, ConfigFile{Name: filename}, getenv, nil)
+    if err == nil || !strings.Contains(err.Error(), filename+":3:3: unknown field \"instanceType\"") {
+        t.Errorf("TestConfigFileStrict unknown field: %v", err)
+    }
+
+    ioutil.WriteFile(filename, []byte("{\n  \"nodes\": \"two\"\n}"), 0644)
+    _, _, err = LoadConfigs(Configs{}, ConfigFile{Name: filename}, getenv, nil)
+    if err == nil || !strings.Contains(err.Error(), filename+":2:") || !strings.Contains(err.Error(), `"nodes"`) {
+        t.Errorf("TestConfigFileStrict type error: %v", err)
+    }
+    var validationErr *ValidationError
+    if !errors.As(err, &validationErr) {
+        t.Errorf("TestConfigFileStrict type error is not a ValidationError: %v", err)
+    }
+}
+
+func TestConfigValidateInputsCollectsAll(t *testing.T) {
+    err := ValidateInputs(0, 1, []string{""}, nil, nil)
+    errs, ok := err.(ValidationErrors)
+    if !ok || len(errs) != 4 {
+        t.Fatalf("TestConfigValidateInputsCollectsAll got %v", err)
+    }
+    var validationErr *ValidationError
+    if !errors.As(err, &validationErr) {
+        t.Errorf("TestConfigValidateInputsCollectsAll is not a ValidationError: %v", err)
+    }
+}
+
+func TestConfigFormats(t *testing.T) {
+    getenv := func(string) string { return "" }
+    expected, _, err := LoadConfigs(Configs{}, ConfigFile{Name: "../../etc/config.json"}, getenv, nil)
+    if err != nil {
+        t.Fatalf("TestConfigFormats json: %v", err)
+    }
+    for _, filename := range []string{"../../etc/config.yaml", "../../etc/config.toml"} {
+        configs, sources, err := LoadConfigs(Configs{}, ConfigFile{Name: filename}, getenv, nil)
+        if err != nil {
+            t.Errorf("TestConfigFormats %s: %v", filename, err)
+            continue
+        }
+        if !reflect.DeepEqual(configs, expected) || sources["tags"] != SourceFile {
+            t.Errorf("TestConfigFormats %s got %+v, expected %+v", filename, configs, expected)
+        }
+    }
+    if _, err := ConfigFormat("config.conf", ""); err == nil {
+        t.Errorf("TestConfigFormats accepted an unknown extension")
+    }
+}
+
+func TestConfigFileStrictYAMLTOML(t *testing.T) {
+    dir, err := ioutil.TempDir("", "ec2fleet")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+    getenv := func(string) string { return "" }
+
+    files := map[string]string{
+        "config.yaml": "nodes: 2\ninstanceType: [t3.micro]\n",
+        "config.toml": "nodes = 2\ninstanceType = [\"t3.micro\"]\n",
+    }
+    for name, content := range files {
+        filename := filepath.Join(dir, name)
+        ioutil.WriteFile(filename, []byte(content), 0644)
+        _, _, err = LoadConfigs(Configs{}, ConfigFile{Name: filename}, getenv, nil)
+        if err == nil || !strings.Contains(err.Error(), filename+":2:1: unknown field \"instanceType\"") {
+            t.Errorf("TestConfigFileStrictYAMLTOML %s: %v", name, err)
+        }
+    }
+
+    filename := filepath.Join(dir, "config")
+    ioutil.WriteFile(filename, []byte("nodes: two\n"), 0644)
+    _, _, err = LoadConfigs(Configs{}, ConfigFile{Name: filename, Format: ConfigFormatYAML}, getenv, nil)
+    if err == nil || !strings.Contains(err.Error(), filename+":1:1: field \"nodes\"") {
+        t.Errorf("TestConfigFileStrictYAMLTOML type error: %v", err)
+    }
+}
+
+func TestConfigFileStrictNestedPositions(t *testing.T) {
+    dir, err := ioutil.TempDir("", "ec2fleet")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+    getenv := func(string) string { return "" }
+
+    filename := filepath.Join(dir, "config.yaml")
+    yaml := "nodes: 2\n" +
+            "sharedVolumes:\n" +
+            "  - name: data\n" +
+            "    size: 10\n" +
+            "  - name: log\n" +
+            "    sise: 5\n" +
+            "blockDevices:\n" +
+            "  root:\n" +
+            "    size: 20\n" +
+            "  volumes:\n" +
+            "    - deviceName: /dev/sdb\n" +
+            "      sizee: 10\n"
+    ioutil.WriteFile(filename, []byte(yaml), 0644)
+    _, _, err = LoadConfigs(Configs{}, ConfigFile{Name: filename}, getenv, nil)
+    for _, expected := range []string{
+        filename + ":6:5: unknown field \"sharedVolumes.sise\"",
+        filename + ":12:7: unknown field \"blockDevices.volumes.sizee\"",
+    } {
+        if err == nil || !strings.Contains(err.Error(), expected) {
+            t.Errorf("TestConfigFileStrictNestedPositions yaml expected %s: %v", expected, err)
+        }
+    }
+
+    filename = filepath.Join(dir, "config.toml")
+    toml := "nodes = 2\n" +
+            "\n" +
+            "[blockDevices]\n" +
+            "root = { size = 20, bogus = 1 }\n" +
+            "\n" +
+            "[[blockDevices.volumes]]\n" +
+            "deviceName = \"/dev/sdb\"\n" +
+            "sizee = 10\n"
+    ioutil.WriteFile(filename, []byte(toml), 0644)
+    _, _, err = LoadConfigs(Configs{}, ConfigFile{Name: filename}, getenv, nil)
+    for _, expected := range []string{
+        filename + ":4:21: unknown field \"blockDevices.root.bogus\"",
+        filename + ":8:1: unknown field \"blockDevices.volumes.sizee\"",
+    } {
+        if err == nil || !strings.Contains(err.Error(), expected) {
+            t.Errorf("TestConfigFileStrictNestedPositions toml expected %s: %v", expected, err)
+        }
+    }
+}
+
+func TestConfigFileReportsAllProblems(t *testing.T) {
+    dir, err := ioutil.TempDir("", "ec2fleet")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+    getenv := func(string) string { return "" }
+
+    files := map[string]string{
+        "config.yaml": "nodes: abc\ninstanceType: t3.micro\namiId: ${AMI}\n",
+        "config.json": "{\n  \"nodes\": \"x\",\n  \"instanceType\": \"t3.micro\",\n  \"amiId\": \"${AMI}\"\n}",
+    }
+    for name, content := range files {
+        filename := filepath.Join(dir, name)
+        ioutil.WriteFile(filename, []byte(content), 0644)
+        _, _, err = LoadConfigs(Configs{}, ConfigFile{Name: filename}, getenv, nil)
+        errs, ok := err.(ValidationErrors)
+        if !ok || len(errs) != 3 {
+            t.Errorf("TestConfigFileReportsAllProblems %s: %v", name, err)
+            continue
+        }
+        for _, expected := range []string{"unknown field \"instanceType\"", "environment variable AMI is not set", "field \"nodes\" must be int"} {
+            if !strings.Contains(err.Error(), expected) {
+                t.Errorf("TestConfigFileReportsAllProblems %s missed %s: %v", name, expected, err)
+            }
+        }
+    }
+}
+
+func TestConfigProfiles(t *testing.T) {
+    getenv := func(string) string { return "" }
+    file := ConfigFile{Name: "../../etc/profiles.yaml", Profile: "perf"}
+    configs, sources, err := LoadConfigs(Configs{}, file, getenv, nil)
+    if err != nil {
+        t.Fatalf("TestConfigProfiles failed: %v", err)
+    }
+    if configs.Nodes != 4 || sources["nodes"] != "file:perf" {
+        t.Errorf("TestConfigProfiles nodes %d from %s", configs.Nodes, sources["nodes"])
+    }
+    // perf inherits staging, which inherits dev
+    if configs.SecurityGroups[0] != "sg-0a1b2c3d4e5f60718" || sources["securityGroups"] != "file:staging" {
+        t.Errorf("TestConfigProfiles securityGroups %v from %s", configs.SecurityGroups, sources["securityGroups"])
+    }
+    if configs.AmiId != "ami-0bcc094591f354be2" || sources["amiId"] != SourceFile {
+        t.Errorf("TestConfigProfiles amiId %s from %s", configs.AmiId, sources["amiId"])
+    }
+
+    file.Profile = "missing"
+    if _, _, err := LoadConfigs(Configs{}, file, getenv, nil); err == nil {
+        t.Errorf("TestConfigProfiles accepted an unknown profile")
+    }
+}
+
+func TestConfigProfilesStrict(t *testing.T) {
+    dir, err := ioutil.TempDir("", "ec2fleet")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+    getenv := func(string) string { return "" }
+    filename := filepath.Join(dir, "config.json")
+
+    ioutil.WriteFile(filename, []byte(`{"profiles": {"a": {"inherits": "b"}, "b": {"inherits": "a"}}}`), 0644)
+    _, _, err = LoadConfigs(Configs{}, ConfigFile{Name: filename, Profile: "a"}, getenv, nil)
+    if err == nil || !strings.Contains(err.Error(), "a -> b -> a") {
+        t.Errorf("TestConfigProfilesStrict loop: %v", err)
+    }
+
+    ioutil.WriteFile(filename, []byte("{\n  \"nodes\": 2,\n  \"profiles\": {\n    \"dev\": {\n      \"nodes\": true\n    }\n  }\n}"), 0644)
+    _, _, err = LoadConfigs(Configs{}, ConfigFile{Name: filename}, getenv, nil)
+    if err == nil || !strings.Contains(err.Error(), filename+":5:7: field \"nodes\"") {
+        t.Errorf("TestConfigProfilesStrict type error: %v", err)
+    }
+
+    filename = filepath.Join(dir, "config.toml")
+    ioutil.WriteFile(filename, []byte("nodes = 2\n\n[profiles.dev]\nnodes = 3\ninstanceType = [\"t3.micro\"]\n"), 0644)
+    _, _, err = LoadConfigs(Configs{}, ConfigFile{Name: filename, Profile: "dev"}, getenv, nil)
+    if err == nil || !strings.Contains(err.Error(), filename+":5:1: unknown field \"instanceType\"") {
+        t.Errorf("TestConfigProfilesStrict unknown field: %v", err)
+    }
+}
+
+func TestConfigInterpolation(t *testing.T) {
+    dir, err := ioutil.TempDir("", "ec2fleet")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+    env := map[string]string{"AMI": "ami-env", "SG": "sg1"}
+    getenv := func(name string) string { return env[name] }
+    filename := filepath.Join(dir, "config.yaml")
+
+    ioutil.WriteFile(filename, []byte(`
+vars:
+  Subnet: sub1
+nodes: ${NODES:-3}
+amiId: ${AMI}
+securityGroups: '{{ env "SG" }}'
+subnets: '{{ repeat .Subnet .Nodes }}'
+instanceTypes: '{{ cycle (list "t3.micro" "t3.small") .Nodes }}'
+tags:
+  cost: $$5
+profiles:
+  big:
+    nodes: 4
+`), 0644)
+    configs, _, err := LoadConfigs(Configs{}, ConfigFile{Name: filename}, getenv, nil)
+    if err != nil {
+        t.Fatalf("TestConfigInterpolation failed: %v", err)
+    }
+    expected := Configs{
+        Nodes:          3,
+        AmiId:          "ami-env",
+        Subnets:        []string{"sub1", "sub1", "sub1"},
+        SecurityGroups: []string{"sg1"},
+        InstanceTypes:  []string{"t3.micro", "t3.small", "t3.micro"},
+        Tags:           map[string]string{"cost": "$5"},
+    }
+    if !reflect.DeepEqual(configs, expected) {
+        t.Errorf("TestConfigInterpolation got %+v, expected %+v", configs, expected)
+    }
+    // Templates see the fields of the selected profile
+    configs, _, err = LoadConfigs(Configs{}, ConfigFile{Name: filename, Profile: "big"}, getenv, nil)
+    if err != nil || len(configs.Subnets) != 4 {
+        t.Errorf("TestConfigInterpolation profile got %v, %v", configs.Subnets, err)
+    }
+
+    delete(env, "AMI")
+    _, _, err = LoadConfigs(Configs{}, ConfigFile{Name: filename}, getenv, nil)
+    if err == nil || !strings.Contains(err.Error(), filename+":5:1: environment variable AMI is not set") {
+        t.Errorf("TestConfigInterpolation undefined variable: %v", err)
+    }
+
+    ioutil.WriteFile(filename, []byte(`subnets: "{{ repeat .Missing 2 }}"`), 0644)
+    _, _, err = LoadConfigs(Configs{}, ConfigFile{Name: filename}, getenv, nil)
+    if err == nil || !strings.Contains(err.Error(), "Missing") {
+        t.Errorf("TestConfigInterpolation undefined template variable: %v", err)
+    }
+}
+
+func TestConfigInterpolationValuesOnly(t *testing.T) {
+    dir, err := ioutil.TempDir("", "ec2fleet")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+    // Values that would change the structure of the file if pasted into it
+    env := map[string]string{
+        "AMI":   `ami-1", "nodes": 9, "x": "`,
+        "TAG":   "a\nnodes: 9",
+        "QUOTE": `it's "quoted"`,
+    }
+    getenv := func(name string) string { return env[name] }
+    cases := []struct {
+        name string
+        file string
+    }{
+        {"config.json", `{"nodes": "${NODES:-2}", "amiId": "${AMI}", "tags": {"team": "${TAG}", "note": "${QUOTE}"}}`},
+        {"config.yaml", "# ${UNSET} in a comment\nnodes: ${NODES:-2} # ${UNSET}\namiId: ${AMI}\ntags:\n  team: ${TAG}\n  note: '${QUOTE}'\n"},
+        {"config.toml", "# ${UNSET} in a comment\nnodes = \"${NODES:-2}\" # ${UNSET}\namiId = '${AMI}'\n[tags]\nteam = \"${TAG}\"\nnote = \"${QUOTE}\"\n"},
+    }
+    for _, c := range cases {
+        filename := filepath.Join(dir, c.name)
+        ioutil.WriteFile(filename, []byte(c.file), 0644)
+        configs, _, err := LoadConfigs(Configs{}, ConfigFile{Name: filename}, getenv, nil)
+        if err != nil {
+            t.Errorf("TestConfigInterpolationValuesOnly %s failed: %v", c.name, err)
+            continue
+        }
+        expected := Configs{
+            Nodes: 2,
+            AmiId: env["AMI"],
+            Tags:  map[string]string{"team": env["TAG"], "note": env["QUOTE"]},
+        }
+        if !reflect.DeepEqual(configs, expected) {
+            t.Errorf("TestConfigInterpolationValuesOnly %s got %+v, expected %+v", c.name, configs, expected)
+        }
+    }
+
+    // Strings nested in lists of objects are interpolated too
+    filename := filepath.Join(dir, "volumes.yaml")
+    ioutil.WriteFile(filename, []byte("sharedVolumes:\n  - name: ${VOLUME:-data}\n    size: 8\n"), 0644)
+    configs, _, err := LoadConfigs(Configs{}, ConfigFile{Name: filename}, getenv, nil)
+    if err != nil || len(configs.SharedVolumes) != 1 || configs.SharedVolumes[0].Name != "data" {
+        t.Errorf("TestConfigInterpolationValuesOnly nested got %+v, %v", configs.SharedVolumes, err)
+    }
+}
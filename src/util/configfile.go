@@ -0,0 +1,559 @@
+/* Copyright (C) Xiang Wang - All Rights Reserved
+ * Unauthorized copying of this file, via any medium is strictly prohibited
+ * Proprietary and confidential
+ * Written by Xiang Wang <xwang1314@gmail.com>, August 2020
+ */
+
+package util
+
+import "github.com/BurntSushi/toml"
+import "gopkg.in/yaml.v3"
+import "encoding/json"
+import "path/filepath"
+import "io/ioutil"
+import "reflect"
+import "strings"
+import "regexp"
+import "bytes"
+import "sort"
+import "fmt"
+
+
+// Config file formats
+const (
+    ConfigFormatJSON = "json"
+    ConfigFormatYAML = "yaml"
+    ConfigFormatTOML = "toml"
+)
+
+// Keys of a config file that are not Configs fields
+const (
+    profilesKey = "profiles"
+    inheritsKey = "inherits"
+    varsKey     = "vars"
+)
+
+var configFormatExtensions = map[string]string{
+    ".json": ConfigFormatJSON,
+    ".yaml": ConfigFormatYAML,
+    ".yml":  ConfigFormatYAML,
+    ".toml": ConfigFormatTOML,
+}
+
+// ConfigFile names a config file and the profile to use from it. The
+// top-level fields of the file are the base that every profile overrides;
+// a profile may also inherit from another profile, eg.
+//
+//   {"nodes": 2, ..., "profiles": {"dev": {...}, "perf": {"inherits": "dev", "nodes": 8}}}
+type ConfigFile struct {
+    Name    string
+    // One of the ConfigFormat values, or "" to pick it from the extension
+    Format  string
+    // "" for the base alone
+    Profile string
+}
+
+// ConfigFormat returns the format of a config file: format itself when it is
+// given, otherwise the one matching the file extension.
+func ConfigFormat(filename, format string) (string, error) {
+    if format == "" {
+        format = configFormatExtensions[strings.ToLower(filepath.Ext(filename))]
+        if format == "" {
+            return "", &ValidationError{Msg: "Can not tell the format of config file " + filename + " from its extension, use -configFormat=json|yaml|toml"}
+        }
+        return format, nil
+    }
+    switch format {
+    case ConfigFormatJSON, ConfigFormatYAML, ConfigFormatTOML:
+        return format, nil
+    }
+    return "", &ValidationError{Msg: fmt.Sprintf("Unknown config format %q, must be json, yaml or toml", format)}
+}
+
+// configSection is one mapping of a config file, either the top level or a
+// profile, in any of the formats.
+type configSection interface {
+    // keys in the order they appear in the file
+    keys() []string
+    // position of key as filename:line:column
+    position(key string) string
+    // decode strictly decodes the value of key into dst, unknown nested
+    // fields may be returned as ValidationErrors with their positions
+    decode(key string, dst interface{}) error
+    // section returns the value of key as a mapping
+    section(key string) (configSection, error)
+}
+
+// configLayer is what the base or one profile of a config file sets.
+type configLayer struct {
+    configs   Configs
+    present   map[string]bool
+    templates map[string]configTemplate
+    vars      map[string]interface{}
+    inherits  string
+}
+
+// readConfigFile strictly decodes a config file and resolves its profile.
+// It returns the decoded values and the source of each field the file sets;
+// unknown fields and values of the wrong type are reported with their line
+// and column. Environment variables are interpolated in the decoded string
+// values and templates rendered last; every problem is reported at once.
+func readConfigFile(file ConfigFile, getenv func(string) string) (Configs, ConfigSources, error) {
+    format, err := ConfigFormat(file.Name, file.Format)
+    if err != nil {
+        return Configs{}, nil, err
+    }
+    data, err := ioutil.ReadFile(file.Name)
+    if err != nil {
+        return Configs{}, nil, &ValidationError{Msg: "Unable to read config file " + file.Name, Err: err}
+    }
+    var top configSection
+    var tomlMeta *toml.MetaData
+    switch format {
+    case ConfigFormatYAML:
+        top, err = newYAMLSection(file.Name, data)
+    case ConfigFormatTOML:
+        top, tomlMeta, err = newTOMLSection(file.Name, data)
+    default:
+        top, err = newJSONSection(file.Name, data)
+    }
+    if err != nil {
+        return Configs{}, nil, err
+    }
+
+    base, errs := decodeConfigLayer(top, false, getenv)
+    profiles := map[string]configLayer{}
+    for _, key := range top.keys() {
+        if key != profilesKey {
+            continue
+        }
+        profileSections, err := top.section(key)
+        if err != nil {
+            errs = append(errs, err)
+            continue
+        }
+        for _, name := range profileSections.keys() {
+            section, err := profileSections.section(name)
+            if err != nil {
+                errs = append(errs, err)
+                continue
+            }
+            layer, layerErrs := decodeConfigLayer(section, true, getenv)
+            profiles[name] = layer
+            errs = append(errs, layerErrs...)
+        }
+    }
+    // TOML leaves unknown fields nested in the values undecoded
+    if tomlMeta != nil && len(errs) == 0 {
+        for _, key := range tomlMeta.Undecoded() {
+            errs = append(errs, unknownFieldError(tomlKeyPosition(file.Name, data, key), key.String()))
+        }
+    }
+    // The templates are rendered even so, their errors are reported together
+    configs, sources, err := resolveProfile(file, base, profiles, getenv)
+    if resolveErrs, ok := err.(ValidationErrors); ok {
+        errs = append(errs, resolveErrs...)
+    } else if err != nil {
+        errs = append(errs, err)
+    }
+    if len(errs) > 0 {
+        return Configs{}, nil, errs
+    }
+    return configs, sources, nil
+}
+
+// decodeConfigLayer decodes the Configs fields of a section and interpolates
+// the environment variables in their strings. A template is told apart
+// before interpolation, so a variable can not add one.
+func decodeConfigLayer(s configSection, isProfile bool, getenv func(string) string) (configLayer, ValidationErrors) {
+    layer := configLayer{present: map[string]bool{}, templates: map[string]configTemplate{}}
+    fields := configFields(&layer.configs)
+    errs := ValidationErrors{}
+    for _, key := range s.keys() {
+        field, ok := fields[key]
+        var text string
+        switch {
+        case key == profilesKey && !isProfile:
+            continue
+        case key == inheritsKey && isProfile:
+            if err := s.decode(key, &layer.inherits); err != nil {
+                errs = append(errs, &ValidationError{Msg: fmt.Sprintf("%s: %s must be the name of a profile", s.position(key), key), Err: err})
+            }
+        case key == varsKey:
+            if err := s.decode(key, &layer.vars); err != nil {
+                errs = append(errs, &ValidationError{Msg: fmt.Sprintf("%s: %s must be a mapping of names to values", s.position(key), key), Err: err})
+            }
+            errs = append(errs, interpolateValue(s.position(key), reflect.ValueOf(layer.vars), getenv)...)
+        case !ok:
+            errs = append(errs, unknownFieldError(s.position(key), key))
+        case s.decode(key, &text) == nil && (field.Kind() != reflect.String || strings.Contains(text, "{{")):
+            interpolated, textErrs := interpolateEnv(s.position(key), text, getenv)
+            errs = append(errs, textErrs...)
+            // Rendering what is left would only repeat the error
+            if len(textErrs) == 0 {
+                layer.templates[key] = configTemplate{text: interpolated, position: s.position(key)}
+                layer.present[key] = true
+            }
+        default:
+            if err := s.decode(key, field.Addr().Interface()); err != nil {
+                // Unknown nested fields come with their own positions
+                if unknown, ok := err.(ValidationErrors); ok {
+                    errs = append(errs, unknown...)
+                    continue
+                }
+                errs = append(errs, &ValidationError{Msg: fmt.Sprintf("%s: field %q must be %s", s.position(key), key, field.Type()), Err: err})
+                continue
+            }
+            errs = append(errs, interpolateValue(s.position(key), field, getenv)...)
+            layer.present[key] = true
+        }
+    }
+    return layer, errs
+}
+
+// resolveProfile merges the base with the selected profile and the profiles
+// it inherits from, the selected profile last, then renders the templates.
+func resolveProfile(file ConfigFile,
+                    base configLayer,
+                    profiles map[string]configLayer,
+                    getenv func(string) string) (Configs, ConfigSources, error) {
+    chain := []string{}
+    seen := map[string]bool{}
+    for name := file.Profile; name != ""; name = profiles[name].inherits {
+        if _, ok := profiles[name]; !ok {
+            names := []string{}
+            for known := range profiles {
+                names = append(names, known)
+            }
+            sort.Strings(names)
+            return Configs{}, nil, &ValidationError{Msg: fmt.Sprintf("Unknown profile %q in %s, the profiles are: %s", name, file.Name, strings.Join(names, ", "))}
+        }
+        if seen[name] {
+            return Configs{}, nil, &ValidationError{Msg: fmt.Sprintf("Profiles in %s inherit from each other in a loop: %s", file.Name, strings.Join(append(chain, name), " -> "))}
+        }
+        seen[name] = true
+        chain = append(chain, name)
+    }
+
+    configs := Configs{}
+    fields := configFields(&configs)
+    sources := ConfigSources{}
+    templates := map[string]configTemplate{}
+    vars := map[string]interface{}{}
+    merge := func(layer configLayer, source string) {
+        layerFields := configFields(&layer.configs)
+        for name := range layer.present {
+            if tmpl, ok := layer.templates[name]; ok {
+                templates[name] = tmpl
+            } else {
+                fields[name].Set(layerFields[name])
+                delete(templates, name)
+            }
+            sources[name] = source
+        }
+        for name, value := range layer.vars {
+            vars[name] = value
+        }
+    }
+    merge(base, SourceFile)
+    for i := len(chain) - 1; i >= 0; i-- {
+        merge(profiles[chain[i]], SourceFile + ":" + chain[i])
+    }
+    return configs, sources, renderTemplates(&configs, templates, vars, getenv)
+}
+
+// configFields maps the name of every Configs field to its value in configs.
+func configFields(configs *Configs) map[string]reflect.Value {
+    fields := map[string]reflect.Value{}
+    value := reflect.ValueOf(configs).Elem()
+    for i := 0; i < value.NumField(); i++ {
+        fields[configName(value.Type().Field(i))] = value.Field(i)
+    }
+    return fields
+}
+
+func unknownFieldError(position, name string) error {
+    return &ValidationError{Msg: fmt.Sprintf("%s: unknown field %q", position, name)}
+}
+
+// filePosition renders a byte offset in file as filename:line:column.
+func filePosition(filename string, file []byte, offset int64) string {
+    if offset > int64(len(file)) {
+        offset = int64(len(file))
+    }
+    before := file[:offset]
+    line := bytes.Count(before, []byte("\n")) + 1
+    column := len(before) - bytes.LastIndexByte(before, '\n')
+    return fmt.Sprintf("%s:%d:%d", filename, line, column)
+}
+
+// keysByOffset sorts keys by where they appear in file.
+func keysByOffset(keys []string, offset func(string) int64) []string {
+    sort.SliceStable(keys, func(i, j int) bool {
+        return offset(keys[i]) < offset(keys[j])
+    })
+    return keys
+}
+
+type jsonSection struct {
+    filename string
+    file     []byte
+    // Offset in file where the section starts
+    start    int64
+    raw      map[string]json.RawMessage
+}
+
+func newJSONSection(filename string, file []byte) (*jsonSection, error) {
+    s := &jsonSection{filename: filename, file: file}
+    if err := json.Unmarshal(file, &s.raw); err != nil {
+        switch e := err.(type) {
+        case *json.SyntaxError:
+            return nil, &ValidationError{Msg: filePosition(filename, file, e.Offset) + ": invalid JSON", Err: err}
+        case *json.UnmarshalTypeError:
+            return nil, &ValidationError{Msg: filePosition(filename, file, e.Offset) + ": config must be a JSON object", Err: err}
+        }
+        return nil, &ValidationError{Msg: "Invalid JSON config file " + filename, Err: err}
+    }
+    return s, nil
+}
+
+func (s *jsonSection) offset(key string) int64 {
+    pattern := regexp.MustCompile(`"` + regexp.QuoteMeta(key) + `"\s*:`)
+    if match := pattern.FindIndex(s.file[s.start:]); match != nil {
+        return s.start + int64(match[0])
+    }
+    return s.start
+}
+
+func (s *jsonSection) keys() []string {
+    keys := []string{}
+    for key := range s.raw {
+        keys = append(keys, key)
+    }
+    return keysByOffset(keys, s.offset)
+}
+
+func (s *jsonSection) position(key string) string {
+    return filePosition(s.filename, s.file, s.offset(key))
+}
+
+func (s *jsonSection) decode(key string, dst interface{}) error {
+    decoder := json.NewDecoder(bytes.NewReader(s.raw[key]))
+    decoder.DisallowUnknownFields()
+    return decoder.Decode(dst)
+}
+
+func (s *jsonSection) section(key string) (configSection, error) {
+    sub := &jsonSection{filename: s.filename, file: s.file, start: s.offset(key)}
+    if err := json.Unmarshal(s.raw[key], &sub.raw); err != nil {
+        return nil, &ValidationError{Msg: fmt.Sprintf("%s: %s must be an object", s.position(key), key), Err: err}
+    }
+    return sub, nil
+}
+
+type yamlSection struct {
+    filename string
+    node     *yaml.Node
+}
+
+func newYAMLSection(filename string, file []byte) (*yamlSection, error) {
+    doc := yaml.Node{}
+    if err := yaml.Unmarshal(file, &doc); err != nil {
+        return nil, &ValidationError{Msg: "Invalid YAML config file " + filename, Err: err}
+    }
+    if len(doc.Content) == 0 {
+        return &yamlSection{filename: filename, node: &yaml.Node{Kind: yaml.MappingNode}}, nil
+    }
+    root := doc.Content[0]
+    if root.Kind != yaml.MappingNode {
+        return nil, &ValidationError{Msg: fmt.Sprintf("%s:%d:%d: config must be a YAML mapping", filename, root.Line, root.Column)}
+    }
+    return &yamlSection{filename: filename, node: root}, nil
+}
+
+// lookup returns the key and value nodes of key.
+func (s *yamlSection) lookup(key string) (*yaml.Node, *yaml.Node) {
+    for i := 0; i+1 < len(s.node.Content); i += 2 {
+        if s.node.Content[i].Value == key {
+            return s.node.Content[i], s.node.Content[i+1]
+        }
+    }
+    return nil, nil
+}
+
+func (s *yamlSection) keys() []string {
+    keys := []string{}
+    for i := 0; i+1 < len(s.node.Content); i += 2 {
+        keys = append(keys, s.node.Content[i].Value)
+    }
+    return keys
+}
+
+func (s *yamlSection) position(key string) string {
+    keyNode, _ := s.lookup(key)
+    return fmt.Sprintf("%s:%d:%d", s.filename, keyNode.Line, keyNode.Column)
+}
+
+func (s *yamlSection) decode(key string, dst interface{}) error {
+    _, value := s.lookup(key)
+    if err := value.Decode(dst); err != nil {
+        return err
+    }
+    // Node.Decode does not reject unknown fields
+    errs := ValidationErrors{}
+    for _, unknown := range yamlUnknownFields(value, reflect.TypeOf(dst).Elem(), key) {
+        errs = append(errs, unknownFieldError(fmt.Sprintf("%s:%d:%d", s.filename, unknown.node.Line, unknown.node.Column), unknown.name))
+    }
+    return errs.errOrNil()
+}
+
+type yamlUnknownField struct {
+    node *yaml.Node
+    name string
+}
+
+// yamlUnknownFields walks node against the type it is decoded into and
+// returns the keys of the mappings that no struct field takes, named by
+// their dotted path from name.
+func yamlUnknownFields(node *yaml.Node, t reflect.Type, name string) []yamlUnknownField {
+    for t.Kind() == reflect.Ptr {
+        t = t.Elem()
+    }
+    if node.Kind == yaml.AliasNode {
+        node = node.Alias
+    }
+    unknown := []yamlUnknownField{}
+    switch {
+    case t.Kind() == reflect.Struct && node.Kind == yaml.MappingNode:
+        fields := yamlFieldTypes(t)
+        for i := 0; i+1 < len(node.Content); i += 2 {
+            keyNode, value := node.Content[i], node.Content[i+1]
+            if keyNode.Value == "<<" {
+                unknown = append(unknown, yamlUnknownFields(value, t, name)...)
+                continue
+            }
+            path := name + "." + keyNode.Value
+            if fieldType, ok := fields[keyNode.Value]; ok {
+                unknown = append(unknown, yamlUnknownFields(value, fieldType, path)...)
+            } else {
+                unknown = append(unknown, yamlUnknownField{node: keyNode, name: path})
+            }
+        }
+    case t.Kind() == reflect.Map && node.Kind == yaml.MappingNode:
+        for i := 0; i+1 < len(node.Content); i += 2 {
+            unknown = append(unknown, yamlUnknownFields(node.Content[i+1], t.Elem(), name + "." + node.Content[i].Value)...)
+        }
+    case (t.Kind() == reflect.Slice || t.Kind() == reflect.Array) && node.Kind == yaml.SequenceNode:
+        for _, item := range node.Content {
+            unknown = append(unknown, yamlUnknownFields(item, t.Elem(), name)...)
+        }
+    }
+    return unknown
+}
+
+// yamlFieldTypes maps the YAML names of the fields of struct type t to their
+// types, the way yaml.v3 names them.
+func yamlFieldTypes(t reflect.Type) map[string]reflect.Type {
+    fields := map[string]reflect.Type{}
+    for i := 0; i < t.NumField(); i++ {
+        field := t.Field(i)
+        if field.PkgPath != "" && !field.Anonymous {
+            continue
+        }
+        tag := strings.Split(field.Tag.Get("yaml"), ",")
+        switch {
+        case tag[0] == "-":
+        case len(tag) > 1 && tag[1] == "inline":
+            for name, fieldType := range yamlFieldTypes(field.Type) {
+                fields[name] = fieldType
+            }
+        case tag[0] != "":
+            fields[tag[0]] = field.Type
+        default:
+            fields[strings.ToLower(field.Name)] = field.Type
+        }
+    }
+    return fields
+}
+
+func (s *yamlSection) section(key string) (configSection, error) {
+    _, value := s.lookup(key)
+    if value.Kind != yaml.MappingNode {
+        return nil, &ValidationError{Msg: fmt.Sprintf("%s: %s must be a mapping", s.position(key), key)}
+    }
+    return &yamlSection{filename: s.filename, node: value}, nil
+}
+
+type tomlSection struct {
+    filename string
+    file     []byte
+    meta     *toml.MetaData
+    // Offset in file where the section starts
+    start    int64
+    raw      map[string]toml.Primitive
+}
+
+func newTOMLSection(filename string, file []byte) (*tomlSection, *toml.MetaData, error) {
+    s := &tomlSection{filename: filename, file: file}
+    meta, err := toml.Decode(string(file), &s.raw)
+    if err != nil {
+        if parseErr, ok := err.(toml.ParseError); ok {
+            return nil, nil, &ValidationError{Msg: filePosition(filename, file, int64(parseErr.Position.Start)) + ": invalid TOML", Err: err}
+        }
+        return nil, nil, &ValidationError{Msg: "Invalid TOML config file " + filename, Err: err}
+    }
+    s.meta = &meta
+    return s, s.meta, nil
+}
+
+func (s *tomlSection) offset(key string) int64 {
+    return tomlKeyOffset(s.file, s.start, key)
+}
+
+func (s *tomlSection) keys() []string {
+    keys := []string{}
+    for key := range s.raw {
+        keys = append(keys, key)
+    }
+    return keysByOffset(keys, s.offset)
+}
+
+func (s *tomlSection) position(key string) string {
+    return filePosition(s.filename, s.file, s.offset(key))
+}
+
+func (s *tomlSection) decode(key string, dst interface{}) error {
+    return s.meta.PrimitiveDecode(s.raw[key], dst)
+}
+
+func (s *tomlSection) section(key string) (configSection, error) {
+    sub := &tomlSection{filename: s.filename, file: s.file, meta: s.meta, start: s.offset(key)}
+    if err := s.meta.PrimitiveDecode(s.raw[key], &sub.raw); err != nil {
+        return nil, &ValidationError{Msg: fmt.Sprintf("%s: %s must be a table", s.position(key), key), Err: err}
+    }
+    return sub, nil
+}
+
+// tomlKeyOffset finds where a TOML key or table is defined, at or after
+// start. Keys of inline tables are found too.
+func tomlKeyOffset(file []byte, start int64, key string) int64 {
+    pattern := regexp.MustCompile(`(?m)(^[ \t]*(\[+[ \t]*([\w.]+\.)?)?|[{,][ \t]*)"?` + regexp.QuoteMeta(key) + `"?[ \t]*[=.\]]`)
+    if match := pattern.FindSubmatchIndex(file[start:]); match != nil {
+        // Inline table keys start after the brace or comma
+        if c := file[start + int64(match[0])]; c == '{' || c == ',' {
+            return start + int64(match[3])
+        }
+        return start + int64(match[0])
+    }
+    return start
+}
+
+// tomlKeyPosition renders where a TOML key is defined as
+// filename:line:column, finding each part of the key after its parent.
+func tomlKeyPosition(filename string, file []byte, key toml.Key) string {
+    offset := int64(0)
+    for _, part := range key {
+        offset = tomlKeyOffset(file, offset, part)
+    }
+    return filePosition(filename, file, offset)
+}
@@ -0,0 +1,222 @@
+/* Copyright (C) Xiang Wang - All Rights Reserved
+ * Unauthorized copying of this file, via any medium is strictly prohibited
+ * Proprietary and confidential
+ * Written by Xiang Wang <xwang1314@gmail.com>, August 2020
+ */
+
+package util
+
+import "text/template"
+import "reflect"
+import "strconv"
+import "strings"
+import "regexp"
+import "bytes"
+import "fmt"
+
+
+// ${VAR}, ${VAR:-default} or $$ for a literal $
+var interpolation = regexp.MustCompile(`\$\$|\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// interpolateEnv replaces the environment variables referenced in a string
+// value of a config file. A variable that is unset or empty takes its
+// default, and is an error without one.
+func interpolateEnv(position, text string, getenv func(string) string) (string, ValidationErrors) {
+    errs := ValidationErrors{}
+    out := interpolation.ReplaceAllStringFunc(text, func(match string) string {
+        if match == "$$" {
+            return "$"
+        }
+        groups := interpolation.FindStringSubmatch(match)
+        value := getenv(groups[1])
+        if value == "" && groups[2] != "" {
+            value = groups[3]
+        } else if value == "" {
+            errs = append(errs, &ValidationError{Msg: fmt.Sprintf("%s: environment variable %s is not set and has no default, eg. ${%s:-value}", position, groups[1], groups[1])})
+        }
+        return value
+    })
+    return out, errs
+}
+
+// interpolateValue interpolates every string of a decoded config value, in
+// structs, lists and the values of mappings. Values are substituted after
+// the file is parsed, so they can not change its structure, and comments
+// are never read.
+func interpolateValue(position string, value reflect.Value, getenv func(string) string) ValidationErrors {
+    errs := ValidationErrors{}
+    switch value.Kind() {
+    case reflect.String:
+        text, stringErrs := interpolateEnv(position, value.String(), getenv)
+        value.SetString(text)
+        errs = append(errs, stringErrs...)
+    case reflect.Ptr:
+        if !value.IsNil() {
+            errs = append(errs, interpolateValue(position, value.Elem(), getenv)...)
+        }
+    case reflect.Struct:
+        for i := 0; i < value.NumField(); i++ {
+            if value.Field(i).CanSet() {
+                errs = append(errs, interpolateValue(position, value.Field(i), getenv)...)
+            }
+        }
+    case reflect.Slice, reflect.Array:
+        for i := 0; i < value.Len(); i++ {
+            errs = append(errs, interpolateValue(position, value.Index(i), getenv)...)
+        }
+    case reflect.Map:
+        // Map values are not addressable, interpolate a copy
+        for _, key := range value.MapKeys() {
+            elem := reflect.New(value.Type().Elem()).Elem()
+            elem.Set(value.MapIndex(key))
+            errs = append(errs, interpolateValue(position, elem, getenv)...)
+            value.SetMapIndex(key, elem)
+        }
+    case reflect.Interface:
+        if !value.IsNil() {
+            elem := reflect.New(value.Elem().Type()).Elem()
+            elem.Set(value.Elem())
+            errs = append(errs, interpolateValue(position, elem, getenv)...)
+            value.Set(elem)
+        }
+    }
+    return errs
+}
+
+// configTemplate is a config value given as a string where the field is not
+// one, or a string using {{ }}. It is rendered with text/template once the
+// profile is resolved, then parsed like a flag value.
+type configTemplate struct {
+    text     string
+    position string
+}
+
+// templateList renders as a comma separated list, the form list fields take
+// on the command line.
+type templateList []string
+
+func (l templateList) String() string {
+    return strings.Join(l, ",")
+}
+
+// templateFuncs are the helpers available in config templates.
+func templateFuncs(getenv func(string) string) template.FuncMap {
+    return template.FuncMap{
+        // repeat "subnet-1" 3 -> subnet-1,subnet-1,subnet-1
+        "repeat": func(value interface{}, count interface{}) (templateList, error) {
+            n, err := templateInt(count)
+            list := templateList{}
+            for i := 0; i < n; i++ {
+                list = append(list, fmt.Sprint(value))
+            }
+            return list, err
+        },
+        // cycle (list "a" "b") 3 -> a,b,a
+        "cycle": func(values interface{}, count interface{}) (templateList, error) {
+            n, err := templateInt(count)
+            if err != nil {
+                return nil, err
+            }
+            items := templateItems(values)
+            if len(items) == 0 {
+                return nil, fmt.Errorf("cycle needs at least one value")
+            }
+            list := templateList{}
+            for i := 0; i < n; i++ {
+                list = append(list, items[i%len(items)])
+            }
+            return list, nil
+        },
+        // list "a" "b" -> a,b
+        "list": func(values ...interface{}) templateList {
+            return templateItems(values)
+        },
+        // env "NAME" fails when NAME is not set
+        "env": func(name string) (string, error) {
+            if value := getenv(name); value != "" {
+                return value, nil
+            }
+            return "", fmt.Errorf("environment variable %s is not set", name)
+        },
+    }
+}
+
+// templateItems flattens a list, or a comma separated string, into strings.
+func templateItems(values interface{}) templateList {
+    value := reflect.ValueOf(values)
+    if value.Kind() != reflect.Slice {
+        return templateList(strings.Split(fmt.Sprint(values), ","))
+    }
+    list := templateList{}
+    for i := 0; i < value.Len(); i++ {
+        list = append(list, fmt.Sprint(value.Index(i).Interface()))
+    }
+    return list
+}
+
+func templateInt(value interface{}) (int, error) {
+    switch n := value.(type) {
+    case int:
+        return n, nil
+    case int64:
+        return int(n), nil
+    case float64:
+        return int(n), nil
+    }
+    return strconv.Atoi(fmt.Sprint(value))
+}
+
+// templateData exposes the vars of the config file and every Configs field,
+// under its Go name, to the templates.
+func templateData(configs Configs, vars map[string]interface{}) map[string]interface{} {
+    data := map[string]interface{}{}
+    for name, value := range vars {
+        data[name] = value
+    }
+    value := reflect.ValueOf(configs)
+    for i := 0; i < value.NumField(); i++ {
+        field := value.Field(i)
+        if list, ok := field.Interface().([]string); ok {
+            data[value.Type().Field(i).Name] = templateList(list)
+        } else {
+            data[value.Type().Field(i).Name] = field.Interface()
+        }
+    }
+    return data
+}
+
+// renderTemplates renders the templates of a resolved config and parses the
+// results into their fields. Scalar fields are rendered first so that lists
+// can be built from them, eg. {{ repeat .Subnet .Nodes }}.
+func renderTemplates(configs *Configs,
+                     templates map[string]configTemplate,
+                     vars map[string]interface{},
+                     getenv func(string) string) error {
+    fields := configFields(configs)
+    errs := ValidationErrors{}
+    for _, lists := range []bool{false, true} {
+        data := templateData(*configs, vars)
+        for _, name := range ConfigFieldNames() {
+            tmpl, ok := templates[name]
+            field := fields[name]
+            isList := field.Kind() == reflect.Slice || field.Kind() == reflect.Map
+            if !ok || isList != lists {
+                continue
+            }
+            parsed, err := template.New(name).Option("missingkey=error").Funcs(templateFuncs(getenv)).Parse(tmpl.text)
+            if err != nil {
+                errs = append(errs, &ValidationError{Msg: fmt.Sprintf("%s: invalid template for field %q", tmpl.position, name), Err: err})
+                continue
+            }
+            out := bytes.Buffer{}
+            if err := parsed.Execute(&out, data); err != nil {
+                errs = append(errs, &ValidationError{Msg: fmt.Sprintf("%s: template for field %q failed", tmpl.position, name), Err: err})
+                continue
+            }
+            if err := setConfigField(field, out.String()); err != nil {
+                errs = append(errs, &ValidationError{Msg: fmt.Sprintf("%s: field %q must be %s, got %q", tmpl.position, name, field.Type(), out.String()), Err: err})
+            }
+        }
+    }
+    return errs.errOrNil()
+}
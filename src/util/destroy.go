@@ -0,0 +1,159 @@
+/* Copyright (C) Xiang Wang - All Rights Reserved
+ * Unauthorized copying of this file, via any medium is strictly prohibited
+ * Proprietary and confidential
+ * Written by Xiang Wang <xwang1314@gmail.com>, August 2020
+ */
+
+package util
+
+import "github.com/aws/aws-sdk-go/aws/awserr"
+import "strings"
+import "errors"
+import "fmt"
+
+
+// DestroySummary describes what DestroyRun will remove.
+func DestroySummary(state *RunState) string {
+    lines := []string{"Run " + state.RunId + ":"}
+    for _, a := range state.Attachments {
+        lines = append(lines, fmt.Sprintf("  detach volume %s from %s (%s)", a.VolumeId, a.InstanceId, a.Device))
+    }
+    for _, v := range state.Volumes {
+        lines = append(lines, "  delete volume " + v.VolumeId + " in " + v.AvailabilityZone)
+    }
+    for _, i := range state.Instances {
+        lines = append(lines, fmt.Sprintf("  terminate instance %s (%s in %s)", i.InstanceId, i.InstanceType, i.AvailabilityZone))
+    }
+    for _, fleetId := range state.FleetIds {
+        lines = append(lines, "  delete fleet " + fleetId)
+    }
+    if state.LaunchTemplateId != "" {
+        lines = append(lines, "  delete launch template " + state.LaunchTemplateId)
+    }
+    return strings.Join(lines, "\n")
+}
+
+// Error codes meaning a resource is already gone, eg. removed by an earlier
+// destroy that failed part way
+var goneCodes = map[string][]string{
+    "attachment":      {"InvalidAttachment.NotFound", "InvalidVolume.NotFound", "InvalidInstanceID.NotFound", "IncorrectState"},
+    "volume":          {"InvalidVolume.NotFound"},
+    "instances":       {"InvalidInstanceID.NotFound"},
+    "fleets":          {"InvalidFleetId.NotFound"},
+    "launch template": {"InvalidLaunchTemplateId.NotFound"},
+}
+
+// alreadyGone tells whether err says the resource of kind is already gone.
+func alreadyGone(kind string, err error) bool {
+    var awsErr awserr.Error
+    if !errors.As(err, &awsErr) {
+        return false
+    }
+    for _, code := range goneCodes[kind] {
+        if awsErr.Code() == code {
+            return true
+        }
+    }
+    return false
+}
+
+// DestroyRun tears down everything recorded in the state file: volumes are
+// detached and deleted first, then the instances are terminated and the fleet
+// deleted. It replays the run as a Saga, so one failed step does not stop the
+// others. Every resource removed, or found already gone, is dropped from the
+// state file right away, so a destroy that fails part way can be re-run for
+// what is left.
+func DestroyRun(p *Provisioner, stateFile *StateFile) error {
+    state := stateFile.State
+    saga := &Saga{}
+    step := func(kind, name string, remove func() error, prune func()) {
+        saga.Record(kind + " " + name, func() error {
+            if err := remove(); err != nil && !alreadyGone(kind, err) {
+                return err
+            }
+            prune()
+            return stateFile.Save()
+        })
+    }
+    if state.LaunchTemplateId != "" {
+        templateId := state.LaunchTemplateId
+        step("launch template", templateId, func() error {
+            _, err := p.DeleteLaunchTemplate(templateId)
+            return err
+        }, func() {
+            state.LaunchTemplateId = ""
+        })
+    }
+    if fleetIds := state.FleetIds; len(fleetIds) > 0 {
+        step("fleets", strings.Join(fleetIds, ","), func() error {
+            _, err := p.DeleteFleets(fleetIds)
+            return err
+        }, func() {
+            state.FleetIds = nil
+        })
+    }
+    if instanceIds := state.InstanceIds(); len(instanceIds) > 0 {
+        terminated := instanceIds
+        step("instances", strings.Join(instanceIds, ","), func() error {
+            _, err := p.TerminateInstances(instanceIds)
+            if !alreadyGone("instances", err) {
+                return err
+            }
+            // One purged instance fails the whole call, so each is retried
+            // alone to tell the gone ones from those still running
+            terminated = nil
+            var failed error
+            for _, instanceId := range instanceIds {
+                if _, err := p.TerminateInstances([]string{instanceId}); err != nil && !alreadyGone("instances", err) {
+                    failed = err
+                    continue
+                }
+                terminated = append(terminated, instanceId)
+            }
+            return failed
+        }, func() {
+            removed := map[string]bool{}
+            for _, instanceId := range terminated {
+                removed[instanceId] = true
+            }
+            instances := []Instance{}
+            for _, i := range state.Instances {
+                if !removed[i.InstanceId] {
+                    instances = append(instances, i)
+                }
+            }
+            state.Instances = instances
+        })
+    }
+    for _, v := range state.Volumes {
+        volumeId := v.VolumeId
+        step("volume", volumeId, func() error {
+            _, err := p.DeleteVolume(volumeId)
+            return err
+        }, func() {
+            volumes := []Volume{}
+            for _, v := range state.Volumes {
+                if v.VolumeId != volumeId {
+                    volumes = append(volumes, v)
+                }
+            }
+            state.Volumes = volumes
+        })
+    }
+    for _, a := range state.Attachments {
+        a := a
+        step("attachment", a.VolumeId + " to " + a.InstanceId, func() error {
+            _, err := p.DetachVolume(a.InstanceId, a.VolumeId)
+            return err
+        }, func() {
+            attachments := []Attachment{}
+            for _, other := range state.Attachments {
+                if other != a {
+                    attachments = append(attachments, other)
+                }
+            }
+            state.Attachments = attachments
+        })
+    }
+    return saga.Rollback()
+}
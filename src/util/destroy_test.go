@@ -0,0 +1,120 @@
+package util
+
+import "github.com/aws/aws-sdk-go/aws/awserr"
+import "path/filepath"
+import "io/ioutil"
+import "os"
+import "testing"
+
+
+func TestDestroyRun(t *testing.T) {
+    fake := &fakeEC2{}
+    state := &RunState{
+        RunId:       "run-1",
+        FleetIds:    []string{"fleet-1"},
+        Instances:   []Instance{{InstanceId: "i-1"}, {InstanceId: "i-2"}},
+        Volumes:     []Volume{{VolumeId: "vol-1"}},
+        Attachments: []Attachment{
+            {InstanceId: "i-1", VolumeId: "vol-1", Device: "/dev/sdf"},
+            {InstanceId: "i-2", VolumeId: "vol-1", Device: "/dev/sdf"},
+        },
+    }
+    if err := DestroyRun(NewProvisioner(fake), &StateFile{State: state}); err != nil {
+        t.Fatalf("TestDestroyRun failed: %v", err)
+    }
+    if len(fake.detached) != 2 || len(fake.volDeleted) != 1 || len(fake.terminated) != 2 {
+        t.Errorf("TestDestroyRun did not remove every resource")
+    }
+    if len(fake.fleetsDeleted) != 1 || fake.fleetsDeleted[0] != "fleet-1" {
+        t.Errorf("TestDestroyRun did not delete the fleet")
+    }
+}
+
+func TestDestroyRunAgainAfterFailure(t *testing.T) {
+    dir, err := ioutil.TempDir("", "ec2fleet")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+    stateFile := &StateFile{
+        Path: StateFilePath(dir, "run-1"),
+        State: &RunState{
+            RunId:       "run-1",
+            FleetIds:    []string{"fleet-1"},
+            Instances:   []Instance{{InstanceId: "i-1"}, {InstanceId: "i-2"}},
+            Volumes:     []Volume{{VolumeId: "vol-1"}, {VolumeId: "vol-2"}},
+            Attachments: []Attachment{
+                {InstanceId: "i-1", VolumeId: "vol-1", Device: "/dev/sdf"},
+                {InstanceId: "i-2", VolumeId: "vol-2", Device: "/dev/sdf"},
+            },
+        },
+    }
+    fake := &fakeEC2{failures: map[string]error{
+        "DeleteVolume":       awserr.New("VolumeInUse", "Volume vol-2 is in use.", nil),
+        "TerminateInstances": awserr.New("RequestLimitExceeded", "Request limit exceeded.", nil),
+    }}
+    p := NewProvisioner(fake)
+    if err := DestroyRun(p, stateFile); err == nil {
+        t.Fatalf("TestDestroyRunAgainAfterFailure did not fail")
+    }
+    left, err := LoadRunState(stateFile.Path)
+    if err != nil || len(left.Attachments) != 0 || len(left.Volumes) != 1 || left.Volumes[0].VolumeId != "vol-2" ||
+       len(left.Instances) != 2 || len(left.FleetIds) != 0 {
+        t.Fatalf("TestDestroyRunAgainAfterFailure left %+v, %v", left, err)
+    }
+
+    // The second destroy only touches what is left, and takes a resource
+    // that went away in between as removed
+    fake.failures = map[string]error{"DeleteVolume": awserr.New("InvalidVolume.NotFound", "The volume 'vol-2' does not exist.", nil)}
+    stateFile.State = left
+    if err := DestroyRun(p, stateFile); err != nil {
+        t.Fatalf("TestDestroyRunAgainAfterFailure second destroy failed: %v", err)
+    }
+    if len(fake.detached) != 2 || len(fake.terminated) != 2 || len(fake.fleetsDeleted) != 1 || !stateFile.State.Empty() {
+        t.Errorf("TestDestroyRunAgainAfterFailure second destroy left %+v", stateFile.State)
+    }
+}
+
+func TestDestroyRunPurgedInstance(t *testing.T) {
+    state := &RunState{
+        RunId:     "run-1",
+        Instances: []Instance{{InstanceId: "i-1"}, {InstanceId: "i-2"}, {InstanceId: "i-3"}},
+    }
+    // i-1 is gone, which fails the call for all three
+    fake := &fakeEC2{purged: map[string]bool{"i-1": true}}
+    if err := DestroyRun(NewProvisioner(fake), &StateFile{State: state}); err != nil {
+        t.Fatalf("TestDestroyRunPurgedInstance failed: %v", err)
+    }
+    if len(fake.terminated) != 2 || fake.terminated[0] != "i-2" || fake.terminated[1] != "i-3" || len(state.Instances) != 0 {
+        t.Errorf("TestDestroyRunPurgedInstance terminated %v, left %+v", fake.terminated, state.Instances)
+    }
+}
+
+func TestDestroyStateRoundTrip(t *testing.T) {
+    dir, err := ioutil.TempDir("", "ec2fleet")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+    filename := StateFilePath(filepath.Join(dir, "state"), "run-1")
+    stateFile := &StateFile{
+        Path:  filename,
+        State: &RunState{RunId: "run-1", Config: Configs{Nodes: 1}},
+    }
+    if err := stateFile.Save(); err != nil {
+        t.Fatalf("TestDestroyStateRoundTrip failed: %v", err)
+    }
+    stateFile.State.Instances = []Instance{{InstanceId: "i-1", AvailabilityZone: "us-east-1a"}}
+    if err := stateFile.Save(); err != nil {
+        t.Fatalf("TestDestroyStateRoundTrip failed: %v", err)
+    }
+    loaded, err := LoadRunState(filename)
+    if err != nil || loaded.RunId != "run-1" || loaded.Config.Nodes != 1 || loaded.Instances[0].InstanceId != "i-1" {
+        t.Errorf("TestDestroyStateRoundTrip failed: %v", err)
+    }
+    // Only the state file is left behind, no temporary files
+    files, _ := ioutil.ReadDir(filepath.Dir(filename))
+    if len(files) != 1 {
+        t.Errorf("TestDestroyStateRoundTrip left %d files", len(files))
+    }
+}
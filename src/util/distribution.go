@@ -0,0 +1,230 @@
+/* Copyright (C) Xiang Wang - All Rights Reserved
+ * Unauthorized copying of this file, via any medium is strictly prohibited
+ * Proprietary and confidential
+ * Written by Xiang Wang <xwang1314@gmail.com>, August 2020
+ */
+
+package util
+
+import "github.com/aws/aws-sdk-go/service/ec2"
+import "github.com/aws/aws-sdk-go/aws"
+import "strings"
+import "fmt"
+
+
+// Distribution strategies, ie. how the nodes of a group are spread over its
+// subnets. Multi-attach volumes are shared per AZ, so the strategy also
+// decides how many volumes a run needs.
+const (
+    // Each node in the subnet listed for it; groups take their subnets in turn
+    DistributionListed     = ""
+    // Nodes take the subnets in turn
+    DistributionRoundRobin = "round-robin"
+    // Nodes split over the subnets in proportion to subnetWeights
+    DistributionWeighted   = "weighted"
+    // Every node in the AZ of the first subnet
+    DistributionPack       = "pack"
+    // Nodes take the AZs in turn, and the subnets of each AZ in turn
+    DistributionSpread     = "spread"
+)
+
+var distributions = []string{DistributionRoundRobin, DistributionWeighted, DistributionPack, DistributionSpread}
+
+// PlaceNodes returns one FleetNode per node with its subnet chosen by the
+// distribution strategy, given the AZ of every subnet.
+func (c Configs) PlaceNodes(subnetZones map[string]string) []FleetNode {
+    nodes := c.FleetNodes()
+    if c.Distribution == DistributionListed {
+        return nodes
+    }
+    start := 0
+    for _, candidates := range c.groupSubnets() {
+        count := candidates.count
+        subnets := distributeSubnets(c.Distribution, uniqueStrings(candidates.subnets), count, subnetZones, c.SubnetWeights)
+        for i := 0; i < count; i++ {
+            nodes[start + i].SubnetId = subnets[i]
+        }
+        start += count
+    }
+    return nodes
+}
+
+// FleetRequestsByZone splits a fleet request into one request per AZ, in the
+// order the AZs are first seen, each asking for the capacity of the nodes
+// placed in its AZ. The overrides of a single fleet are only capacity pools
+// EC2 picks from, so one fleet for every AZ would not keep the placement.
+// The on-demand capacity is shared out in proportion to the capacity of
+// each AZ.
+func FleetRequestsByZone(input *ec2.CreateFleetInput) []*ec2.CreateFleetInput {
+    zones := []string{}
+    overrides := map[string][]*ec2.FleetLaunchTemplateOverridesRequest{}
+    capacity := map[string]int64{}
+    for _, override := range input.LaunchTemplateConfigs[0].Overrides {
+        zone := aws.StringValue(override.AvailabilityZone)
+        if _, ok := overrides[zone]; !ok {
+            zones = append(zones, zone)
+        }
+        overrides[zone] = append(overrides[zone], override)
+        capacity[zone] += int64(FleetNode{Weight: int(aws.Float64Value(override.WeightedCapacity))}.Capacity())
+    }
+    target := input.TargetCapacitySpecification
+    total := aws.Int64Value(target.TotalTargetCapacity)
+    onDemand := aws.Int64Value(target.OnDemandTargetCapacity)
+    requests := []*ec2.CreateFleetInput{}
+    before := int64(0)
+    for _, zone := range zones {
+        after := before + capacity[zone]
+        zoneOnDemand := onDemand * after / total - onDemand * before / total
+        before = after
+        config := *input.LaunchTemplateConfigs[0]
+        config.Overrides = overrides[zone]
+        request := *input
+        request.LaunchTemplateConfigs = []*ec2.FleetLaunchTemplateConfigRequest{&config}
+        request.TargetCapacitySpecification = &ec2.TargetCapacitySpecificationRequest{
+            OnDemandTargetCapacity:    aws.Int64(zoneOnDemand),
+            SpotTargetCapacity:        aws.Int64(capacity[zone] - zoneOnDemand),
+            TotalTargetCapacity:       aws.Int64(capacity[zone]),
+            DefaultTargetCapacityType: target.DefaultTargetCapacityType,
+        }
+        requests = append(requests, &request)
+    }
+    return requests
+}
+
+type groupCandidates struct {
+    count   int
+    subnets []string
+}
+
+// groupSubnets returns the node count and subnets of every node group, or of
+// the whole fleet when it has no node groups, in FleetNodes order.
+func (c Configs) groupSubnets() []groupCandidates {
+    if len(c.NodeGroups) == 0 {
+        return []groupCandidates{{count: len(c.FleetNodes()), subnets: c.Subnets}}
+    }
+    groups := []groupCandidates{}
+    for _, group := range c.NodeGroups {
+        groups = append(groups, groupCandidates{count: group.Count, subnets: group.Subnets})
+    }
+    return groups
+}
+
+// distributeSubnets picks the subnet of each of count nodes.
+func distributeSubnets(strategy string,
+                       subnets []string,
+                       count int,
+                       subnetZones map[string]string,
+                       weights map[string]int) []string {
+    placed := []string{}
+    switch strategy {
+    case DistributionWeighted:
+        // Smooth weighted round-robin keeps every prefix close to the weights
+        current := make([]int, len(subnets))
+        total := 0
+        for _, subnet := range subnets {
+            total += subnetWeight(weights, subnet)
+        }
+        for i := 0; i < count; i++ {
+            best := 0
+            for j, subnet := range subnets {
+                current[j] += subnetWeight(weights, subnet)
+                if current[j] > current[best] {
+                    best = j
+                }
+            }
+            current[best] -= total
+            placed = append(placed, subnets[best])
+        }
+    case DistributionPack:
+        packed := []string{}
+        for _, subnet := range subnets {
+            if subnetZones[subnet] == subnetZones[subnets[0]] {
+                packed = append(packed, subnet)
+            }
+        }
+        for i := 0; i < count; i++ {
+            placed = append(placed, packed[i % len(packed)])
+        }
+    case DistributionSpread:
+        zones := []string{}
+        zoneSubnets := map[string][]string{}
+        for _, subnet := range subnets {
+            zone := subnetZones[subnet]
+            if _, ok := zoneSubnets[zone]; !ok {
+                zones = append(zones, zone)
+            }
+            zoneSubnets[zone] = append(zoneSubnets[zone], subnet)
+        }
+        for i := 0; i < count; i++ {
+            inZone := zoneSubnets[zones[i % len(zones)]]
+            placed = append(placed, inZone[(i / len(zones)) % len(inZone)])
+        }
+    default:
+        for i := 0; i < count; i++ {
+            placed = append(placed, subnets[i % len(subnets)])
+        }
+    }
+    return placed
+}
+
+// subnetWeight is the weight of a subnet, 1 when it has none.
+func subnetWeight(weights map[string]int, subnet string) int {
+    if weight, ok := weights[subnet]; ok {
+        return weight
+    }
+    return 1
+}
+
+func uniqueStrings(values []string) []string {
+    unique := []string{}
+    seen := map[string]bool{}
+    for _, value := range values {
+        if !seen[value] {
+            seen[value] = true
+            unique = append(unique, value)
+        }
+    }
+    return unique
+}
+
+// validateDistribution checks the strategy and the subnet weights.
+func validateDistribution(c Configs) ValidationErrors {
+    errs := ValidationErrors{}
+    known := c.Distribution == DistributionListed
+    for _, strategy := range distributions {
+        known = known || c.Distribution == strategy
+    }
+    if !known {
+        errs = append(errs, &ValidationError{Msg: fmt.Sprintf("Unknown distribution %q, must be one of %s.", c.Distribution, strings.Join(distributions, ", "))})
+    }
+    if len(c.SubnetWeights) > 0 && c.Distribution != DistributionWeighted {
+        errs = append(errs, &ValidationError{Msg: "subnetWeights are only used with the weighted distribution."})
+    }
+    subnets := map[string]bool{}
+    for _, subnet := range c.FleetNodes() {
+        subnets[subnet.SubnetId] = true
+    }
+    for _, subnet := range c.Subnets {
+        subnets[subnet] = true
+    }
+    for subnet, weight := range c.SubnetWeights {
+        if !subnets[subnet] {
+            errs = append(errs, &ValidationError{Msg: "subnetWeights names " + subnet + ", which is not one of the subnets."})
+        }
+        if weight < 0 {
+            errs = append(errs, &ValidationError{Msg: "Weight of subnet " + subnet + " can not be negative."})
+        }
+    }
+    if c.Distribution == DistributionWeighted {
+        for _, group := range c.groupSubnets() {
+            total := 0
+            for _, subnet := range uniqueStrings(group.subnets) {
+                total += subnetWeight(c.SubnetWeights, subnet)
+            }
+            if total <= 0 && group.count > 0 {
+                errs = append(errs, &ValidationError{Msg: "Every subnet of a node group has weight 0."})
+            }
+        }
+    }
+    return errs
+}
@@ -0,0 +1,162 @@
+package util
+
+import "reflect"
+import "testing"
+
+
+var distributionZones = map[string]string{"sub1": "us-east-1a", "sub2": "us-east-1a", "sub3": "us-east-1b", "sub4": "us-east-1c"}
+
+func placedSubnets(configs Configs) []string {
+    subnets := []string{}
+    for _, node := range configs.PlaceNodes(distributionZones) {
+        subnets = append(subnets, node.SubnetId)
+    }
+    return subnets
+}
+
+func TestDistributionStrategies(t *testing.T) {
+    configs := Configs{
+        NodeGroups: []NodeGroup{{Count: 6, Subnets: []string{"sub1", "sub2", "sub3", "sub4"}, InstanceTypes: []string{"t3.micro"}}},
+    }
+    expected := map[string][]string{
+        DistributionListed:     {"sub1", "sub2", "sub3", "sub4", "sub1", "sub2"},
+        DistributionRoundRobin: {"sub1", "sub2", "sub3", "sub4", "sub1", "sub2"},
+        DistributionPack:       {"sub1", "sub2", "sub1", "sub2", "sub1", "sub2"},
+        DistributionSpread:     {"sub1", "sub3", "sub4", "sub2", "sub3", "sub4"},
+    }
+    for strategy, subnets := range expected {
+        configs.Distribution = strategy
+        if placed := placedSubnets(configs); !reflect.DeepEqual(placed, subnets) {
+            t.Errorf("TestDistributionStrategies %q got %v, expected %v", strategy, placed, subnets)
+        }
+    }
+
+    configs.Distribution = DistributionWeighted
+    configs.SubnetWeights = map[string]int{"sub1": 2, "sub2": 0, "sub3": 1, "sub4": 0}
+    counts := map[string]int{}
+    for _, subnet := range placedSubnets(configs) {
+        counts[subnet]++
+    }
+    if !reflect.DeepEqual(counts, map[string]int{"sub1": 4, "sub3": 2}) {
+        t.Errorf("TestDistributionStrategies weighted got %v", counts)
+    }
+}
+
+func TestDistributionLists(t *testing.T) {
+    // The listed subnets become the candidates, each node keeps its type
+    configs := Configs{
+        Nodes:         4,
+        Subnets:       []string{"sub1", "sub1", "sub1", "sub3"},
+        InstanceTypes: []string{"t3.micro", "t3.small", "t3.micro", "t3.small"},
+        Distribution:  DistributionRoundRobin,
+    }
+    nodes := configs.PlaceNodes(distributionZones)
+    if nodes[1].SubnetId != "sub3" || nodes[1].InstanceType != "t3.small" || nodes[2].SubnetId != "sub1" {
+        t.Errorf("TestDistributionLists got %v", nodes)
+    }
+}
+
+func TestDistributionValidate(t *testing.T) {
+    configs := Configs{
+        Nodes:          2,
+        VolumeSize:     4,
+        SecurityGroups: []string{"sg1"},
+        Subnets:        []string{"sub1", "sub2"},
+        InstanceTypes:  []string{"t3.micro", "t3.micro"},
+        Distribution:   "even",
+        SubnetWeights:  map[string]int{"sub9": 1},
+    }
+    errs, ok := ValidateConfigs(configs).(ValidationErrors)
+    // unknown strategy, weights without weighted, unknown subnet
+    if !ok || len(errs) != 3 {
+        t.Errorf("TestDistributionValidate got %v", errs)
+    }
+    configs.Distribution = DistributionWeighted
+    configs.SubnetWeights = map[string]int{"sub1": 0, "sub2": 0}
+    if err := ValidateConfigs(configs); err == nil {
+        t.Errorf("TestDistributionValidate accepted all weights 0")
+    }
+}
+
+func TestDistributionPlanZones(t *testing.T) {
+    configs := Configs{
+        Distribution: DistributionSpread,
+        NodeGroups:   []NodeGroup{{Count: 20, Subnets: []string{"sub1", "sub3"}, InstanceTypes: []string{"t3.micro"}}},
+    }
+    template := GetCreateLaunchTemplateInput("ec2fleet-template", "ami-1", "t3.micro", []string{"sg1"}, nil)
+    fleet := GetCreateFleetRequestInput(configs.PlaceNodes(distributionZones), LaunchTemplateRef{Id: "lt-1", Version: "1"}, distributionZones, configs, nil)
+    plan := NewPlan(template, fleet, []VolumeSpec{{Size: 4}}, nil)
+    expected := []PlanZone{{"us-east-1a", 10, 1, 0, 10}, {"us-east-1b", 10, 1, 0, 10}}
+    if !reflect.DeepEqual(plan.Zones, expected) {
+        t.Errorf("TestDistributionPlanZones got %v", plan.Zones)
+    }
+
+    configs.Distribution = DistributionListed
+    configs.NodeGroups[0].Subnets = []string{"sub1"}
+    fleet = GetCreateFleetRequestInput(configs.PlaceNodes(distributionZones), LaunchTemplateRef{Id: "lt-1", Version: "1"}, distributionZones, configs, nil)
+    plan = NewPlan(template, fleet, []VolumeSpec{{Size: 4}}, nil)
+    expected = []PlanZone{{"us-east-1a", 20, 2, 0, 20}}
+    if !reflect.DeepEqual(plan.Zones, expected) {
+        t.Errorf("TestDistributionPlanZones one subnet got %v", plan.Zones)
+    }
+}
+
+func TestDistributionFleetRequestsByZone(t *testing.T) {
+    configs := Configs{
+        Distribution:       DistributionWeighted,
+        SubnetWeights:      map[string]int{"sub1": 3, "sub3": 1},
+        OnDemandPercentage: 50,
+        NodeGroups:         []NodeGroup{{Count: 8, Subnets: []string{"sub1", "sub3"}, InstanceTypes: []string{"t3.micro"}}},
+    }
+    fleet := GetCreateFleetRequestInput(configs.PlaceNodes(distributionZones), LaunchTemplateRef{Id: "lt-1", Version: "1"}, distributionZones, configs, nil)
+    requests := FleetRequestsByZone(fleet)
+    if len(requests) != 2 {
+        t.Fatalf("TestDistributionFleetRequestsByZone got %d requests", len(requests))
+    }
+    // Each AZ asks for its own nodes, and half of them on-demand
+    for i, expected := range []struct{ zone string; total, onDemand int64 }{{"us-east-1a", 6, 3}, {"us-east-1b", 2, 1}} {
+        capacity := requests[i].TargetCapacitySpecification
+        overrides := requests[i].LaunchTemplateConfigs[0].Overrides
+        if *capacity.TotalTargetCapacity != expected.total || *capacity.OnDemandTargetCapacity != expected.onDemand ||
+           *capacity.SpotTargetCapacity != expected.total - expected.onDemand {
+            t.Errorf("TestDistributionFleetRequestsByZone %s got %v", expected.zone, capacity)
+        }
+        for _, override := range overrides {
+            if *override.AvailabilityZone != expected.zone {
+                t.Errorf("TestDistributionFleetRequestsByZone %s has override %v", expected.zone, override)
+            }
+        }
+    }
+    // The request itself is left as is
+    if *fleet.TargetCapacitySpecification.TotalTargetCapacity != 8 || len(fleet.LaunchTemplateConfigs[0].Overrides) != 8 {
+        t.Errorf("TestDistributionFleetRequestsByZone changed the fleet request")
+    }
+}
+
+func TestDistributionCandidateSubnets(t *testing.T) {
+    configs := Configs{
+        Nodes:          5,
+        Distribution:   DistributionRoundRobin,
+        Subnets:        []string{"sub1", "sub3"},
+        InstanceTypes:  []string{"t3.micro"},
+        SecurityGroups: []string{"sg1"},
+        VolumeSize:     4,
+    }
+    if err := ValidateConfigs(configs); err != nil {
+        t.Fatalf("TestDistributionCandidateSubnets failed: %v", err)
+    }
+    nodes := configs.PlaceNodes(distributionZones)
+    if len(nodes) != 5 || nodes[4].SubnetId != "sub1" || nodes[3].SubnetId != "sub3" || nodes[4].InstanceType != "t3.micro" {
+        t.Errorf("TestDistributionCandidateSubnets got %+v", nodes)
+    }
+    configs.RemoveNodes(2)
+    configs.AddNodes([]FleetNode{{SubnetId: "sub3", InstanceType: "t3.micro"}})
+    if configs.Nodes != 4 || len(configs.Subnets) != 2 || len(configs.InstanceTypes) != 1 {
+        t.Errorf("TestDistributionCandidateSubnets scaled to %+v", configs)
+    }
+
+    configs.Distribution = DistributionListed
+    if err := ValidateConfigs(configs); err == nil {
+        t.Errorf("TestDistributionCandidateSubnets accepted 2 listed subnets for 4 nodes")
+    }
+}
@@ -0,0 +1,175 @@
+/* Copyright (C) Xiang Wang - All Rights Reserved
+ * Unauthorized copying of this file, via any medium is strictly prohibited
+ * Proprietary and confidential
+ * Written by Xiang Wang <xwang1314@gmail.com>, August 2020
+ */
+
+package util
+
+import "github.com/aws/aws-sdk-go/service/ec2"
+import "github.com/aws/aws-sdk-go/aws/awserr"
+import "github.com/aws/aws-sdk-go/aws"
+import "strings"
+import "fmt"
+import "log"
+
+
+// Outcomes of a dry-run call.
+const (
+    DryRunAllowed      = "ALLOWED"
+    DryRunDenied       = "DENIED"
+    DryRunUnverifiable = "NOT VERIFIABLE"
+    DryRunError        = "ERROR"
+)
+
+// DryRunResult is the outcome of one mutating call sent with DryRun: true.
+type DryRunResult struct {
+    Op      string
+    Status  string
+    Code    string
+    Message string
+}
+
+// recordDryRun records the answer to a dry-run call that referenced ids.
+// AWS answers a permitted dry-run call with a DryRunOperation error and a
+// forbidden one with UnauthorizedOperation. A call on a placeholder ID can
+// also fail its lookup before the permission check, which leaves the step
+// not verifiable rather than denied. Any other error, or no error at all
+// because the call really ran, is reported as an error.
+func (p *Provisioner) recordDryRun(op string, err error, ids ...string) {
+    result := DryRunResult{Op: op, Status: DryRunError}
+    if aerr, ok := err.(awserr.Error); ok {
+        result.Code = aerr.Code()
+        result.Message = aerr.Message()
+        switch {
+        case result.Code == "DryRunOperation":
+            result.Status = DryRunAllowed
+        case result.Code == "UnauthorizedOperation":
+            result.Status = DryRunDenied
+        case notFoundCode(result.Code) && p.anyPlaceholder(ids):
+            result.Status = DryRunUnverifiable
+        }
+    } else if err != nil {
+        result.Message = err.Error()
+    } else {
+        result.Message = "The call ran instead of being checked, it was not sent as a dry run."
+    }
+    switch result.Status {
+    case DryRunAllowed:
+        log.Println(op, "DryRun succeeded.")
+    case DryRunUnverifiable:
+        log.Println(op, "DryRun could not be verified:", result.Code, result.Message)
+    default:
+        log.Println(op, "DryRun failed:", result.Code, result.Message)
+    }
+    p.dryRunResults = append(p.dryRunResults, result)
+}
+
+// notFoundCode reports whether code is a failed lookup of a resource ID,
+// eg. InvalidInstanceID.NotFound or InvalidLaunchTemplateId.Malformed.
+func notFoundCode(code string) bool {
+    return strings.HasSuffix(code, ".NotFound") || strings.HasPrefix(code, "InvalidLaunchTemplateId.")
+}
+
+func (p *Provisioner) anyPlaceholder(ids []string) bool {
+    for _, id := range ids {
+        if p.placeholderIds[id] {
+            return true
+        }
+    }
+    return false
+}
+
+// DryRunResults returns the result of every dry-run call so far.
+func (p *Provisioner) DryRunResults() []DryRunResult {
+    return p.dryRunResults
+}
+
+// DryRunFailed reports whether any dry-run call would have failed. Steps
+// that could not be verified do not count.
+func (p *Provisioner) DryRunFailed() bool {
+    for _, result := range p.dryRunResults {
+        if result.Status == DryRunDenied || result.Status == DryRunError {
+            return true
+        }
+    }
+    return false
+}
+
+// placeholderId returns a unique fake ID for a resource that a dry run did
+// not create. It is well formed, eg. i-0000000000000d001, so that the dry-run
+// calls taking it reach the permission check instead of failing validation.
+// Fleet IDs are UUIDs.
+func (p *Provisioner) placeholderId(prefix string) string {
+    p.placeholders++
+    id := fmt.Sprintf("%s-0000000000000d%03x", prefix, p.placeholders)
+    if prefix == "fleet" {
+        id = fmt.Sprintf("fleet-00000000-0000-0000-0000-0000000d%04x", p.placeholders)
+    }
+    if p.placeholderIds == nil {
+        p.placeholderIds = map[string]bool{}
+    }
+    p.placeholderIds[id] = true
+    return id
+}
+
+// dryRunFleet answers a dry-run CreateFleet with one placeholder instance per
+// unit of target capacity, spread over the overrides like the real request.
+func (p *Provisioner) dryRunFleet(input *ec2.CreateFleetInput) *ec2.CreateFleetOutput {
+    output := &ec2.CreateFleetOutput{FleetId: aws.String(p.placeholderId("fleet"))}
+    config := input.LaunchTemplateConfigs[0]
+    capacity := input.TargetCapacitySpecification
+    onDemand := aws.Int64Value(capacity.OnDemandTargetCapacity)
+    for i := int64(0); i < aws.Int64Value(capacity.TotalTargetCapacity); i++ {
+        override := config.Overrides[int(i) % len(config.Overrides)]
+        lifecycle := "spot"
+        if i < onDemand {
+            lifecycle = "on-demand"
+        }
+        output.Instances = append(output.Instances, &ec2.CreateFleetInstance{
+            InstanceIds:  aws.StringSlice([]string{p.placeholderId("i")}),
+            InstanceType: override.InstanceType,
+            Lifecycle:    aws.String(lifecycle),
+            LaunchTemplateAndOverrides: &ec2.LaunchTemplateAndOverridesResponse{
+                Overrides: &ec2.FleetLaunchTemplateOverrides{
+                    AvailabilityZone: override.AvailabilityZone,
+                    InstanceType:     override.InstanceType,
+                    SubnetId:         override.SubnetId,
+                },
+            },
+        })
+    }
+    return output
+}
+
+// FormatDryRunReport renders one line per step, folding repeated calls
+// with the same outcome (eg. one attach per instance) into a count.
+func FormatDryRunReport(results []DryRunResult) string {
+    type step struct {
+        result DryRunResult
+        calls  int
+    }
+    steps := []*step{}
+    for _, result := range results {
+        var found *step
+        for _, s := range steps {
+            if s.result.Op == result.Op && s.result.Status == result.Status && s.result.Code == result.Code {
+                found = s
+            }
+        }
+        if found == nil {
+            found = &step{result: result}
+            steps = append(steps, found)
+        }
+        found.calls++
+    }
+    lines := []string{fmt.Sprintf("%-24s %-6s %-14s %s", "STEP", "CALLS", "RESULT", "DETAIL")}
+    for _, s := range steps {
+        detail := ""
+        if s.result.Status != DryRunAllowed {
+            detail = strings.TrimSpace(s.result.Code + " " + s.result.Message)
+        }
+        lines = append(lines, fmt.Sprintf("%-24s %-6d %-14s %s", s.result.Op, s.calls, s.result.Status, detail))
+    }
+    return strings.Join(lines, "\n")
+}
@@ -0,0 +1,113 @@
+package util
+
+import "github.com/aws/aws-sdk-go/service/ec2"
+import "github.com/aws/aws-sdk-go/aws/awserr"
+import "strings"
+import "regexp"
+import "testing"
+
+
+// EC2 rejects malformed IDs before it checks the permissions of a dry run
+var validId = regexp.MustCompile(`^(i|vol|lt)-[0-9a-f]{17}$`)
+
+func TestDryRunContinuesWithPlaceholders(t *testing.T) {
+    fake := &fakeEC2{denied: map[string]bool{"CreateVolume": true}}
+    p := NewProvisioner(fake)
+    p.DryRun = true
+
+    template, err := p.CreateLaunchTemplate(GetCreateLaunchTemplateInput("name", "ami-1", "t3.micro", []string{"sg1"}, nil))
+    if err != nil || !validId.MatchString(*template.LaunchTemplate.LaunchTemplateId) {
+        t.Fatalf("TestDryRunContinuesWithPlaceholders failed: %v", err)
+    }
+    configs := Configs{Nodes: 3, OnDemandPercentage: 20, Subnets: []string{"sub1", "sub2", "sub3"}, InstanceTypes: []string{"t3.micro", "t3.micro", "t3.micro"}}
+    input := GetCreateFleetRequestInput(configs.FleetNodes(), LaunchTemplateRef{Id: *template.LaunchTemplate.LaunchTemplateId, Version: "1"},
+                                        map[string]string{"sub1": "us-east-1a", "sub2": "us-east-1b", "sub3": "us-east-1c"},
+                                        configs, nil)
+    fleet, err := p.CreateFleet(input)
+    if err != nil || len(fleet.Instances) != 3 || !*fake.fleets[0].DryRun {
+        t.Fatalf("TestDryRunContinuesWithPlaceholders failed: %v", err)
+    }
+    volume, err := p.CreateVolume(VolumeSpec{Size: 4}, "us-east-1a", nil)
+    if err != nil {
+        t.Fatalf("TestDryRunContinuesWithPlaceholders failed: %v", err)
+    }
+    if !validId.MatchString(*volume.VolumeId) {
+        t.Errorf("TestDryRunContinuesWithPlaceholders got volume ID %s", *volume.VolumeId)
+    }
+    for _, instance := range fleet.Instances {
+        if !validId.MatchString(*instance.InstanceIds[0]) {
+            t.Errorf("TestDryRunContinuesWithPlaceholders got instance ID %s", *instance.InstanceIds[0])
+        }
+        if _, err := p.AttachVolume(*instance.InstanceIds[0], *volume.VolumeId, "/dev/sdf"); err != nil {
+            t.Fatalf("TestDryRunContinuesWithPlaceholders failed: %v", err)
+        }
+    }
+
+    if len(p.DryRunResults()) != 6 || !p.DryRunFailed() {
+        t.Errorf("TestDryRunContinuesWithPlaceholders recorded %v", p.DryRunResults())
+    }
+    report := FormatDryRunReport(p.DryRunResults())
+    if !strings.Contains(report, "UnauthorizedOperation") || strings.Count(report, "\n") != 4 {
+        t.Errorf("TestDryRunContinuesWithPlaceholders report:\n%s", report)
+    }
+}
+
+func TestDryRunCallThatRan(t *testing.T) {
+    p := NewProvisioner(&fakeEC2{})
+    p.recordDryRun("Create volume", nil)
+    if !p.DryRunFailed() || p.DryRunResults()[0].Status != DryRunError {
+        t.Errorf("TestDryRunCallThatRan recorded %v", p.DryRunResults())
+    }
+}
+
+func TestDryRunPlaceholderNotFound(t *testing.T) {
+    notFound := map[string]string{
+        "AttachVolume":                "InvalidInstanceID.NotFound",
+        "CreateLaunchTemplateVersion": "InvalidLaunchTemplateId.NotFound",
+    }
+    for op, code := range notFound {
+        fake := &fakeEC2{failures: map[string]error{op: awserr.New(code, "The ID does not exist", nil)}}
+        p := NewProvisioner(fake)
+        p.DryRun = true
+        instanceId := p.placeholderId("i")
+        templateId := p.placeholderId("lt")
+        if op == "AttachVolume" {
+            _, err := p.AttachVolume(instanceId, p.placeholderId("vol"), "/dev/sdf")
+            if err != nil {
+                t.Fatalf("TestDryRunPlaceholderNotFound failed: %v", err)
+            }
+        } else if _, err := p.CreateLaunchTemplateVersion(templateId, &ec2.RequestLaunchTemplateData{}); err != nil {
+            t.Fatalf("TestDryRunPlaceholderNotFound failed: %v", err)
+        }
+        results := p.DryRunResults()
+        if len(results) != 1 || results[0].Status != DryRunUnverifiable || p.DryRunFailed() {
+            t.Errorf("TestDryRunPlaceholderNotFound recorded %v for %s", results, code)
+        }
+        if !strings.Contains(FormatDryRunReport(results), "NOT VERIFIABLE "+code) {
+            t.Errorf("TestDryRunPlaceholderNotFound report:\n%s", FormatDryRunReport(results))
+        }
+    }
+
+    // The same code on a real ID is a failure
+    fake := &fakeEC2{failures: map[string]error{"CreateLaunchTemplateVersion": awserr.New("InvalidLaunchTemplateId.NotFound", "", nil)}}
+    p := NewProvisioner(fake)
+    p.DryRun = true
+    if _, err := p.CreateLaunchTemplateVersion("lt-00000000000000001", &ec2.RequestLaunchTemplateData{}); err != nil {
+        t.Fatalf("TestDryRunPlaceholderNotFound failed: %v", err)
+    }
+    if !p.DryRunFailed() || p.DryRunResults()[0].Status != DryRunError {
+        t.Errorf("TestDryRunPlaceholderNotFound recorded %v", p.DryRunResults())
+    }
+}
+
+func TestDryRunUnauthorized(t *testing.T) {
+    fake := &fakeEC2{denied: map[string]bool{"AttachVolume": true}}
+    p := NewProvisioner(fake)
+    p.DryRun = true
+    if _, err := p.AttachVolume(p.placeholderId("i"), p.placeholderId("vol"), "/dev/sdf"); err != nil {
+        t.Fatalf("TestDryRunUnauthorized failed: %v", err)
+    }
+    if !p.DryRunFailed() || p.DryRunResults()[0].Status != DryRunDenied {
+        t.Errorf("TestDryRunUnauthorized recorded %v", p.DryRunResults())
+    }
+}
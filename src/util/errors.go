@@ -0,0 +1,94 @@
+/* Copyright (C) Xiang Wang - All Rights Reserved
+ * Unauthorized copying of this file, via any medium is strictly prohibited
+ * Proprietary and confidential
+ * Written by Xiang Wang <xwang1314@gmail.com>, August 2020
+ */
+
+package util
+
+import "github.com/aws/aws-sdk-go/aws/awserr"
+import "strings"
+import "fmt"
+import "time"
+
+
+// ValidationError reports inputs or configuration that can not be used.
+type ValidationError struct {
+    Msg string
+    Err error
+}
+
+func (e *ValidationError) Error() string {
+    if e.Err != nil {
+        return e.Msg + ": " + e.Err.Error()
+    }
+    return e.Msg
+}
+
+func (e *ValidationError) Unwrap() error {
+    return e.Err
+}
+
+// ValidationErrors collects every problem found in the inputs, so they can
+// all be fixed at once. errors.As finds the *ValidationError in it.
+type ValidationErrors []error
+
+func (e ValidationErrors) Error() string {
+    if len(e) == 1 {
+        return e[0].Error()
+    }
+    msgs := []string{fmt.Sprintf("%d problems:", len(e))}
+    for _, err := range e {
+        msgs = append(msgs, "  - "+err.Error())
+    }
+    return strings.Join(msgs, "\n")
+}
+
+func (e ValidationErrors) Unwrap() []error {
+    return e
+}
+
+// errOrNil returns nil when nothing was collected.
+func (e ValidationErrors) errOrNil() error {
+    if len(e) == 0 {
+        return nil
+    }
+    return e
+}
+
+// AWSError wraps a failed EC2 API call with the operation that made it.
+type AWSError struct {
+    Op  string
+    Err error
+}
+
+func (e *AWSError) Error() string {
+    return e.Op + " failed: " + e.Err.Error()
+}
+
+func (e *AWSError) Unwrap() error {
+    return e.Err
+}
+
+// Code returns the AWS error code, or "" when the failure did not come
+// from the AWS API itself (eg. a network error).
+func (e *AWSError) Code() string {
+    if aerr, ok := e.Err.(awserr.Error); ok {
+        return aerr.Code()
+    }
+    return ""
+}
+
+// TimeoutError reports a resource that did not reach the expected state in time.
+type TimeoutError struct {
+    Op     string
+    Waited time.Duration
+}
+
+func (e *TimeoutError) Error() string {
+    return fmt.Sprintf("%s timed out after %v", e.Op, e.Waited)
+}
+
+func newAWSError(op string, err error) error {
+    return &AWSError{Op: op, Err: err}
+}
@@ -0,0 +1,68 @@
+package util
+
+import "github.com/aws/aws-sdk-go/service/ec2"
+import "github.com/aws/aws-sdk-go/aws/awserr"
+import "io/ioutil"
+import "testing"
+import "errors"
+import "os"
+
+
+type failingEC2 struct {
+    fakeEC2
+}
+
+func (f *failingEC2) CreateFleet(in *ec2.CreateFleetInput) (*ec2.CreateFleetOutput, error) {
+    return nil, awserr.New("UnauthorizedOperation", "not allowed", nil)
+}
+
+func TestErrorsAWSError(t *testing.T) {
+    p := NewProvisioner(&failingEC2{})
+    _, err := p.CreateFleet(&ec2.CreateFleetInput{})
+    var awsErr *AWSError
+    if !errors.As(err, &awsErr) || awsErr.Code() != "UnauthorizedOperation" {
+        t.Errorf("TestErrorsAWSError failed: %v", err)
+    }
+}
+
+func TestErrorsTimeout(t *testing.T) {
+    p := NewProvisioner(&fakeEC2{status: "pending"})
+    p.pollInterval = 0
+    _, err := p.AttachVolume("i-1", "vol-1", "/dev/sdf")
+    var timeoutErr *TimeoutError
+    if !errors.As(err, &timeoutErr) {
+        t.Errorf("TestErrorsTimeout failed: %v", err)
+    }
+}
+
+func TestErrorsValidation(t *testing.T) {
+    err := ValidateInputs(0, 4, nil, []string{"sg1"}, nil)
+    var validationErr *ValidationError
+    if !errors.As(err, &validationErr) {
+        t.Errorf("TestErrorsValidation failed: %v", err)
+    }
+    _, err = GetJsonObjectFromFile("does-not-exist.json")
+    if !errors.As(err, &validationErr) {
+        t.Errorf("TestErrorsValidation failed: %v", err)
+    }
+}
+
+func TestErrorsStateFileWrite(t *testing.T) {
+    dir, err := ioutil.TempDir("", "ec2fleet")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+    // The state directory is a file, so the state can not be written
+    ioutil.WriteFile(dir + "/state", nil, 0644)
+    stateFile := &StateFile{Path: StateFilePath(dir + "/state", "run-1"), State: &RunState{RunId: "run-1"}}
+    err = stateFile.Save()
+    var validationErr *ValidationError
+    if err == nil || errors.As(err, &validationErr) {
+        t.Errorf("TestErrorsStateFileWrite got %v", err)
+    }
+    var pathErr *os.PathError
+    if !errors.As(err, &pathErr) {
+        t.Errorf("TestErrorsStateFileWrite does not wrap the IO error: %v", err)
+    }
+}
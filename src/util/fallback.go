@@ -0,0 +1,168 @@
+/* Copyright (C) Xiang Wang - All Rights Reserved
+ * Unauthorized copying of this file, via any medium is strictly prohibited
+ * Proprietary and confidential
+ * Written by Xiang Wang <xwang1314@gmail.com>, August 2020
+ */
+
+package util
+
+import "github.com/aws/aws-sdk-go/service/ec2"
+import "github.com/aws/aws-sdk-go/aws/awserr"
+import "github.com/aws/aws-sdk-go/aws"
+import "errors"
+import "fmt"
+
+
+// InsufficientCapacityCode is the error code of EC2 running out of an
+// instance type in an AZ.
+const InsufficientCapacityCode = "InsufficientInstanceCapacity"
+
+// FallbackOnDemand is the name of the fallback that buys the missing
+// capacity on-demand.
+const FallbackOnDemand = "on-demand"
+
+// fleetFallback is one step of the fallback chain: a change to the fleet
+// request for the missing capacity.
+type fleetFallback struct {
+    name  string
+    apply func(input *ec2.CreateFleetInput) *ec2.CreateFleetInput
+}
+
+// withOverrides returns a copy of input with every override passed to change.
+func withOverrides(input *ec2.CreateFleetInput, change func(*ec2.FleetLaunchTemplateOverridesRequest)) *ec2.CreateFleetInput {
+    copied := *input
+    copied.LaunchTemplateConfigs = []*ec2.FleetLaunchTemplateConfigRequest{}
+    for _, config := range input.LaunchTemplateConfigs {
+        configCopy := *config
+        configCopy.Overrides = []*ec2.FleetLaunchTemplateOverridesRequest{}
+        for _, override := range config.Overrides {
+            overrideCopy := *override
+            change(&overrideCopy)
+            configCopy.Overrides = append(configCopy.Overrides, &overrideCopy)
+        }
+        copied.LaunchTemplateConfigs = append(copied.LaunchTemplateConfigs, &configCopy)
+    }
+    return &copied
+}
+
+// fleetFallbacks is the fallback chain of configs: every fallback instance
+// type, then every fallback subnet, then on-demand.
+func (c Configs) fleetFallbacks(subnetZones map[string]string) []fleetFallback {
+    fallbacks := []fleetFallback{}
+    for _, instanceType := range c.FallbackInstanceTypes {
+        instanceType := instanceType
+        fallbacks = append(fallbacks, fleetFallback{
+            name: "instance type " + instanceType,
+            apply: func(input *ec2.CreateFleetInput) *ec2.CreateFleetInput {
+                return withOverrides(input, func(override *ec2.FleetLaunchTemplateOverridesRequest) {
+                    override.InstanceType = aws.String(instanceType)
+                })
+            },
+        })
+    }
+    for _, subnet := range c.FallbackSubnets {
+        subnet := subnet
+        fallbacks = append(fallbacks, fleetFallback{
+            name: fmt.Sprintf("subnet %s (%s)", subnet, subnetZones[subnet]),
+            apply: func(input *ec2.CreateFleetInput) *ec2.CreateFleetInput {
+                return withOverrides(input, func(override *ec2.FleetLaunchTemplateOverridesRequest) {
+                    override.SubnetId = aws.String(subnet)
+                    override.AvailabilityZone = aws.String(subnetZones[subnet])
+                })
+            },
+        })
+    }
+    if c.FallbackOnDemand {
+        fallbacks = append(fallbacks, fleetFallback{
+            name: FallbackOnDemand,
+            apply: func(input *ec2.CreateFleetInput) *ec2.CreateFleetInput {
+                copied := *input
+                total := input.TargetCapacitySpecification.TotalTargetCapacity
+                copied.TargetCapacitySpecification = &ec2.TargetCapacitySpecificationRequest{
+                    OnDemandTargetCapacity:    total,
+                    SpotTargetCapacity:        aws.Int64(0),
+                    TotalTargetCapacity:       total,
+                    DefaultTargetCapacityType: aws.String(ec2.DefaultTargetCapacityTypeOnDemand),
+                }
+                return &copied
+            },
+        })
+    }
+    return fallbacks
+}
+
+// insufficientCapacity tells whether EC2 ran out of capacity for the fleet.
+func (r FleetResult) insufficientCapacity() bool {
+    for _, e := range r.Errors {
+        if e.Code == InsufficientCapacityCode {
+            return true
+        }
+    }
+    return false
+}
+
+// InsufficientCapacityResult returns the result of a CreateFleet call that
+// failed because EC2 ran out of capacity, so that the fallbacks can take
+// over, and false for any other error.
+func InsufficientCapacityResult(err error, fallback string) (FleetResult, bool) {
+    var awsErr awserr.Error
+    if !errors.As(err, &awsErr) || awsErr.Code() != InsufficientCapacityCode {
+        return FleetResult{}, false
+    }
+    return FleetResult{
+        Fallback: fallback,
+        Errors:   []FleetError{{Code: awsErr.Code(), Message: awsErr.Message()}},
+    }, true
+}
+
+// NextFleetRequest returns the next fleet to request for input, given the
+// results of the fleets requested so far, and the name of the fallback it
+// uses. The configured nodes are retried as the partial fulfillment policy
+// says; once EC2 runs out of capacity for them, each fallback is tried once,
+// in order, for the capacity still missing. It returns nil when there is
+// nothing left to try.
+func (c Configs) NextFleetRequest(input *ec2.CreateFleetInput,
+                                  subnetZones map[string]string,
+                                  results []FleetResult) (*ec2.CreateFleetInput, string) {
+    if len(results) == 0 {
+        return input, ""
+    }
+    shortfall := ShortfallRequest(input, results)
+    if shortfall == nil {
+        return nil, ""
+    }
+    last := results[len(results) - 1]
+    if last.Fallback == "" && c.PartialFulfillment == PartialFulfillmentRetry && len(results) <= FleetRetries {
+        return shortfall, ""
+    }
+    if !last.insufficientCapacity() {
+        return nil, ""
+    }
+    tried := 0
+    for _, result := range results {
+        if result.Fallback != "" {
+            tried++
+        }
+    }
+    fallbacks := c.fleetFallbacks(subnetZones)
+    if tried >= len(fallbacks) {
+        return nil, ""
+    }
+    return fallbacks[tried].apply(shortfall), fallbacks[tried].name
+}
+
+// validateFallbacks checks the fallback instance types and subnets.
+func validateFallbacks(c Configs) ValidationErrors {
+    errs := ValidationErrors{}
+    if containsEmpty(c.FallbackInstanceTypes) {
+        errs = append(errs, &ValidationError{Msg: "fallbackInstanceTypes must not contain empty instance types."})
+    }
+    if containsEmpty(c.FallbackSubnets) {
+        errs = append(errs, &ValidationError{Msg: "fallbackSubnets must not contain empty subnets."})
+    }
+    fallbacks := len(c.FallbackInstanceTypes) > 0 || len(c.FallbackSubnets) > 0 || c.FallbackOnDemand
+    if fallbacks && c.FleetTypeOrDefault() != ec2.FleetTypeInstant {
+        errs = append(errs, &ValidationError{Msg: "Fallbacks only apply to instant fleets."})
+    }
+    return errs
+}
@@ -0,0 +1,107 @@
+package util
+
+import "github.com/aws/aws-sdk-go/service/ec2"
+import "github.com/aws/aws-sdk-go/aws/awserr"
+import "github.com/aws/aws-sdk-go/aws"
+import "testing"
+
+
+var fallbackZones = map[string]string{"sub1": "us-east-1a", "sub2": "us-east-1b", "sub3": "us-east-1c"}
+
+func fallbackConfigs() Configs {
+    configs := purchasingConfigs()
+    configs.FallbackInstanceTypes = []string{"t3.small"}
+    configs.FallbackSubnets = []string{"sub3"}
+    configs.FallbackOnDemand = true
+    return configs
+}
+
+// shortResult launched spot capacity of launched and ran out of capacity for the rest.
+func shortResult(fallback string, launched int64) FleetResult {
+    return FleetResult{Fallback: fallback, SpotCapacity: launched, Errors: []FleetError{{Code: InsufficientCapacityCode}}}
+}
+
+func TestFallbackChain(t *testing.T) {
+    configs := fallbackConfigs()
+    input := GetCreateFleetRequestInput(configs.FleetNodes(), LaunchTemplateRef{Id: "lt-1", Version: "1"}, fallbackZones, configs, nil)
+    if next, fallback := configs.NextFleetRequest(input, fallbackZones, nil); next != input || fallback != "" {
+        t.Fatalf("TestFallbackChain first request %v %q", next, fallback)
+    }
+
+    results := []FleetResult{shortResult("", 1)}
+    next, fallback := configs.NextFleetRequest(input, fallbackZones, results)
+    if fallback != "instance type t3.small" || aws.StringValue(next.LaunchTemplateConfigs[0].Overrides[0].InstanceType) != "t3.small" ||
+       aws.Int64Value(next.TargetCapacitySpecification.TotalTargetCapacity) != 3 {
+        t.Errorf("TestFallbackChain instance type fallback %q %v", fallback, next)
+    }
+    // The configured request is left alone
+    if aws.StringValue(input.LaunchTemplateConfigs[0].Overrides[0].InstanceType) != "t3.micro" {
+        t.Errorf("TestFallbackChain changed the request %v", input)
+    }
+
+    results = append(results, shortResult(fallback, 1))
+    next, fallback = configs.NextFleetRequest(input, fallbackZones, results)
+    override := next.LaunchTemplateConfigs[0].Overrides[0]
+    if fallback != "subnet sub3 (us-east-1c)" || aws.StringValue(override.SubnetId) != "sub3" || aws.StringValue(override.AvailabilityZone) != "us-east-1c" ||
+       aws.StringValue(override.InstanceType) != "t3.micro" {
+        t.Errorf("TestFallbackChain subnet fallback %q %v", fallback, next)
+    }
+
+    results = append(results, shortResult(fallback, 0))
+    next, fallback = configs.NextFleetRequest(input, fallbackZones, results)
+    capacity := next.TargetCapacitySpecification
+    if fallback != FallbackOnDemand || aws.Int64Value(capacity.OnDemandTargetCapacity) != 2 || aws.Int64Value(capacity.SpotTargetCapacity) != 0 {
+        t.Errorf("TestFallbackChain on-demand fallback %q %v", fallback, capacity)
+    }
+
+    results = append(results, shortResult(fallback, 1))
+    if next, _ := configs.NextFleetRequest(input, fallbackZones, results); next != nil {
+        t.Errorf("TestFallbackChain expected the chain to end, got %v", next)
+    }
+}
+
+func TestFallbackOnlyOnInsufficientCapacity(t *testing.T) {
+    configs := fallbackConfigs()
+    input := GetCreateFleetRequestInput(configs.FleetNodes(), LaunchTemplateRef{Id: "lt-1", Version: "1"}, fallbackZones, configs, nil)
+    results := []FleetResult{{SpotCapacity: 1, Errors: []FleetError{{Code: "InvalidLaunchTemplateId.NotFound"}}}}
+    if next, _ := configs.NextFleetRequest(input, fallbackZones, results); next != nil {
+        t.Errorf("TestFallbackOnlyOnInsufficientCapacity got %v", next)
+    }
+    // Retries of the configured nodes come first
+    configs.PartialFulfillment = PartialFulfillmentRetry
+    results = []FleetResult{shortResult("", 1)}
+    if _, fallback := configs.NextFleetRequest(input, fallbackZones, results); fallback != "" {
+        t.Errorf("TestFallbackOnlyOnInsufficientCapacity retry got fallback %q", fallback)
+    }
+}
+
+func TestFallbackInsufficientCapacityResult(t *testing.T) {
+    err := newAWSError("Create Fleet", awserr.New(InsufficientCapacityCode, "No capacity.", nil))
+    result, ok := InsufficientCapacityResult(err, "on-demand")
+    if !ok || result.Fallback != "on-demand" || !result.insufficientCapacity() {
+        t.Errorf("TestFallbackInsufficientCapacityResult got %+v", result)
+    }
+    if _, ok := InsufficientCapacityResult(newAWSError("Create Fleet", awserr.New("UnauthorizedOperation", "", nil)), ""); ok {
+        t.Errorf("TestFallbackInsufficientCapacityResult took any error")
+    }
+}
+
+func TestFallbackParseRecordsFallback(t *testing.T) {
+    result := ParseFleetOutput(partialFleetOutput(), "instance type t3.small")
+    if result.Instances[0].Fallback != "instance type t3.small" {
+        t.Errorf("TestFallbackParseRecordsFallback got %+v", result.Instances)
+    }
+}
+
+func TestFallbackValidate(t *testing.T) {
+    configs := fallbackConfigs()
+    configs.FallbackSubnets = []string{""}
+    configs.FleetType = ec2.FleetTypeRequest
+    errs, ok := ValidateConfigs(configs).(ValidationErrors)
+    if !ok || len(errs) != 2 {
+        t.Errorf("TestFallbackValidate got %v", errs)
+    }
+    if subnets := fallbackConfigs().SubnetIds(); len(subnets) != 2 || subnets[1] != "sub3" {
+        t.Errorf("TestFallbackValidate subnet IDs %v", subnets)
+    }
+}
@@ -0,0 +1,217 @@
+/* Copyright (C) Xiang Wang - All Rights Reserved
+ * Unauthorized copying of this file, via any medium is strictly prohibited
+ * Proprietary and confidential
+ * Written by Xiang Wang <xwang1314@gmail.com>, August 2020
+ */
+
+package util
+
+import "github.com/aws/aws-sdk-go/service/ec2"
+import "github.com/aws/aws-sdk-go/aws"
+import "strings"
+import "fmt"
+
+
+// Policies for an instant fleet that launches less than its target capacity
+const (
+    // Keep whatever launched
+    PartialFulfillmentAccept   = "accept"
+    // Request another fleet for the shortfall, up to FleetRetries times
+    PartialFulfillmentRetry    = "retry"
+    // Roll the run back
+    PartialFulfillmentRollback = "rollback"
+
+    PartialFulfillmentDefault = PartialFulfillmentAccept
+)
+
+// FleetRetries is how many fleets the retry policy requests for the shortfall.
+const FleetRetries = 3
+
+var partialFulfillmentPolicies = []string{
+    PartialFulfillmentAccept,
+    PartialFulfillmentRetry,
+    PartialFulfillmentRollback,
+}
+
+// FleetError is one entry of CreateFleetOutput.Errors: an override that could
+// not launch.
+type FleetError struct {
+    Code             string
+    Message          string
+    InstanceType     string
+    AvailabilityZone string
+    SubnetId         string
+    Lifecycle        string
+}
+
+// FleetResult is what one instant fleet launched.
+type FleetResult struct {
+    FleetId          string
+    // The fallback the fleet was requested with, empty for the configured nodes
+    Fallback         string
+    Instances        []Instance
+    Errors           []FleetError
+    OnDemandCapacity int64
+    SpotCapacity     int64
+}
+
+// fleetOverrides returns the overrides of a fleet response, which EC2 may leave out.
+func fleetOverrides(response *ec2.LaunchTemplateAndOverridesResponse) *ec2.FleetLaunchTemplateOverrides {
+    if response == nil || response.Overrides == nil {
+        return &ec2.FleetLaunchTemplateOverrides{}
+    }
+    return response.Overrides
+}
+
+// ParseFleetOutput collects every instance of an instant fleet requested with
+// fallback, including each of the IDs of a FleetInstance that holds several,
+// and its errors.
+func ParseFleetOutput(output *ec2.CreateFleetOutput, fallback string) FleetResult {
+    result := FleetResult{FleetId: aws.StringValue(output.FleetId), Fallback: fallback}
+    for _, instance := range output.Instances {
+        overrides := fleetOverrides(instance.LaunchTemplateAndOverrides)
+        lifecycle := aws.StringValue(instance.Lifecycle)
+        weight := int64(FleetNode{Weight: int(aws.Float64Value(overrides.WeightedCapacity))}.Capacity())
+        for _, id := range instance.InstanceIds {
+            result.Instances = append(result.Instances, Instance{
+                InstanceId:       aws.StringValue(id),
+                InstanceType:     aws.StringValue(instance.InstanceType),
+                AvailabilityZone: aws.StringValue(overrides.AvailabilityZone),
+                SubnetId:         aws.StringValue(overrides.SubnetId),
+                Lifecycle:        lifecycle,
+                Fallback:         fallback,
+            })
+            if lifecycle == ec2.InstanceLifecycleSpot {
+                result.SpotCapacity += weight
+            } else {
+                result.OnDemandCapacity += weight
+            }
+        }
+    }
+    for _, e := range output.Errors {
+        overrides := fleetOverrides(e.LaunchTemplateAndOverrides)
+        result.Errors = append(result.Errors, FleetError{
+            Code:             aws.StringValue(e.ErrorCode),
+            Message:          aws.StringValue(e.ErrorMessage),
+            InstanceType:     aws.StringValue(overrides.InstanceType),
+            AvailabilityZone: aws.StringValue(overrides.AvailabilityZone),
+            SubnetId:         aws.StringValue(overrides.SubnetId),
+            Lifecycle:        aws.StringValue(e.Lifecycle),
+        })
+    }
+    return result
+}
+
+// launchedCapacity adds up the on-demand and spot capacity of results.
+func launchedCapacity(results []FleetResult) (int64, int64) {
+    onDemand, spot := int64(0), int64(0)
+    for _, result := range results {
+        onDemand += result.OnDemandCapacity
+        spot += result.SpotCapacity
+    }
+    return onDemand, spot
+}
+
+// FormatFleetErrors renders one line per distinct error and override,
+// folding the repeats into a count.
+func FormatFleetErrors(errors []FleetError) string {
+    keys := []string{}
+    counts := map[string]int{}
+    for _, e := range errors {
+        key := fmt.Sprintf("%s: %s %s in %s (%s): %s", e.Code, e.Lifecycle, e.InstanceType, e.AvailabilityZone, e.SubnetId, e.Message)
+        if counts[key] == 0 {
+            keys = append(keys, key)
+        }
+        counts[key]++
+    }
+    lines := []string{}
+    for _, key := range keys {
+        line := "  - " + key
+        if counts[key] > 1 {
+            line += fmt.Sprintf(" (x%d)", counts[key])
+        }
+        lines = append(lines, line)
+    }
+    return strings.Join(lines, "\n")
+}
+
+// ShortfallRequest returns a copy of input that asks only for the capacity
+// results are short of, keeping the on-demand part that is still missing.
+// It returns nil when nothing is missing.
+func ShortfallRequest(input *ec2.CreateFleetInput, results []FleetResult) *ec2.CreateFleetInput {
+    target := input.TargetCapacitySpecification
+    onDemand, spot := launchedCapacity(results)
+    total := aws.Int64Value(target.TotalTargetCapacity) - onDemand - spot
+    if total <= 0 {
+        return nil
+    }
+    missingOnDemand := aws.Int64Value(target.OnDemandTargetCapacity) - onDemand
+    if missingOnDemand < 0 {
+        missingOnDemand = 0
+    }
+    if missingOnDemand > total {
+        missingOnDemand = total
+    }
+    shortfall := *input
+    shortfall.TargetCapacitySpecification = &ec2.TargetCapacitySpecificationRequest{
+        OnDemandTargetCapacity:    aws.Int64(missingOnDemand),
+        SpotTargetCapacity:        aws.Int64(total - missingOnDemand),
+        TotalTargetCapacity:       aws.Int64(total),
+        DefaultTargetCapacityType: target.DefaultTargetCapacityType,
+    }
+    return &shortfall
+}
+
+// CheckFulfillment applies the partial fulfillment policy of configs to the
+// fleets launched for input. It fails when the retry or rollback policy is
+// in use and less than minTargetCapacity launched; without a
+// minTargetCapacity that is the whole target capacity.
+func (c Configs) CheckFulfillment(input *ec2.CreateFleetInput, results []FleetResult) error {
+    target := aws.Int64Value(input.TargetCapacitySpecification.TotalTargetCapacity)
+    onDemand, spot := launchedCapacity(results)
+    if onDemand + spot >= target || orDefault(c.PartialFulfillment, PartialFulfillmentDefault) == PartialFulfillmentAccept {
+        return nil
+    }
+    minimum := target
+    if c.MinTargetCapacity > 0 {
+        minimum = int64(c.MinTargetCapacity)
+    }
+    if onDemand + spot >= minimum {
+        return nil
+    }
+    errors := []FleetError{}
+    for _, result := range results {
+        errors = append(errors, result.Errors...)
+    }
+    msg := fmt.Sprintf("launched capacity %d of %d, below the minimum of %d", onDemand + spot, target, minimum)
+    if len(errors) > 0 {
+        msg += ":\n" + FormatFleetErrors(errors)
+    }
+    return &AWSError{Op: "Create Fleet", Err: fmt.Errorf("%s", msg)}
+}
+
+// validateFulfillment checks the partial fulfillment policy.
+func validateFulfillment(c Configs) ValidationErrors {
+    errs := ValidationErrors{}
+    policy := orDefault(c.PartialFulfillment, PartialFulfillmentDefault)
+    valid := false
+    for _, ok := range partialFulfillmentPolicies {
+        valid = valid || policy == ok
+    }
+    if !valid {
+        errs = append(errs, &ValidationError{Msg: fmt.Sprintf("Invalid partialFulfillment %q, must be one of %s.", policy, strings.Join(partialFulfillmentPolicies, ", "))})
+    }
+    if c.PartialFulfillment != "" && c.FleetTypeOrDefault() != ec2.FleetTypeInstant {
+        errs = append(errs, &ValidationError{Msg: "partialFulfillment only applies to instant fleets."})
+    }
+    capacity := 0
+    for _, node := range c.FleetNodes() {
+        capacity += node.Capacity()
+    }
+    if c.MinTargetCapacity < 0 || c.MinTargetCapacity > capacity {
+        errs = append(errs, &ValidationError{Msg: fmt.Sprintf("minTargetCapacity must be between 0 and the fleet capacity %d.", capacity)})
+    } else if c.MinTargetCapacity > 0 && policy == PartialFulfillmentAccept {
+        errs = append(errs, &ValidationError{Msg: "minTargetCapacity needs partialFulfillment retry or rollback."})
+    }
+    return errs
+}
@@ -0,0 +1,103 @@
+package util
+
+import "github.com/aws/aws-sdk-go/service/ec2"
+import "github.com/aws/aws-sdk-go/aws"
+import "strings"
+import "testing"
+
+
+// partialFleetOutput launched two of its instances in one FleetInstance and
+// failed the rest.
+func partialFleetOutput() *ec2.CreateFleetOutput {
+    return &ec2.CreateFleetOutput{
+        FleetId: aws.String("fleet-1"),
+        Instances: []*ec2.CreateFleetInstance{{
+            InstanceIds:  aws.StringSlice([]string{"i-1", "i-2"}),
+            InstanceType: aws.String("t3.micro"),
+            Lifecycle:    aws.String("spot"),
+            LaunchTemplateAndOverrides: &ec2.LaunchTemplateAndOverridesResponse{
+                Overrides: &ec2.FleetLaunchTemplateOverrides{AvailabilityZone: aws.String("us-east-1a"), SubnetId: aws.String("sub1")},
+            },
+        }},
+        Errors: []*ec2.CreateFleetError{
+            {ErrorCode: aws.String("InsufficientInstanceCapacity"), ErrorMessage: aws.String("No capacity."), Lifecycle: aws.String("on-demand"),
+             LaunchTemplateAndOverrides: &ec2.LaunchTemplateAndOverridesResponse{
+                 Overrides: &ec2.FleetLaunchTemplateOverrides{InstanceType: aws.String("t3.micro"), AvailabilityZone: aws.String("us-east-1b"), SubnetId: aws.String("sub2")},
+             }},
+            {ErrorCode: aws.String("InsufficientInstanceCapacity"), ErrorMessage: aws.String("No capacity."), Lifecycle: aws.String("on-demand"),
+             LaunchTemplateAndOverrides: &ec2.LaunchTemplateAndOverridesResponse{
+                 Overrides: &ec2.FleetLaunchTemplateOverrides{InstanceType: aws.String("t3.micro"), AvailabilityZone: aws.String("us-east-1b"), SubnetId: aws.String("sub2")},
+             }},
+        },
+    }
+}
+
+func fulfillmentRequest() *ec2.CreateFleetInput {
+    configs := Configs{Nodes: 4, OnDemandPercentage: 50,
+                       Subnets: []string{"sub1", "sub2", "sub1", "sub2"},
+                       InstanceTypes: []string{"t3.micro", "t3.micro", "t3.micro", "t3.micro"}}
+    return GetCreateFleetRequestInput(configs.FleetNodes(), LaunchTemplateRef{Id: "lt-1", Version: "1"}, map[string]string{"sub1": "us-east-1a", "sub2": "us-east-1b"}, configs, nil)
+}
+
+func TestFulfillmentParseFleetOutput(t *testing.T) {
+    result := ParseFleetOutput(partialFleetOutput(), "")
+    if len(result.Instances) != 2 || result.Instances[1].InstanceId != "i-2" || result.Instances[1].SubnetId != "sub1" {
+        t.Errorf("TestFulfillmentParseFleetOutput instances %+v", result.Instances)
+    }
+    if result.SpotCapacity != 2 || result.OnDemandCapacity != 0 || len(result.Errors) != 2 {
+        t.Errorf("TestFulfillmentParseFleetOutput got %+v", result)
+    }
+    summary := FormatFleetErrors(result.Errors)
+    if strings.Count(summary, "\n") != 0 || !strings.Contains(summary, "InsufficientInstanceCapacity: on-demand t3.micro in us-east-1b (sub2)") || !strings.Contains(summary, "(x2)") {
+        t.Errorf("TestFulfillmentParseFleetOutput summary %q", summary)
+    }
+}
+
+func TestFulfillmentShortfallRequest(t *testing.T) {
+    input := fulfillmentRequest()
+    results := []FleetResult{ParseFleetOutput(partialFleetOutput(), "")}
+    shortfall := ShortfallRequest(input, results)
+    capacity := shortfall.TargetCapacitySpecification
+    // Only the on-demand half is missing
+    if aws.Int64Value(capacity.TotalTargetCapacity) != 2 || aws.Int64Value(capacity.OnDemandTargetCapacity) != 2 || aws.Int64Value(capacity.SpotTargetCapacity) != 0 {
+        t.Errorf("TestFulfillmentShortfallRequest capacity %v", capacity)
+    }
+    if aws.Int64Value(input.TargetCapacitySpecification.TotalTargetCapacity) != 4 || len(shortfall.LaunchTemplateConfigs[0].Overrides) != 4 {
+        t.Errorf("TestFulfillmentShortfallRequest changed the request %v", input)
+    }
+    results = append(results, FleetResult{OnDemandCapacity: 2})
+    if ShortfallRequest(input, results) != nil {
+        t.Errorf("TestFulfillmentShortfallRequest expected nothing missing")
+    }
+}
+
+func TestFulfillmentCheck(t *testing.T) {
+    input := fulfillmentRequest()
+    results := []FleetResult{ParseFleetOutput(partialFleetOutput(), "")}
+    if err := (Configs{}).CheckFulfillment(input, results); err != nil {
+        t.Errorf("TestFulfillmentCheck accept got %v", err)
+    }
+    if err := (Configs{PartialFulfillment: PartialFulfillmentRollback, MinTargetCapacity: 2}).CheckFulfillment(input, results); err != nil {
+        t.Errorf("TestFulfillmentCheck minimum got %v", err)
+    }
+    err := (Configs{PartialFulfillment: PartialFulfillmentRollback}).CheckFulfillment(input, results)
+    if _, ok := err.(*AWSError); !ok || !strings.Contains(err.Error(), "launched capacity 2 of 4") || !strings.Contains(err.Error(), "InsufficientInstanceCapacity") {
+        t.Errorf("TestFulfillmentCheck rollback got %v", err)
+    }
+}
+
+func TestFulfillmentValidate(t *testing.T) {
+    configs := purchasingConfigs()
+    configs.PartialFulfillment = "ignore"
+    configs.MinTargetCapacity = 5
+    configs.FleetType = ec2.FleetTypeMaintain
+    errs, ok := ValidateConfigs(configs).(ValidationErrors)
+    if !ok || len(errs) != 3 {
+        t.Errorf("TestFulfillmentValidate got %v", errs)
+    }
+    configs = purchasingConfigs()
+    configs.MinTargetCapacity = 2
+    if err := ValidateConfigs(configs); err == nil || !strings.Contains(err.Error(), "minTargetCapacity needs") {
+        t.Errorf("TestFulfillmentValidate accept got %v", err)
+    }
+}
@@ -0,0 +1,190 @@
+/* Copyright (C) Xiang Wang - All Rights Reserved
+ * Unauthorized copying of this file, via any medium is strictly prohibited
+ * Proprietary and confidential
+ * Written by Xiang Wang <xwang1314@gmail.com>, August 2020
+ */
+
+package util
+
+import "github.com/aws/aws-sdk-go/service/ec2"
+import "github.com/aws/aws-sdk-go/aws/awserr"
+import "github.com/aws/aws-sdk-go/aws"
+import "encoding/base64"
+import "encoding/json"
+import "crypto/sha256"
+import "io/ioutil"
+import "strconv"
+import "strings"
+import "regexp"
+import "fmt"
+import "log"
+
+
+// MaxUserDataSize is the largest user data EC2 accepts, before base64 encoding.
+const MaxUserDataSize = 16 * 1024
+
+// LaunchTemplateVersionDefault is the version of an existing launch template
+// used when none is given.
+const LaunchTemplateVersionDefault = "$Default"
+
+// LaunchTemplateRef names the launch template version a fleet launches.
+type LaunchTemplateRef struct {
+    Id      string
+    Name    string
+    Version string
+}
+
+func (r LaunchTemplateRef) specification() *ec2.FleetLaunchTemplateSpecificationRequest {
+    spec := &ec2.FleetLaunchTemplateSpecificationRequest{Version: aws.String(r.Version)}
+    if r.Id != "" {
+        spec.LaunchTemplateId = aws.String(r.Id)
+    } else {
+        spec.LaunchTemplateName = aws.String(r.Name)
+    }
+    return spec
+}
+
+func (r LaunchTemplateRef) String() string {
+    if r.Id != "" {
+        return r.Id + " version " + r.Version
+    }
+    return r.Name + " version " + r.Version
+}
+
+// ExistingLaunchTemplate returns the launch template configs asks to use as
+// is, and false when the run should create its own.
+func (c Configs) ExistingLaunchTemplate() (LaunchTemplateRef, bool) {
+    if c.LaunchTemplateId == "" && c.LaunchTemplateName == "" {
+        return LaunchTemplateRef{}, false
+    }
+    return LaunchTemplateRef{
+        Id:      c.LaunchTemplateId,
+        Name:    c.LaunchTemplateName,
+        Version: orDefault(c.LaunchTemplateVersion, LaunchTemplateVersionDefault),
+    }, true
+}
+
+// LaunchTemplateName is the name of the launch template a run creates, unique
+// to the run so that concurrent runs do not collide.
+func LaunchTemplateName(runId string) string {
+    return "ec2fleet-" + runId
+}
+
+// LaunchTemplateDigest fingerprints launch template data, so a run can tell
+// whether its settings changed since its template was last written.
+func LaunchTemplateDigest(data *ec2.RequestLaunchTemplateData) string {
+    encoded, _ := json.Marshal(data)
+    return fmt.Sprintf("%x", sha256.Sum256(encoded))
+}
+
+// CreateLaunchTemplateVersion adds data as a new version of a launch template
+// and returns its version number.
+func (p *Provisioner) CreateLaunchTemplateVersion(templateId string, data *ec2.RequestLaunchTemplateData) (string, error) {
+    input := &ec2.CreateLaunchTemplateVersionInput{
+        DryRun:             aws.Bool(p.DryRun),
+        LaunchTemplateId:   aws.String(templateId),
+        LaunchTemplateData: data,
+    }
+    responseBody, err := p.client.CreateLaunchTemplateVersion(input)
+    if p.DryRun {
+        p.recordDryRun("Create Launch Template Version", err, templateId)
+        return "2", nil
+    }
+    if err != nil {
+        log.Println("Create Launch Template Version error:")
+        if aerr, ok := err.(awserr.Error); ok {
+            log.Println("Create Launch Template Version status code: ", aerr.Code())
+        }
+        return "", newAWSError("Create Launch Template Version", err)
+    }
+    version := strconv.FormatInt(aws.Int64Value(responseBody.LaunchTemplateVersion.VersionNumber), 10)
+    log.Println("Launch template", templateId, "version", version, "created successfully.")
+    return version, nil
+}
+
+var (
+    instanceProfileArn  = regexp.MustCompile(`^arn:aws[a-z-]*:iam::\d{12}:instance-profile/[\w+=,.@/-]+$`)
+    instanceProfileName = regexp.MustCompile(`^[\w+=,.@-]{1,128}$`)
+)
+
+// readUserData reads the user data file of configs, base64 encoded as EC2
+// expects it, or "" when there is none.
+func (c Configs) readUserData() (string, error) {
+    if c.UserDataFile == "" {
+        return "", nil
+    }
+    data, err := ioutil.ReadFile(c.UserDataFile)
+    if err != nil {
+        return "", &ValidationError{Msg: "Unable to read userDataFile " + c.UserDataFile, Err: err}
+    }
+    if len(data) > MaxUserDataSize {
+        return "", &ValidationError{Msg: fmt.Sprintf("userDataFile %s is %d bytes, more than the %d EC2 accepts.", c.UserDataFile, len(data), MaxUserDataSize)}
+    }
+    return base64.StdEncoding.EncodeToString(data), nil
+}
+
+// SetLaunchTemplateOptions carries the key pair, instance profile, user
+// data, metadata options, monitoring, EBS optimization and block devices of
+// configs into the launch template data.
+func (c Configs) SetLaunchTemplateOptions(data *ec2.RequestLaunchTemplateData) error {
+    if c.KeyName != "" {
+        data.KeyName = aws.String(c.KeyName)
+    }
+    if c.IamInstanceProfile != "" {
+        data.IamInstanceProfile = &ec2.LaunchTemplateIamInstanceProfileSpecificationRequest{}
+        if strings.HasPrefix(c.IamInstanceProfile, "arn:") {
+            data.IamInstanceProfile.Arn = aws.String(c.IamInstanceProfile)
+        } else {
+            data.IamInstanceProfile.Name = aws.String(c.IamInstanceProfile)
+        }
+    }
+    userData, err := c.readUserData()
+    if err != nil {
+        return err
+    }
+    if userData != "" {
+        data.UserData = aws.String(userData)
+    }
+    if c.RequireImdsv2 {
+        data.MetadataOptions = &ec2.LaunchTemplateInstanceMetadataOptionsRequest{
+            HttpEndpoint: aws.String(ec2.LaunchTemplateInstanceMetadataEndpointStateEnabled),
+            HttpTokens:   aws.String(ec2.LaunchTemplateHttpTokensStateRequired),
+        }
+    }
+    if c.DetailedMonitoring {
+        data.Monitoring = &ec2.LaunchTemplatesMonitoringRequest{Enabled: aws.Bool(true)}
+    }
+    if c.EbsOptimized {
+        data.EbsOptimized = aws.Bool(true)
+    }
+    data.BlockDeviceMappings = c.BlockDevices.Mappings()
+    return nil
+}
+
+// validateLaunchTemplate checks the launch template options.
+func validateLaunchTemplate(c Configs) ValidationErrors {
+    errs := ValidationErrors{}
+    if c.KeyName != strings.TrimSpace(c.KeyName) || len(c.KeyName) > 255 {
+        errs = append(errs, &ValidationError{Msg: "keyName must be a key pair name of at most 255 characters, without surrounding spaces."})
+    }
+    profile := c.IamInstanceProfile
+    if profile != "" && !instanceProfileArn.MatchString(profile) && !instanceProfileName.MatchString(profile) {
+        errs = append(errs, &ValidationError{Msg: fmt.Sprintf("Invalid iamInstanceProfile %q, must be an instance profile name or ARN.", profile)})
+    }
+    if _, err := c.readUserData(); err != nil {
+        errs = append(errs, err)
+    }
+    if c.LaunchTemplateId != "" && c.LaunchTemplateName != "" {
+        errs = append(errs, &ValidationError{Msg: "Use either launchTemplateId or launchTemplateName, not both."})
+    }
+    version := c.LaunchTemplateVersion
+    if version != "" && version != "$Latest" && version != "$Default" {
+        if n, err := strconv.Atoi(version); err != nil || n < 1 {
+            errs = append(errs, &ValidationError{Msg: fmt.Sprintf("Invalid launchTemplateVersion %q, must be a version number, $Latest or $Default.", version)})
+        }
+    }
+    if version != "" && c.LaunchTemplateId == "" && c.LaunchTemplateName == "" {
+        errs = append(errs, &ValidationError{Msg: "launchTemplateVersion needs launchTemplateId or launchTemplateName."})
+    }
+    return errs
+}
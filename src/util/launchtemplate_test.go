@@ -0,0 +1,123 @@
+package util
+
+import "github.com/aws/aws-sdk-go/aws"
+import "encoding/base64"
+import "path/filepath"
+import "io/ioutil"
+import "strings"
+import "os"
+import "testing"
+
+
+func TestLaunchTemplateOptions(t *testing.T) {
+    dir, err := ioutil.TempDir("", "ec2fleet")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+    userDataFile := filepath.Join(dir, "cloud-init.yaml")
+    if err := ioutil.WriteFile(userDataFile, []byte("#cloud-config\npackages: [nvme-cli]\n"), 0644); err != nil {
+        t.Fatal(err)
+    }
+
+    configs := purchasingConfigs()
+    configs.KeyName = "storage-team"
+    configs.IamInstanceProfile = "arn:aws:iam::123456789012:instance-profile/ec2fleet-node"
+    configs.UserDataFile = userDataFile
+    configs.RequireImdsv2 = true
+    configs.DetailedMonitoring = true
+    configs.EbsOptimized = true
+    if err := ValidateConfigs(configs); err != nil {
+        t.Fatalf("TestLaunchTemplateOptions failed: %v", err)
+    }
+    template := GetCreateLaunchTemplateInput("name", "ami-1", "t3.micro", []string{"sg1"}, nil)
+    if err := configs.SetLaunchTemplateOptions(template.LaunchTemplateData); err != nil {
+        t.Fatalf("TestLaunchTemplateOptions failed: %v", err)
+    }
+    data := template.LaunchTemplateData
+    userData, _ := base64.StdEncoding.DecodeString(aws.StringValue(data.UserData))
+    if aws.StringValue(data.KeyName) != "storage-team" || aws.StringValue(data.IamInstanceProfile.Arn) != configs.IamInstanceProfile ||
+       data.IamInstanceProfile.Name != nil || !strings.HasPrefix(string(userData), "#cloud-config") {
+        t.Errorf("TestLaunchTemplateOptions got %v", data)
+    }
+    if aws.StringValue(data.MetadataOptions.HttpTokens) != "required" || !aws.BoolValue(data.Monitoring.Enabled) || !aws.BoolValue(data.EbsOptimized) {
+        t.Errorf("TestLaunchTemplateOptions got %v", data)
+    }
+
+    fleet := GetCreateFleetRequestInput(configs.FleetNodes(), LaunchTemplateRef{Id: "lt-1", Version: "1"}, map[string]string{"sub1": "us-east-1a"}, configs, nil)
+    plan := NewPlan(template, fleet, []VolumeSpec{{Size: 4}}, nil)
+    if plan.LaunchTemplate.UserDataSize != len(userData) || plan.LaunchTemplate.HttpTokens != "required" || !strings.Contains(FormatPlan(plan), "storage-team") {
+        t.Errorf("TestLaunchTemplateOptions plan %+v", plan.LaunchTemplate)
+    }
+}
+
+func TestLaunchTemplateOptionsByName(t *testing.T) {
+    configs := Configs{IamInstanceProfile: "ec2fleet-node"}
+    template := GetCreateLaunchTemplateInput("name", "ami-1", "t3.micro", []string{"sg1"}, nil)
+    if err := configs.SetLaunchTemplateOptions(template.LaunchTemplateData); err != nil {
+        t.Fatalf("TestLaunchTemplateOptionsByName failed: %v", err)
+    }
+    data := template.LaunchTemplateData
+    if aws.StringValue(data.IamInstanceProfile.Name) != "ec2fleet-node" || data.UserData != nil || data.MetadataOptions != nil || data.Monitoring != nil {
+        t.Errorf("TestLaunchTemplateOptionsByName got %v", data)
+    }
+}
+
+func TestLaunchTemplateValidate(t *testing.T) {
+    configs := purchasingConfigs()
+    configs.KeyName = " storage-team"
+    configs.IamInstanceProfile = "arn:aws:iam::1234:role/ec2fleet-node"
+    configs.UserDataFile = "does-not-exist.yaml"
+    errs, ok := ValidateConfigs(configs).(ValidationErrors)
+    if !ok || len(errs) != 3 || !strings.Contains(errs.Error(), "Unable to read userDataFile does-not-exist.yaml") {
+        t.Errorf("TestLaunchTemplateValidate got %v", errs)
+    }
+}
+
+func TestLaunchTemplateExisting(t *testing.T) {
+    configs := purchasingConfigs()
+    if _, ok := configs.ExistingLaunchTemplate(); ok {
+        t.Errorf("TestLaunchTemplateExisting found a template without one configured")
+    }
+    configs.LaunchTemplateName = "storage-nodes"
+    configs.SecurityGroups = nil
+    if err := ValidateConfigs(configs); err != nil {
+        t.Errorf("TestLaunchTemplateExisting failed: %v", err)
+    }
+    template, ok := configs.ExistingLaunchTemplate()
+    fleet := GetCreateFleetRequestInput(configs.FleetNodes(), template, map[string]string{"sub1": "us-east-1a"}, configs, nil)
+    spec := fleet.LaunchTemplateConfigs[0].LaunchTemplateSpecification
+    if !ok || aws.StringValue(spec.LaunchTemplateName) != "storage-nodes" || spec.LaunchTemplateId != nil || aws.StringValue(spec.Version) != "$Default" {
+        t.Errorf("TestLaunchTemplateExisting got %v", spec)
+    }
+
+    configs.LaunchTemplateId = "lt-1"
+    configs.LaunchTemplateVersion = "latest"
+    errs, ok := ValidateConfigs(configs).(ValidationErrors)
+    if !ok || len(errs) != 2 {
+        t.Errorf("TestLaunchTemplateExisting validate got %v", errs)
+    }
+    configs = purchasingConfigs()
+    configs.LaunchTemplateVersion = "2"
+    if err := ValidateConfigs(configs); err == nil || !strings.Contains(err.Error(), "launchTemplateVersion needs") {
+        t.Errorf("TestLaunchTemplateExisting version alone got %v", err)
+    }
+}
+
+func TestLaunchTemplateNewVersion(t *testing.T) {
+    fake := &fakeEC2{}
+    p := NewProvisioner(fake)
+    template := GetCreateLaunchTemplateInput(LaunchTemplateName("run-1"), "ami-1", "t3.micro", []string{"sg1"}, nil)
+    digest := LaunchTemplateDigest(template.LaunchTemplateData)
+    if aws.StringValue(template.LaunchTemplateName) != "ec2fleet-run-1" || digest != LaunchTemplateDigest(template.LaunchTemplateData) {
+        t.Errorf("TestLaunchTemplateNewVersion template %v", template)
+    }
+    Configs{KeyName: "storage-team"}.SetLaunchTemplateOptions(template.LaunchTemplateData)
+    if LaunchTemplateDigest(template.LaunchTemplateData) == digest {
+        t.Errorf("TestLaunchTemplateNewVersion digest did not change")
+    }
+    version, err := p.CreateLaunchTemplateVersion("lt-1", template.LaunchTemplateData)
+    if err != nil || version != "2" || aws.StringValue(fake.versions[0].LaunchTemplateId) != "lt-1" {
+        t.Errorf("TestLaunchTemplateNewVersion got %q, %v", version, err)
+    }
+}
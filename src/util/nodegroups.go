@@ -0,0 +1,207 @@
+/* Copyright (C) Xiang Wang - All Rights Reserved
+ * Unauthorized copying of this file, via any medium is strictly prohibited
+ * Proprietary and confidential
+ * Written by Xiang Wang <xwang1314@gmail.com>, August 2020
+ */
+
+package util
+
+import "fmt"
+
+
+// NodeGroup describes count nodes at once, as an alternative to the parallel
+// subnets and instanceTypes lists. The nodes of a group take its subnets and
+// instance types in turn, so neither list has to match count.
+type NodeGroup struct {
+    Count         int      `json:"count" yaml:"count" toml:"count"`
+    InstanceTypes []string `json:"instanceTypes" yaml:"instanceTypes" toml:"instanceTypes"`
+    Subnets       []string `json:"subnets" yaml:"subnets" toml:"subnets"`
+    // Capacity units each node counts for in the fleet, 1 when unset
+    Weight        int      `json:"weight,omitempty" yaml:"weight" toml:"weight"`
+}
+
+// FleetNode is where one node of the fleet is launched.
+type FleetNode struct {
+    SubnetId     string
+    InstanceType string
+    // 0 when the node has no weight of its own
+    Weight       int
+}
+
+// Capacity is the number of capacity units the node counts for.
+func (n FleetNode) Capacity() int {
+    if n.Weight > 0 {
+        return n.Weight
+    }
+    return 1
+}
+
+// FleetNodes expands the node groups, or zips the subnets and instanceTypes
+// lists when there are none, into one FleetNode per node.
+func (c Configs) FleetNodes() []FleetNode {
+    nodes := []FleetNode{}
+    if len(c.NodeGroups) == 0 {
+        // Lists shorter than the nodes are taken in turn, eg. the candidate
+        // subnets of a distribution strategy
+        for i := 0; i < c.Nodes && len(c.Subnets) > 0 && len(c.InstanceTypes) > 0; i++ {
+            nodes = append(nodes, FleetNode{SubnetId: c.Subnets[i % len(c.Subnets)], InstanceType: c.InstanceTypes[i % len(c.InstanceTypes)]})
+        }
+        return nodes
+    }
+    for _, group := range c.NodeGroups {
+        for i := 0; i < group.Count; i++ {
+            nodes = append(nodes, FleetNode{
+                SubnetId:     group.Subnets[i % len(group.Subnets)],
+                InstanceType: group.InstanceTypes[i % len(group.InstanceTypes)],
+                Weight:       group.Weight,
+            })
+        }
+    }
+    return nodes
+}
+
+// SubnetIds returns every subnet the nodes may be launched in, including
+// the fallback subnets, once each.
+func (c Configs) SubnetIds() []string {
+    subnets := []string{}
+    for _, node := range c.FleetNodes() {
+        subnets = append(subnets, node.SubnetId)
+    }
+    return uniqueStrings(append(subnets, c.FallbackSubnets...))
+}
+
+// NodeGroupsCount is the number of nodes in every node group.
+func (c Configs) NodeGroupsCount() int {
+    count := 0
+    for _, group := range c.NodeGroups {
+        count += group.Count
+    }
+    return count
+}
+
+// AddNodes records nodes added to the fleet, in whichever form configs uses.
+func (c *Configs) AddNodes(nodes []FleetNode) {
+    c.addNodes(nodes, len(c.NodeGroups) > 0)
+}
+
+// WithNodes returns a copy of configs describing just nodes, in the same
+// form as configs. The nodes are taken as placed already. The on-demand
+// count and minimum target capacity are for the whole run, so the copy gets
+// the part of them the nodes add to its current capacity.
+func (c Configs) WithNodes(nodes []FleetNode) Configs {
+    groups := len(c.NodeGroups) > 0
+    current := int64(fleetCapacity(c.FleetNodes()))
+    added := int64(fleetCapacity(nodes))
+    if c.OnDemandCount != nil {
+        count := int(c.onDemandCapacity(current + added) - c.onDemandCapacity(current))
+        c.OnDemandCount = &count
+    }
+    if c.MinTargetCapacity > 0 {
+        c.MinTargetCapacity -= int(current)
+        if c.MinTargetCapacity <= 0 {
+            // The run has its minimum already, whatever the nodes get will do
+            c.MinTargetCapacity = 0
+            c.PartialFulfillment = PartialFulfillmentAccept
+        }
+    }
+    c.Distribution = DistributionListed
+    c.SubnetWeights = nil
+    c.Nodes = 0
+    c.Subnets = nil
+    c.InstanceTypes = nil
+    c.NodeGroups = nil
+    c.addNodes(nodes, groups)
+    return c
+}
+
+// fleetCapacity is the capacity of nodes, counting their weights.
+func fleetCapacity(nodes []FleetNode) int {
+    capacity := 0
+    for _, node := range nodes {
+        capacity += node.Capacity()
+    }
+    return capacity
+}
+
+func (c *Configs) addNodes(nodes []FleetNode, groups bool) {
+    for _, node := range nodes {
+        if groups {
+            c.NodeGroups = append(c.NodeGroups, NodeGroup{
+                Count:         1,
+                InstanceTypes: []string{node.InstanceType},
+                Subnets:       []string{node.SubnetId},
+                Weight:        node.Weight,
+            })
+        } else if c.Distribution == DistributionListed {
+            c.Subnets = append(c.Subnets, node.SubnetId)
+            c.InstanceTypes = append(c.InstanceTypes, node.InstanceType)
+        }
+    }
+    c.Nodes += len(nodes)
+}
+
+// RemoveNodes records the last count nodes removed from the fleet.
+func (c *Configs) RemoveNodes(count int) {
+    c.Nodes -= count
+    if len(c.NodeGroups) == 0 && c.Distribution != DistributionListed {
+        // The subnets are candidates, not one per node
+        return
+    }
+    if len(c.NodeGroups) == 0 {
+        c.Subnets = c.Subnets[:c.Nodes]
+        c.InstanceTypes = c.InstanceTypes[:c.Nodes]
+        return
+    }
+    for count > 0 && len(c.NodeGroups) > 0 {
+        last := &c.NodeGroups[len(c.NodeGroups) - 1]
+        removed := count
+        if removed > last.Count {
+            removed = last.Count
+        }
+        last.Count -= removed
+        count -= removed
+        if last.Count == 0 {
+            c.NodeGroups = c.NodeGroups[:len(c.NodeGroups) - 1]
+        }
+    }
+}
+
+// ValidateConfigs checks the fleet inputs in either form and reports every
+// problem found.
+func ValidateConfigs(c Configs) error {
+    errs := validateDistribution(c)
+    errs = append(errs, validatePurchasing(c)...)
+    errs = append(errs, validateFulfillment(c)...)
+    errs = append(errs, validateFallbacks(c)...)
+    errs = append(errs, validateLaunchTemplate(c)...)
+    errs = append(errs, validateBlockDevices(c)...)
+    errs = append(errs, validateSharedVolumes(c)...)
+    _, existingTemplate := c.ExistingLaunchTemplate()
+    if len(c.NodeGroups) == 0 {
+        errs = append(errs, validateInputs(c.Nodes, c.VolumeSpecs(), c.Subnets, c.SecurityGroups, c.InstanceTypes, existingTemplate, c.Distribution == DistributionListed)...)
+        return errs.errOrNil()
+    }
+    errs = append(errs, validateShared(c.VolumeSpecs(), c.SecurityGroups, existingTemplate)...)
+    if len(c.Subnets) > 0 || len(c.InstanceTypes) > 0 {
+        errs = append(errs, &ValidationError{Msg: "Use either nodeGroups or subnets and instanceTypes, not both."})
+    }
+    if c.Nodes != c.NodeGroupsCount() {
+        errs = append(errs, &ValidationError{Msg: fmt.Sprintf("Number of nodes %d does not match the %d nodes of the node groups, leave it out.", c.Nodes, c.NodeGroupsCount())})
+    }
+    for i, group := range c.NodeGroups {
+        name := fmt.Sprintf("Node group %d", i + 1)
+        if group.Count <= 0 {
+            errs = append(errs, &ValidationError{Msg: name + ": count must be at least 1."})
+        }
+        if len(group.Subnets) == 0 || containsEmpty(group.Subnets) {
+            errs = append(errs, &ValidationError{Msg: name + ": needs at least one subnet and no empty ones."})
+        }
+        if len(group.InstanceTypes) == 0 || containsEmpty(group.InstanceTypes) {
+            errs = append(errs, &ValidationError{Msg: name + ": needs at least one instance type and no empty ones."})
+        }
+        if group.Weight < 0 {
+            errs = append(errs, &ValidationError{Msg: name + ": weight can not be negative."})
+        }
+    }
+    return errs.errOrNil()
+}
@@ -0,0 +1,131 @@
+package util
+
+import "github.com/aws/aws-sdk-go/aws"
+import "reflect"
+import "testing"
+
+
+func TestNodeGroupsExpand(t *testing.T) {
+    configs := Configs{
+        Nodes: 5,
+        NodeGroups: []NodeGroup{
+            {Count: 3, Subnets: []string{"sub1", "sub2"}, InstanceTypes: []string{"m5.large"}, Weight: 2},
+            {Count: 2, Subnets: []string{"sub3"}, InstanceTypes: []string{"t3.micro", "t3.small"}},
+        },
+    }
+    expected := []FleetNode{
+        {"sub1", "m5.large", 2}, {"sub2", "m5.large", 2}, {"sub1", "m5.large", 2},
+        {"sub3", "t3.micro", 0}, {"sub3", "t3.small", 0},
+    }
+    if nodes := configs.FleetNodes(); !reflect.DeepEqual(nodes, expected) {
+        t.Errorf("TestNodeGroupsExpand got %v", nodes)
+    }
+    if subnets := configs.SubnetIds(); !reflect.DeepEqual(subnets, []string{"sub1", "sub2", "sub3"}) {
+        t.Errorf("TestNodeGroupsExpand subnets %v", subnets)
+    }
+
+    zones := map[string]string{"sub1": "us-east-1a", "sub2": "us-east-1b", "sub3": "us-east-1c"}
+    fleet := GetCreateFleetRequestInput(configs.FleetNodes(), LaunchTemplateRef{Id: "lt-1", Version: "1"}, zones, configs, nil)
+    overrides := fleet.LaunchTemplateConfigs[0].Overrides
+    if len(overrides) != 5 || aws.Float64Value(overrides[0].WeightedCapacity) != 2 || overrides[3].WeightedCapacity != nil {
+        t.Errorf("TestNodeGroupsExpand overrides %v", overrides)
+    }
+    if capacity := aws.Int64Value(fleet.TargetCapacitySpecification.TotalTargetCapacity); capacity != 8 {
+        t.Errorf("TestNodeGroupsExpand capacity %d", capacity)
+    }
+}
+
+func TestNodeGroupsSameOverridesAsLists(t *testing.T) {
+    lists := Configs{Nodes: 2, Subnets: []string{"sub1", "sub2"}, InstanceTypes: []string{"t3.micro", "t3.micro"}}
+    groups := Configs{Nodes: 2, NodeGroups: []NodeGroup{{Count: 2, Subnets: []string{"sub1", "sub2"}, InstanceTypes: []string{"t3.micro"}}}}
+    zones := map[string]string{"sub1": "us-east-1a", "sub2": "us-east-1b"}
+    if !reflect.DeepEqual(GetCreateFleetRequestInput(lists.FleetNodes(), LaunchTemplateRef{Id: "lt-1", Version: "1"}, zones, lists, nil),
+                          GetCreateFleetRequestInput(groups.FleetNodes(), LaunchTemplateRef{Id: "lt-1", Version: "1"}, zones, groups, nil)) {
+        t.Errorf("TestNodeGroupsSameOverridesAsLists requests differ")
+    }
+}
+
+func TestNodeGroupsValidate(t *testing.T) {
+    configs := Configs{
+        Nodes:          3,
+        VolumeSize:     4,
+        SecurityGroups: []string{"sg1"},
+        NodeGroups:     []NodeGroup{{Count: 3, Subnets: []string{"sub1"}, InstanceTypes: []string{"t3.micro"}}},
+    }
+    if err := ValidateConfigs(configs); err != nil {
+        t.Errorf("TestNodeGroupsValidate failed: %v", err)
+    }
+    configs.Nodes = 4
+    configs.Subnets = []string{"sub1"}
+    configs.NodeGroups = append(configs.NodeGroups, NodeGroup{Count: 0, Weight: -1})
+    errs, ok := ValidateConfigs(configs).(ValidationErrors)
+    // both forms, node count, and the second group's count, subnets, types and weight
+    if !ok || len(errs) != 6 {
+        t.Errorf("TestNodeGroupsValidate got %v", errs)
+    }
+}
+
+func TestNodeGroupsResize(t *testing.T) {
+    configs := Configs{
+        Nodes: 4,
+        NodeGroups: []NodeGroup{
+            {Count: 3, Subnets: []string{"sub1"}, InstanceTypes: []string{"t3.micro"}},
+            {Count: 1, Subnets: []string{"sub2"}, InstanceTypes: []string{"t3.micro"}},
+        },
+    }
+    configs.RemoveNodes(2)
+    if configs.Nodes != 2 || len(configs.NodeGroups) != 1 || configs.NodeGroups[0].Count != 2 {
+        t.Errorf("TestNodeGroupsResize shrink got %+v", configs)
+    }
+    added := []FleetNode{{"sub3", "m5.large", 2}}
+    delta := configs.WithNodes(added)
+    if delta.Nodes != 1 || len(delta.NodeGroups) != 1 || delta.NodeGroups[0].Weight != 2 {
+        t.Errorf("TestNodeGroupsResize delta got %+v", delta)
+    }
+    configs.AddNodes(added)
+    if configs.Nodes != 3 || len(configs.FleetNodes()) != 3 {
+        t.Errorf("TestNodeGroupsResize grow got %+v", configs)
+    }
+
+    lists := Configs{Nodes: 2, Subnets: []string{"sub1", "sub2"}, InstanceTypes: []string{"t3.micro", "t3.micro"}}
+    lists.RemoveNodes(1)
+    lists.AddNodes(added)
+    if lists.Nodes != 2 || !reflect.DeepEqual(lists.Subnets, []string{"sub1", "sub3"}) {
+        t.Errorf("TestNodeGroupsResize lists got %+v", lists)
+    }
+}
+
+func TestNodeGroupsWithNodesPurchasing(t *testing.T) {
+    count := 2
+    configs := Configs{
+        Nodes:              4,
+        Subnets:            []string{"sub1", "sub1", "sub1", "sub1"},
+        InstanceTypes:      []string{"t3.micro", "t3.micro", "t3.micro", "t3.micro"},
+        OnDemandCount:      &count,
+        MinTargetCapacity:  3,
+        PartialFulfillment: PartialFulfillmentRollback,
+    }
+    // The run has its 2 on-demand nodes and its minimum already
+    delta := configs.WithNodes([]FleetNode{{"sub1", "t3.micro", 0}})
+    input := GetCreateFleetRequestInput(delta.FleetNodes(), LaunchTemplateRef{Id: "lt-1", Version: "1"}, map[string]string{"sub1": "us-east-1a"}, delta, nil)
+    target := input.TargetCapacitySpecification
+    if *target.OnDemandTargetCapacity != 0 || *target.SpotTargetCapacity != 1 || *target.TotalTargetCapacity != 1 {
+        t.Errorf("TestNodeGroupsWithNodesPurchasing sent %v", target)
+    }
+    if delta.MinTargetCapacity != 0 || delta.PartialFulfillment != PartialFulfillmentAccept {
+        t.Errorf("TestNodeGroupsWithNodesPurchasing minimum %d, %s", delta.MinTargetCapacity, delta.PartialFulfillment)
+    }
+
+    // A run short of its on-demand count and minimum gets the rest
+    count = 6
+    configs.MinTargetCapacity = 6
+    delta = configs.WithNodes([]FleetNode{{"sub1", "t3.micro", 0}, {"sub1", "t3.micro", 0}, {"sub1", "t3.micro", 0}})
+    if *delta.OnDemandCount != 2 || delta.MinTargetCapacity != 2 || delta.PartialFulfillment != PartialFulfillmentRollback {
+        t.Errorf("TestNodeGroupsWithNodesPurchasing short run got %d, %d, %s", *delta.OnDemandCount, delta.MinTargetCapacity, delta.PartialFulfillment)
+    }
+
+    // The on-demand count never exceeds the capacity asked for
+    if onDemand := configs.onDemandCapacity(3); onDemand != 3 {
+        t.Errorf("TestNodeGroupsWithNodesPurchasing on-demand %d of 3", onDemand)
+    }
+}
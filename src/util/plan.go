@@ -0,0 +1,371 @@
+/* Copyright (C) Xiang Wang - All Rights Reserved
+ * Unauthorized copying of this file, via any medium is strictly prohibited
+ * Proprietary and confidential
+ * Written by Xiang Wang <xwang1314@gmail.com>, August 2020
+ */
+
+package util
+
+import "github.com/aws/aws-sdk-go/service/ec2"
+import "github.com/aws/aws-sdk-go/aws"
+import "encoding/base64"
+import "text/tabwriter"
+import "strings"
+import "bytes"
+import "fmt"
+
+
+// A multi-attach volume can be attached to at most 16 Nitro instances
+// https://docs.aws.amazon.com/AWSEC2/latest/UserGuide/ebs-volumes-multi.html
+const MaxAttachmentsPerVolume = 16
+
+// OfflineSubnetZones returns the AZ of every subnet of configs as given in
+// its subnetZones, instead of looking them up.
+func (c Configs) OfflineSubnetZones() (map[string]string, error) {
+    errs := ValidationErrors{}
+    for _, subnet := range c.SubnetIds() {
+        if c.SubnetZones[subnet] == "" {
+            errs = append(errs, &ValidationError{Msg: "subnetZones has no AZ for subnet " + subnet + ", eg. -subnetZones=" + subnet + "=us-east-1a"})
+        }
+    }
+    return c.SubnetZones, errs.errOrNil()
+}
+
+// ResolveSubnetZones returns the AZ of every subnet of configs: the ones in
+// its subnetZones as given, the others from lookup, which is not called at
+// all when subnetZones covers every subnet.
+func (c Configs) ResolveSubnetZones(lookup func([]string) (map[string]string, error)) (map[string]string, error) {
+    zones := map[string]string{}
+    uncovered := []string{}
+    for _, subnet := range c.SubnetIds() {
+        if zone := c.SubnetZones[subnet]; zone != "" {
+            zones[subnet] = zone
+        } else {
+            uncovered = append(uncovered, subnet)
+        }
+    }
+    if len(uncovered) == 0 {
+        return zones, nil
+    }
+    looked, err := lookup(uncovered)
+    if err != nil {
+        return nil, err
+    }
+    for subnet, zone := range looked {
+        zones[subnet] = zone
+    }
+    return zones, nil
+}
+
+// VolumeGroup is one multi-attach volume and the nodes that share it.
+type VolumeGroup struct {
+    AvailabilityZone string
+    // Existing volume with free attachment slots, or "" for a new volume
+    VolumeId string
+    // Indexes of the nodes attached to the volume
+    Members []int
+}
+
+// GroupByVolume assigns every node to a new multi-attach volume in its AZ,
+// given the AZ of each node.
+func GroupByVolume(availabilityZones []string) []VolumeGroup {
+    return AssignVolumes(nil, nil, availabilityZones)
+}
+
+// AssignVolumes assigns every node to a multi-attach volume in its AZ, given
+// the AZ of each node. Existing volumes are filled up first, counting the
+// attachments they already have; the remaining nodes get new volumes. A
+// volume is shared by up to MaxAttachmentsPerVolume nodes; AZs are kept in
+// the order first seen.
+func AssignVolumes(existing []Volume, attachmentCounts map[string]int, availabilityZones []string) []VolumeGroup {
+    zones := []string{}
+    members := map[string][]int{}
+    for i, az := range availabilityZones {
+        if _, ok := members[az]; !ok {
+            zones = append(zones, az)
+        }
+        members[az] = append(members[az], i)
+    }
+    groups := []VolumeGroup{}
+    for _, az := range zones {
+        nodes := members[az]
+        for _, volume := range existing {
+            free := MaxAttachmentsPerVolume - attachmentCounts[volume.VolumeId]
+            if volume.AvailabilityZone != az || free <= 0 || len(nodes) == 0 {
+                continue
+            }
+            if free > len(nodes) {
+                free = len(nodes)
+            }
+            groups = append(groups, VolumeGroup{AvailabilityZone: az, VolumeId: volume.VolumeId, Members: nodes[:free]})
+            nodes = nodes[free:]
+        }
+        for start := 0; start < len(nodes); start += MaxAttachmentsPerVolume {
+            end := start + MaxAttachmentsPerVolume
+            if end > len(nodes) {
+                end = len(nodes)
+            }
+            groups = append(groups, VolumeGroup{AvailabilityZone: az, Members: nodes[start:end]})
+        }
+    }
+    return groups
+}
+
+// Plan describes every resource a run would create.
+type Plan struct {
+    LaunchTemplate     PlanLaunchTemplate `json:"launchTemplate"`
+    FleetType          string             `json:"fleetType"`
+    AllocationStrategy string             `json:"allocationStrategy"`
+    OnDemandStrategy   string             `json:"onDemandAllocationStrategy,omitempty"`
+    MaxSpotPrice       string             `json:"maxSpotPrice,omitempty"`
+    TotalCapacity      int64              `json:"totalCapacity"`
+    OnDemandCapacity   int64              `json:"onDemandCapacity"`
+    SpotCapacity       int64              `json:"spotCapacity"`
+    Overrides          []PlanOverride     `json:"overrides"`
+    Volumes            []PlanVolume       `json:"volumes"`
+    Zones              []PlanZone         `json:"zones"`
+    Tags               map[string]string  `json:"tags,omitempty"`
+}
+
+type PlanLaunchTemplate struct {
+    Name               string        `json:"name"`
+    ImageId            string        `json:"imageId"`
+    InstanceType       string        `json:"instanceType"`
+    SecurityGroupIds   []string      `json:"securityGroupIds"`
+    KeyName            string        `json:"keyName,omitempty"`
+    IamInstanceProfile string        `json:"iamInstanceProfile,omitempty"`
+    // Size of the user data before base64 encoding, in bytes
+    UserDataSize       int           `json:"userDataSize,omitempty"`
+    HttpTokens         string        `json:"httpTokens,omitempty"`
+    DetailedMonitoring bool          `json:"detailedMonitoring,omitempty"`
+    EbsOptimized       bool          `json:"ebsOptimized,omitempty"`
+    BlockDevices       []BlockDevice `json:"blockDevices,omitempty"`
+    // An existing template, used as is
+    Existing           bool          `json:"existing,omitempty"`
+}
+
+// PlanOverride is one fleet override, ie. one node of the fleet.
+type PlanOverride struct {
+    Node             int    `json:"node"`
+    AvailabilityZone string `json:"availabilityZone"`
+    SubnetId         string `json:"subnetId"`
+    InstanceType     string `json:"instanceType"`
+    // Capacity units the node counts for
+    Weight           int    `json:"weight"`
+    Volume           string `json:"volume"`
+}
+
+// PlanZone counts the nodes and multi-attach volumes planned in one AZ, and
+// the capacity of its fleet.
+type PlanZone struct {
+    AvailabilityZone string `json:"availabilityZone"`
+    Nodes            int    `json:"nodes"`
+    Volumes          int    `json:"volumes"`
+    OnDemandCapacity int64  `json:"onDemandCapacity"`
+    SpotCapacity     int64  `json:"spotCapacity"`
+}
+
+type PlanVolume struct {
+    Name             string `json:"name"`
+    AvailabilityZone string `json:"availabilityZone"`
+    Size             int    `json:"size"`
+    VolumeType       string `json:"volumeType"`
+    Iops             int    `json:"iops"`
+    Encrypted        bool   `json:"encrypted"`
+    KmsKeyId         string `json:"kmsKeyId,omitempty"`
+    Device           string `json:"device"`
+    Nodes            []int  `json:"nodes"`
+}
+
+// NewPlan computes the plan from the exact requests a run would send.
+func NewPlan(template *ec2.CreateLaunchTemplateInput,
+             fleet *ec2.CreateFleetInput,
+             volumes []VolumeSpec,
+             tags map[string]string) *Plan {
+    data := template.LaunchTemplateData
+    capacity := fleet.TargetCapacitySpecification
+    plan := &Plan{
+        LaunchTemplate: PlanLaunchTemplate{
+            Name:             aws.StringValue(template.LaunchTemplateName),
+            ImageId:          aws.StringValue(data.ImageId),
+            InstanceType:     aws.StringValue(data.InstanceType),
+            SecurityGroupIds: aws.StringValueSlice(data.SecurityGroupIds),
+            KeyName:          aws.StringValue(data.KeyName),
+            EbsOptimized:     aws.BoolValue(data.EbsOptimized),
+        },
+        FleetType:          aws.StringValue(fleet.Type),
+        AllocationStrategy: aws.StringValue(fleet.SpotOptions.AllocationStrategy),
+        TotalCapacity:      aws.Int64Value(capacity.TotalTargetCapacity),
+        OnDemandCapacity:   aws.Int64Value(capacity.OnDemandTargetCapacity),
+        SpotCapacity:       aws.Int64Value(capacity.SpotTargetCapacity),
+        Tags:               tags,
+    }
+    if profile := data.IamInstanceProfile; profile != nil {
+        plan.LaunchTemplate.IamInstanceProfile = aws.StringValue(profile.Arn) + aws.StringValue(profile.Name)
+    }
+    if userData, err := base64.StdEncoding.DecodeString(aws.StringValue(data.UserData)); err == nil {
+        plan.LaunchTemplate.UserDataSize = len(userData)
+    }
+    if data.MetadataOptions != nil {
+        plan.LaunchTemplate.HttpTokens = aws.StringValue(data.MetadataOptions.HttpTokens)
+    }
+    for _, mapping := range data.BlockDeviceMappings {
+        plan.LaunchTemplate.BlockDevices = append(plan.LaunchTemplate.BlockDevices, blockDevice(mapping))
+    }
+    if data.Monitoring != nil {
+        plan.LaunchTemplate.DetailedMonitoring = aws.BoolValue(data.Monitoring.Enabled)
+    }
+    if fleet.OnDemandOptions != nil {
+        plan.OnDemandStrategy = aws.StringValue(fleet.OnDemandOptions.AllocationStrategy)
+    }
+    if overrides := fleet.LaunchTemplateConfigs[0].Overrides; len(overrides) > 0 {
+        plan.MaxSpotPrice = aws.StringValue(overrides[0].MaxPrice)
+    }
+    azs := []string{}
+    for i, override := range fleet.LaunchTemplateConfigs[0].Overrides {
+        plan.Overrides = append(plan.Overrides, PlanOverride{
+            Node:             i,
+            AvailabilityZone: aws.StringValue(override.AvailabilityZone),
+            SubnetId:         aws.StringValue(override.SubnetId),
+            InstanceType:     aws.StringValue(override.InstanceType),
+            Weight:           FleetNode{Weight: int(aws.Float64Value(override.WeightedCapacity))}.Capacity(),
+        })
+        azs = append(azs, aws.StringValue(override.AvailabilityZone))
+    }
+    for _, volume := range volumes {
+        volume = volume.withDefaults()
+        for i, group := range GroupByVolume(azs) {
+            name := fmt.Sprintf("%s-%d", orDefault(volume.Name, "volume"), i + 1)
+            plan.Volumes = append(plan.Volumes, PlanVolume{
+                Name:             name,
+                AvailabilityZone: group.AvailabilityZone,
+                Size:             volume.Size,
+                VolumeType:       volume.Type,
+                Iops:             volume.Iops,
+                Encrypted:        volume.Encrypted,
+                KmsKeyId:         volume.KmsKeyId,
+                Device:           volume.Device,
+                Nodes:            group.Members,
+            })
+            for _, node := range group.Members {
+                override := &plan.Overrides[node]
+                if override.Volume != "" {
+                    override.Volume += ","
+                }
+                override.Volume += name
+            }
+        }
+    }
+    perAz := plan.VolumesPerAz()
+    for _, group := range GroupByVolume(azs) {
+        if len(plan.Zones) > 0 && plan.Zones[len(plan.Zones) - 1].AvailabilityZone == group.AvailabilityZone {
+            plan.Zones[len(plan.Zones) - 1].Nodes += len(group.Members)
+            continue
+        }
+        plan.Zones = append(plan.Zones, PlanZone{
+            AvailabilityZone: group.AvailabilityZone,
+            Nodes:            len(group.Members),
+            Volumes:          perAz[group.AvailabilityZone],
+        })
+    }
+    for i, request := range FleetRequestsByZone(fleet) {
+        capacity := request.TargetCapacitySpecification
+        plan.Zones[i].OnDemandCapacity = aws.Int64Value(capacity.OnDemandTargetCapacity)
+        plan.Zones[i].SpotCapacity = aws.Int64Value(capacity.SpotTargetCapacity)
+    }
+    return plan
+}
+
+// VolumesPerAz counts the multi-attach volumes planned in each AZ.
+func (plan *Plan) VolumesPerAz() map[string]int {
+    counts := map[string]int{}
+    for _, volume := range plan.Volumes {
+        counts[volume.AvailabilityZone]++
+    }
+    return counts
+}
+
+// FormatPlan renders the plan as human-readable tables.
+func FormatPlan(plan *Plan) string {
+    var buf bytes.Buffer
+    w := tabwriter.NewWriter(&buf, 0, 4, 2, ' ', 0)
+    if plan.LaunchTemplate.Existing {
+        fmt.Fprintf(w, "Launch template:\t%s (existing)\n", plan.LaunchTemplate.Name)
+    } else {
+        fmt.Fprintf(w, "Launch template:\t%s\n", plan.LaunchTemplate.Name)
+        fmt.Fprintf(w, "  Image:\t%s\n", plan.LaunchTemplate.ImageId)
+        fmt.Fprintf(w, "  Instance type:\t%s\n", plan.LaunchTemplate.InstanceType)
+        fmt.Fprintf(w, "  Security groups:\t%s\n", strings.Join(plan.LaunchTemplate.SecurityGroupIds, ", "))
+        if plan.LaunchTemplate.KeyName != "" {
+            fmt.Fprintf(w, "  Key pair:\t%s\n", plan.LaunchTemplate.KeyName)
+        }
+        if plan.LaunchTemplate.IamInstanceProfile != "" {
+            fmt.Fprintf(w, "  IAM instance profile:\t%s\n", plan.LaunchTemplate.IamInstanceProfile)
+        }
+        if plan.LaunchTemplate.UserDataSize > 0 {
+            fmt.Fprintf(w, "  User data:\t%d bytes\n", plan.LaunchTemplate.UserDataSize)
+        }
+        if plan.LaunchTemplate.HttpTokens != "" {
+            fmt.Fprintf(w, "  Metadata tokens:\t%s\n", plan.LaunchTemplate.HttpTokens)
+        }
+        fmt.Fprintf(w, "  Detailed monitoring:\t%t\n", plan.LaunchTemplate.DetailedMonitoring)
+        fmt.Fprintf(w, "  EBS-optimized:\t%t\n", plan.LaunchTemplate.EbsOptimized)
+        for _, device := range plan.LaunchTemplate.BlockDevices {
+            fmt.Fprintf(w, "  Block device:\t%s\n", device)
+        }
+    }
+    fmt.Fprintf(w, "Fleet:\t%s, %s\n", plan.FleetType, plan.AllocationStrategy)
+    fmt.Fprintf(w, "  Capacity:\t%d total, %d on-demand, %d spot\n", plan.TotalCapacity, plan.OnDemandCapacity, plan.SpotCapacity)
+    if plan.OnDemandStrategy != "" {
+        fmt.Fprintf(w, "  On-demand strategy:\t%s\n", plan.OnDemandStrategy)
+    }
+    if plan.MaxSpotPrice != "" {
+        fmt.Fprintf(w, "  Max spot price:\t%s USD/hour\n", plan.MaxSpotPrice)
+    }
+    if len(plan.Tags) > 0 {
+        fmt.Fprintf(w, "  Tags:\t")
+        for i, tag := range getTags(plan.Tags) {
+            if i > 0 {
+                fmt.Fprintf(w, ", ")
+            }
+            fmt.Fprintf(w, "%s=%s", *tag.Key, *tag.Value)
+        }
+        fmt.Fprintf(w, "\n")
+    }
+    w.Flush()
+
+    fmt.Fprintf(&buf, "\nOverrides:\n")
+    w = tabwriter.NewWriter(&buf, 0, 4, 2, ' ', 0)
+    fmt.Fprintf(w, "  NODE\tAZ\tSUBNET\tTYPE\tWEIGHT\tVOLUME\n")
+    for _, o := range plan.Overrides {
+        fmt.Fprintf(w, "  %d\t%s\t%s\t%s\t%d\t%s\n", o.Node, o.AvailabilityZone, o.SubnetId, o.InstanceType, o.Weight, o.Volume)
+    }
+    w.Flush()
+
+    fmt.Fprintf(&buf, "\nAvailability zones, one fleet each:\n")
+    w = tabwriter.NewWriter(&buf, 0, 4, 2, ' ', 0)
+    fmt.Fprintf(w, "  AZ\tNODES\tVOLUMES\tON-DEMAND\tSPOT\n")
+    for _, z := range plan.Zones {
+        fmt.Fprintf(w, "  %s\t%d\t%d\t%d\t%d\n", z.AvailabilityZone, z.Nodes, z.Volumes, z.OnDemandCapacity, z.SpotCapacity)
+    }
+    w.Flush()
+
+    fmt.Fprintf(&buf, "\nMulti-attach volumes:\n")
+    w = tabwriter.NewWriter(&buf, 0, 4, 2, ' ', 0)
+    fmt.Fprintf(w, "  VOLUME\tAZ\tDEVICE\tSIZE\tTYPE\tIOPS\tENCRYPTION\tNODES\n")
+    for _, v := range plan.Volumes {
+        nodes := []string{}
+        for _, node := range v.Nodes {
+            nodes = append(nodes, fmt.Sprint(node))
+        }
+        encryption := "none"
+        if v.KmsKeyId != "" {
+            encryption = v.KmsKeyId
+        } else if v.Encrypted {
+            encryption = "default key"
+        }
+        fmt.Fprintf(w, "  %s\t%s\t%s\t%d GiB\t%s\t%d\t%s\t%s\n", v.Name, v.AvailabilityZone, v.Device, v.Size, v.VolumeType, v.Iops, encryption, strings.Join(nodes, ","))
+    }
+    w.Flush()
+    return buf.String()
+}
@@ -0,0 +1,111 @@
+package util
+
+import "strings"
+import "testing"
+
+
+func TestPlanGroupByVolume(t *testing.T) {
+    azs := []string{}
+    for i := 0; i < 20; i++ {
+        azs = append(azs, "us-east-1a")
+    }
+    azs = append(azs, "us-east-1c", "us-east-1a")
+    groups := GroupByVolume(azs)
+    if len(groups) != 3 {
+        t.Fatalf("TestPlanGroupByVolume got %d groups", len(groups))
+    }
+    if groups[0].AvailabilityZone != "us-east-1a" || len(groups[0].Members) != MaxAttachmentsPerVolume {
+        t.Errorf("TestPlanGroupByVolume first group %v", groups[0])
+    }
+    if len(groups[1].Members) != 5 || groups[1].Members[4] != 21 {
+        t.Errorf("TestPlanGroupByVolume second group %v", groups[1])
+    }
+    if groups[2].AvailabilityZone != "us-east-1c" || groups[2].Members[0] != 20 {
+        t.Errorf("TestPlanGroupByVolume third group %v", groups[2])
+    }
+}
+
+func TestPlanAssignVolumesFillsExisting(t *testing.T) {
+    existing := []Volume{{VolumeId: "vol-1", AvailabilityZone: "us-east-1a"}}
+    counts := map[string]int{"vol-1": 14}
+    groups := AssignVolumes(existing, counts, []string{"us-east-1a", "us-east-1a", "us-east-1a"})
+    if len(groups) != 2 || groups[0].VolumeId != "vol-1" || len(groups[0].Members) != 2 {
+        t.Fatalf("TestPlanAssignVolumesFillsExisting got %+v", groups)
+    }
+    if groups[1].VolumeId != "" || groups[1].Members[0] != 2 {
+        t.Errorf("TestPlanAssignVolumesFillsExisting got %+v", groups)
+    }
+}
+
+func TestPlanFromRequests(t *testing.T) {
+    template := GetCreateLaunchTemplateInput("ec2fleet-template", "ami-1", "t3.micro", []string{"sg1"}, nil)
+    configs := Configs{Nodes: 5, OnDemandPercentage: 20,
+                       Subnets: []string{"sub1", "sub2", "sub3", "sub4", "sub5"},
+                       InstanceTypes: []string{"t3.micro", "t3.micro", "t3.micro", "t3.micro", "t3.micro"}}
+    fleet := GetCreateFleetRequestInput(configs.FleetNodes(), LaunchTemplateRef{Id: "lt-1", Version: "1"},
+                                        map[string]string{"sub1": "us-east-1a", "sub2": "us-east-1a", "sub3": "us-east-1b",
+                                                          "sub4": "us-east-1b", "sub5": "us-east-1c"},
+                                        configs, nil)
+    plan := NewPlan(template, fleet, []VolumeSpec{{Size: 4}}, nil)
+    if plan.TotalCapacity != 5 || plan.OnDemandCapacity != 1 || plan.SpotCapacity != 4 {
+        t.Errorf("TestPlanFromRequests capacity %+v", plan)
+    }
+    if len(plan.Overrides) != 5 || len(plan.Volumes) != 3 {
+        t.Fatalf("TestPlanFromRequests got %d overrides, %d volumes", len(plan.Overrides), len(plan.Volumes))
+    }
+    if plan.Overrides[1].Volume != "volume-1" || plan.Overrides[2].Volume != "volume-2" || plan.Overrides[4].Volume != "volume-3" {
+        t.Errorf("TestPlanFromRequests volume mapping %+v", plan.Overrides)
+    }
+    if counts := plan.VolumesPerAz(); counts["us-east-1a"] != 1 || counts["us-east-1b"] != 1 || counts["us-east-1c"] != 1 {
+        t.Errorf("TestPlanFromRequests volumes per AZ %v", counts)
+    }
+    if !strings.Contains(FormatPlan(plan), "volume-3") {
+        t.Errorf("TestPlanFromRequests table:\n%s", FormatPlan(plan))
+    }
+}
+
+func TestPlanOfflineSubnetZones(t *testing.T) {
+    configs := Configs{
+        Nodes:           2,
+        Subnets:         []string{"sub1", "sub2"},
+        InstanceTypes:   []string{"t3.micro", "t3.micro"},
+        FallbackSubnets: []string{"sub3"},
+        SubnetZones:     map[string]string{"sub1": "us-east-1a", "sub2": "us-east-1b"},
+    }
+    _, err := configs.OfflineSubnetZones()
+    if err == nil || err.Error() != "subnetZones has no AZ for subnet sub3, eg. -subnetZones=sub3=us-east-1a" {
+        t.Errorf("TestPlanOfflineSubnetZones without a fallback subnet AZ got %v", err)
+    }
+    configs.SubnetZones["sub3"] = "us-east-1c"
+    zones, err := configs.OfflineSubnetZones()
+    if err != nil || zones["sub2"] != "us-east-1b" || len(zones) != 3 {
+        t.Errorf("TestPlanOfflineSubnetZones got %v, %v", zones, err)
+    }
+}
+
+func TestPlanResolveSubnetZones(t *testing.T) {
+    configs := Configs{
+        Nodes:         2,
+        Subnets:       []string{"sub1", "sub2"},
+        InstanceTypes: []string{"t3.micro", "t3.micro"},
+        SubnetZones:   map[string]string{"sub1": "us-east-1a"},
+    }
+    looked := [][]string{}
+    lookup := func(subnets []string) (map[string]string, error) {
+        looked = append(looked, subnets)
+        return map[string]string{"sub2": "us-east-1b"}, nil
+    }
+    zones, err := configs.ResolveSubnetZones(lookup)
+    if err != nil || zones["sub1"] != "us-east-1a" || zones["sub2"] != "us-east-1b" ||
+       len(looked) != 1 || len(looked[0]) != 1 || looked[0][0] != "sub2" {
+        t.Errorf("TestPlanResolveSubnetZones got %v, %v after looking up %v", zones, err, looked)
+    }
+
+    // Nothing is looked up when subnetZones covers every subnet
+    configs.SubnetZones["sub2"] = "us-east-1c"
+    looked = nil
+    zones, err = configs.ResolveSubnetZones(lookup)
+    if err != nil || zones["sub2"] != "us-east-1c" || len(looked) != 0 {
+        t.Errorf("TestPlanResolveSubnetZones got %v, %v after looking up %v", zones, err, looked)
+    }
+}
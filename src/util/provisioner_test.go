@@ -0,0 +1,234 @@
+package util
+
+import "github.com/aws/aws-sdk-go/service/ec2"
+import "github.com/aws/aws-sdk-go/aws/awserr"
+import "github.com/aws/aws-sdk-go/aws"
+import "strings"
+import "testing"
+
+
+// fakeEC2 records the requests it receives and answers with canned IDs.
+type fakeEC2 struct {
+    templates     []*ec2.CreateLaunchTemplateInput
+    versions      []*ec2.CreateLaunchTemplateVersionInput
+    fleets        []*ec2.CreateFleetInput
+    volumes       []*ec2.CreateVolumeInput
+    attached      []*ec2.AttachVolumeInput
+    deleted       []string
+    detached      []*ec2.DetachVolumeInput
+    volDeleted    []string
+    terminated    []string
+    fleetsDeleted []string
+    status        string
+    tagged        taggedResources
+    // Operations answered with UnauthorizedOperation during a dry run
+    denied        map[string]bool
+    // Errors returned once by the next call of an operation
+    failures      map[string]error
+    // Instances already purged, TerminateInstances fails with them
+    purged        map[string]bool
+}
+
+// fail returns the error queued for the next call of op, if any.
+func (f *fakeEC2) fail(op string) error {
+    err := f.failures[op]
+    delete(f.failures, op)
+    return err
+}
+
+// dryRun answers a call sent with DryRun like AWS does.
+func (f *fakeEC2) dryRun(op string, dryRun *bool) error {
+    if !aws.BoolValue(dryRun) {
+        return nil
+    }
+    if err := f.fail(op); err != nil {
+        return err
+    }
+    if f.denied[op] {
+        return awserr.New("UnauthorizedOperation", "You are not authorized to perform this operation.", nil)
+    }
+    return awserr.New("DryRunOperation", "Request would have succeeded, but DryRun flag is set.", nil)
+}
+
+// taggedResources are returned by the Describe calls that filter on tags.
+type taggedResources struct {
+    Fleets          []*ec2.FleetData
+    Reservations    []*ec2.Reservation
+    Volumes         []*ec2.Volume
+    LaunchTemplates []*ec2.LaunchTemplate
+}
+
+func (f *fakeEC2) CreateLaunchTemplate(in *ec2.CreateLaunchTemplateInput) (*ec2.CreateLaunchTemplateOutput, error) {
+    f.templates = append(f.templates, in)
+    if err := f.dryRun("CreateLaunchTemplate", in.DryRun); err != nil {
+        return nil, err
+    }
+    return &ec2.CreateLaunchTemplateOutput{
+        LaunchTemplate: &ec2.LaunchTemplate{LaunchTemplateId: aws.String("lt-1")},
+    }, nil
+}
+
+func (f *fakeEC2) CreateLaunchTemplateVersion(in *ec2.CreateLaunchTemplateVersionInput) (*ec2.CreateLaunchTemplateVersionOutput, error) {
+    f.versions = append(f.versions, in)
+    if err := f.dryRun("CreateLaunchTemplateVersion", in.DryRun); err != nil {
+        return nil, err
+    }
+    return &ec2.CreateLaunchTemplateVersionOutput{
+        LaunchTemplateVersion: &ec2.LaunchTemplateVersion{VersionNumber: aws.Int64(int64(len(f.versions) + 1))},
+    }, nil
+}
+
+func (f *fakeEC2) DeleteLaunchTemplate(in *ec2.DeleteLaunchTemplateInput) (*ec2.DeleteLaunchTemplateOutput, error) {
+    f.deleted = append(f.deleted, *in.LaunchTemplateId)
+    if err := f.dryRun("DeleteLaunchTemplate", in.DryRun); err != nil {
+        return nil, err
+    }
+    return &ec2.DeleteLaunchTemplateOutput{}, nil
+}
+
+func (f *fakeEC2) CreateFleet(in *ec2.CreateFleetInput) (*ec2.CreateFleetOutput, error) {
+    f.fleets = append(f.fleets, in)
+    if err := f.dryRun("CreateFleet", in.DryRun); err != nil {
+        return nil, err
+    }
+    return &ec2.CreateFleetOutput{FleetId: aws.String("fleet-1")}, nil
+}
+
+func (f *fakeEC2) CreateVolume(in *ec2.CreateVolumeInput) (*ec2.Volume, error) {
+    f.volumes = append(f.volumes, in)
+    if err := f.dryRun("CreateVolume", in.DryRun); err != nil {
+        return nil, err
+    }
+    return &ec2.Volume{VolumeId: aws.String("vol-1"), AvailabilityZone: in.AvailabilityZone}, nil
+}
+
+func (f *fakeEC2) AttachVolume(in *ec2.AttachVolumeInput) (*ec2.VolumeAttachment, error) {
+    f.attached = append(f.attached, in)
+    if err := f.dryRun("AttachVolume", in.DryRun); err != nil {
+        return nil, err
+    }
+    return &ec2.VolumeAttachment{InstanceId: in.InstanceId, VolumeId: in.VolumeId}, nil
+}
+
+func (f *fakeEC2) DetachVolume(in *ec2.DetachVolumeInput) (*ec2.VolumeAttachment, error) {
+    if err := f.fail("DetachVolume"); err != nil {
+        return nil, err
+    }
+    f.detached = append(f.detached, in)
+    return &ec2.VolumeAttachment{InstanceId: in.InstanceId, VolumeId: in.VolumeId}, nil
+}
+
+func (f *fakeEC2) DeleteVolume(in *ec2.DeleteVolumeInput) (*ec2.DeleteVolumeOutput, error) {
+    if err := f.fail("DeleteVolume"); err != nil {
+        return nil, err
+    }
+    f.volDeleted = append(f.volDeleted, *in.VolumeId)
+    return &ec2.DeleteVolumeOutput{}, nil
+}
+
+func (f *fakeEC2) DescribeVolumes(in *ec2.DescribeVolumesInput) (*ec2.DescribeVolumesOutput, error) {
+    if len(in.VolumeIds) == 0 {
+        // Lookups by tag or volume-id filter
+        return &ec2.DescribeVolumesOutput{Volumes: f.tagged.Volumes}, nil
+    }
+    return &ec2.DescribeVolumesOutput{
+        Volumes: []*ec2.Volume{{VolumeId: in.VolumeIds[0], State: aws.String("available")}},
+    }, nil
+}
+
+func (f *fakeEC2) TerminateInstances(in *ec2.TerminateInstancesInput) (*ec2.TerminateInstancesOutput, error) {
+    if err := f.fail("TerminateInstances"); err != nil {
+        return nil, err
+    }
+    for _, instanceId := range aws.StringValueSlice(in.InstanceIds) {
+        if f.purged[instanceId] {
+            return nil, awserr.New("InvalidInstanceID.NotFound", "The instance ID '" + instanceId + "' does not exist", nil)
+        }
+    }
+    f.terminated = append(f.terminated, aws.StringValueSlice(in.InstanceIds)...)
+    return &ec2.TerminateInstancesOutput{}, nil
+}
+
+func (f *fakeEC2) DeleteFleets(in *ec2.DeleteFleetsInput) (*ec2.DeleteFleetsOutput, error) {
+    f.fleetsDeleted = append(f.fleetsDeleted, aws.StringValueSlice(in.FleetIds)...)
+    return &ec2.DeleteFleetsOutput{}, nil
+}
+
+func (f *fakeEC2) DescribeFleets(in *ec2.DescribeFleetsInput) (*ec2.DescribeFleetsOutput, error) {
+    return &ec2.DescribeFleetsOutput{Fleets: f.tagged.Fleets}, nil
+}
+
+func (f *fakeEC2) DescribeInstances(in *ec2.DescribeInstancesInput) (*ec2.DescribeInstancesOutput, error) {
+    return &ec2.DescribeInstancesOutput{Reservations: f.tagged.Reservations}, nil
+}
+
+func (f *fakeEC2) DescribeLaunchTemplates(in *ec2.DescribeLaunchTemplatesInput) (*ec2.DescribeLaunchTemplatesOutput, error) {
+    return &ec2.DescribeLaunchTemplatesOutput{LaunchTemplates: f.tagged.LaunchTemplates}, nil
+}
+
+// DescribeSubnets places subnets named "<az>-<n>" in <az>, eg. us-east-1c-2.
+func (f *fakeEC2) DescribeSubnets(in *ec2.DescribeSubnetsInput) (*ec2.DescribeSubnetsOutput, error) {
+    output := &ec2.DescribeSubnetsOutput{}
+    for _, id := range in.SubnetIds {
+        if i := strings.LastIndex(*id, "-"); i > 0 {
+            output.Subnets = append(output.Subnets, &ec2.Subnet{SubnetId: id, AvailabilityZone: aws.String((*id)[:i])})
+        }
+    }
+    return output, nil
+}
+
+func (f *fakeEC2) DescribeInstanceStatus(in *ec2.DescribeInstanceStatusInput) (*ec2.DescribeInstanceStatusOutput, error) {
+    return &ec2.DescribeInstanceStatusOutput{
+        InstanceStatuses: []*ec2.InstanceStatus{
+            {InstanceState: &ec2.InstanceState{Name: aws.String(f.status)}},
+        },
+    }, nil
+}
+
+var _ EC2API = (*ec2.EC2)(nil)
+
+func TestProvisionerCreateVolume(t *testing.T) {
+    fake := &fakeEC2{}
+    p := NewProvisioner(fake)
+    volume, err := p.CreateVolume(VolumeSpec{Size: 8}, "us-east-1a", nil)
+    if err != nil || *volume.VolumeId != "vol-1" || len(fake.volumes) != 1 {
+        t.Errorf("TestProvisionerCreateVolume failed")
+    }
+    if !*fake.volumes[0].MultiAttachEnabled || *fake.volumes[0].Size != 8 {
+        t.Errorf("TestProvisionerCreateVolume sent unexpected input: %v", fake.volumes[0])
+    }
+}
+
+func TestProvisionerAttachVolume(t *testing.T) {
+    fake := &fakeEC2{status: "running"}
+    p := NewProvisioner(fake)
+    _, err := p.AttachVolume("i-1", "vol-1", "/dev/sdf")
+    if err != nil || len(fake.attached) != 1 || *fake.attached[0].InstanceId != "i-1" {
+        t.Errorf("TestProvisionerAttachVolume failed")
+    }
+}
+
+func TestProvisionerLaunchTemplate(t *testing.T) {
+    fake := &fakeEC2{}
+    p := NewProvisioner(fake)
+    input := GetCreateLaunchTemplateInput("name", "ami-1", "t3.micro", []string{"sg1"}, nil)
+    output, err := p.CreateLaunchTemplate(input)
+    if err != nil {
+        t.Fatalf("TestProvisionerLaunchTemplate failed: %v", err)
+    }
+    p.DeleteLaunchTemplate(*output.LaunchTemplate.LaunchTemplateId)
+    if len(fake.templates) != 1 || len(fake.deleted) != 1 || fake.deleted[0] != "lt-1" {
+        t.Errorf("TestProvisionerLaunchTemplate failed")
+    }
+}
+
+func TestProvisionerSubnetAvailabilityZones(t *testing.T) {
+    p := NewProvisioner(&fakeEC2{})
+    zones, err := p.GetSubnetAvailabilityZones([]string{"us-east-1a-1", "us-east-1c-1", "us-east-1a-1"})
+    if err != nil || len(zones) != 2 || zones["us-east-1c-1"] != "us-east-1c" {
+        t.Errorf("TestProvisionerSubnetAvailabilityZones failed: %v %v", zones, err)
+    }
+    if _, err := p.GetSubnetAvailabilityZones([]string{"missing"}); err == nil {
+        t.Errorf("TestProvisionerSubnetAvailabilityZones accepted an unknown subnet")
+    }
+}
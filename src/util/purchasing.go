@@ -0,0 +1,161 @@
+/* Copyright (C) Xiang Wang - All Rights Reserved
+ * Unauthorized copying of this file, via any medium is strictly prohibited
+ * Proprietary and confidential
+ * Written by Xiang Wang <xwang1314@gmail.com>, August 2020
+ */
+
+package util
+
+import "github.com/aws/aws-sdk-go/service/ec2"
+import "github.com/aws/aws-sdk-go/aws"
+import "strconv"
+import "strings"
+import "time"
+import "fmt"
+import "log"
+
+
+// Purchasing option defaults, used when a Configs field is empty
+const (
+    OnDemandPercentageDefault  = 20
+    SpotAllocationDefault      = ec2.SpotAllocationStrategyDiversified
+    FleetTypeDefault           = ec2.FleetTypeInstant
+    DefaultCapacityTypeDefault = ec2.DefaultTargetCapacityTypeSpot
+)
+
+var (
+    spotAllocationStrategies = []string{
+        ec2.SpotAllocationStrategyLowestPrice,
+        ec2.SpotAllocationStrategyDiversified,
+        ec2.SpotAllocationStrategyCapacityOptimized,
+        "capacity-optimized-prioritized",
+        "price-capacity-optimized",
+    }
+    onDemandAllocationStrategies = []string{
+        ec2.FleetOnDemandAllocationStrategyLowestPrice,
+        ec2.FleetOnDemandAllocationStrategyPrioritized,
+    }
+    fleetTypes = []string{ec2.FleetTypeInstant, ec2.FleetTypeRequest, ec2.FleetTypeMaintain}
+    capacityTypes = []string{ec2.DefaultTargetCapacityTypeSpot, ec2.DefaultTargetCapacityTypeOnDemand}
+)
+
+func orDefault(value, defaultValue string) string {
+    if value == "" {
+        return defaultValue
+    }
+    return value
+}
+
+// FleetTypeOrDefault is the type of fleet configs asks for.
+func (c Configs) FleetTypeOrDefault() string {
+    return orDefault(c.FleetType, FleetTypeDefault)
+}
+
+// onDemandCapacity is how much of capacity is bought on-demand: the
+// on-demand count when there is one, the on-demand percentage otherwise.
+// It is never more than capacity.
+func (c Configs) onDemandCapacity(capacity int64) int64 {
+    if c.OnDemandCount == nil {
+        return int64(c.OnDemandPercentage)*capacity/100
+    }
+    count := int64(*c.OnDemandCount)
+    if count > capacity {
+        return capacity
+    }
+    if count < 0 {
+        return 0
+    }
+    return count
+}
+
+// validatePurchasing checks the purchasing options.
+func validatePurchasing(c Configs) ValidationErrors {
+    errs := ValidationErrors{}
+    oneOf := func(name, value string, allowed []string) {
+        if value == "" {
+            return
+        }
+        for _, ok := range allowed {
+            if value == ok {
+                return
+            }
+        }
+        errs = append(errs, &ValidationError{Msg: fmt.Sprintf("Invalid %s %q, must be one of %s.", name, value, strings.Join(allowed, ", "))})
+    }
+    oneOf("spotAllocationStrategy", c.SpotAllocationStrategy, spotAllocationStrategies)
+    oneOf("onDemandAllocationStrategy", c.OnDemandAllocationStrategy, onDemandAllocationStrategies)
+    oneOf("fleetType", c.FleetType, fleetTypes)
+    oneOf("defaultCapacityType", c.DefaultCapacityType, capacityTypes)
+
+    if c.OnDemandPercentage < 0 || c.OnDemandPercentage > 100 {
+        errs = append(errs, &ValidationError{Msg: "onDemandPercentage must be between 0-100 inclusively."})
+    }
+    capacity := fleetCapacity(c.FleetNodes())
+    if c.OnDemandCount != nil && (*c.OnDemandCount < 0 || *c.OnDemandCount > capacity) {
+        errs = append(errs, &ValidationError{Msg: fmt.Sprintf("onDemandCount must be between 0 and the fleet capacity %d.", capacity)})
+    }
+    if c.MaxSpotPrice != "" {
+        if price, err := strconv.ParseFloat(c.MaxSpotPrice, 64); err != nil || price <= 0 {
+            errs = append(errs, &ValidationError{Msg: "maxSpotPrice must be a positive price in USD per hour, eg. 0.05."})
+        }
+    }
+    return errs
+}
+
+// WaitForFleetInstances waits for a request or maintain fleet, which does
+// not return its instances from CreateFleet, to reach its target capacity
+// and returns its instances.
+func (p *Provisioner) WaitForFleetInstances(fleetId string) ([]Instance, error) {
+    fulfilled := false
+    for i := 0; i < 6 && !fulfilled; i++ {
+        responseBody, err := p.client.DescribeFleets(&ec2.DescribeFleetsInput{FleetIds: aws.StringSlice([]string{fleetId})})
+        if err != nil {
+            return nil, newAWSError("Describe fleets", err)
+        }
+        for _, fleet := range responseBody.Fleets {
+            target := aws.Int64Value(fleet.TargetCapacitySpecification.TotalTargetCapacity)
+            if aws.StringValue(fleet.FleetId) == fleetId && aws.Float64Value(fleet.FulfilledCapacity) >= float64(target) {
+                fulfilled = true
+            }
+        }
+        if !fulfilled {
+            log.Println("Waiting for fleet", fleetId, "to reach its target capacity. Sleep", p.pollInterval, "...")
+            time.Sleep(p.pollInterval)
+        }
+    }
+    if !fulfilled {
+        return nil, &TimeoutError{Op: "Waiting for fleet " + fleetId + " to reach its target capacity", Waited: 6 * p.pollInterval}
+    }
+
+    // EC2 tags every fleet instance with the ID of its fleet
+    input := &ec2.DescribeInstancesInput{
+        Filters: []*ec2.Filter{{Name: aws.String("tag:aws:ec2:fleet-id"), Values: aws.StringSlice([]string{fleetId})}},
+    }
+    instances := []Instance{}
+    for {
+        responseBody, err := p.client.DescribeInstances(input)
+        if err != nil {
+            return nil, newAWSError("Describe instances", err)
+        }
+        for _, reservation := range responseBody.Reservations {
+            for _, instance := range reservation.Instances {
+                lifecycle := aws.StringValue(instance.InstanceLifecycle)
+                if lifecycle == "" {
+                    lifecycle = ec2.DefaultTargetCapacityTypeOnDemand
+                }
+                instances = append(instances, Instance{
+                    InstanceId:       aws.StringValue(instance.InstanceId),
+                    InstanceType:     aws.StringValue(instance.InstanceType),
+                    AvailabilityZone: aws.StringValue(instance.Placement.AvailabilityZone),
+                    SubnetId:         aws.StringValue(instance.SubnetId),
+                    Lifecycle:        lifecycle,
+                })
+            }
+        }
+        if aws.StringValue(responseBody.NextToken) == "" {
+            break
+        }
+        input.NextToken = responseBody.NextToken
+    }
+    return instances, nil
+}
@@ -0,0 +1,101 @@
+package util
+
+import "github.com/aws/aws-sdk-go/service/ec2"
+import "github.com/aws/aws-sdk-go/aws"
+import "time"
+import "testing"
+
+
+func purchasingConfigs() Configs {
+    return Configs{
+        Nodes:          4,
+        VolumeSize:     4,
+        SecurityGroups: []string{"sg1"},
+        Subnets:        []string{"sub1", "sub1", "sub1", "sub1"},
+        InstanceTypes:  []string{"t3.micro", "t3.micro", "t3.micro", "t3.micro"},
+    }
+}
+
+func TestPurchasingOptions(t *testing.T) {
+    configs := purchasingConfigs()
+    count := 3
+    configs.OnDemandCount = &count
+    configs.OnDemandPercentage = 50
+    configs.SpotAllocationStrategy = "price-capacity-optimized"
+    configs.OnDemandAllocationStrategy = ec2.FleetOnDemandAllocationStrategyPrioritized
+    configs.MaxSpotPrice = "0.05"
+    configs.FleetType = ec2.FleetTypeMaintain
+    if err := ValidateConfigs(configs); err != nil {
+        t.Fatalf("TestPurchasingOptions failed: %v", err)
+    }
+    fleet := GetCreateFleetRequestInput(configs.FleetNodes(), LaunchTemplateRef{Id: "lt-1", Version: "1"}, map[string]string{"sub1": "us-east-1a"}, configs, nil)
+    capacity := fleet.TargetCapacitySpecification
+    // The count wins over the percentage
+    if aws.Int64Value(capacity.OnDemandTargetCapacity) != 3 || aws.Int64Value(capacity.SpotTargetCapacity) != 1 {
+        t.Errorf("TestPurchasingOptions capacity %v", capacity)
+    }
+    if aws.StringValue(fleet.Type) != "maintain" || aws.StringValue(fleet.SpotOptions.AllocationStrategy) != "price-capacity-optimized" ||
+       aws.StringValue(fleet.OnDemandOptions.AllocationStrategy) != "prioritized" ||
+       aws.StringValue(fleet.LaunchTemplateConfigs[0].Overrides[0].MaxPrice) != "0.05" {
+        t.Errorf("TestPurchasingOptions request %v", fleet)
+    }
+    // Maintain fleets can not tag their instances
+    for _, spec := range fleet.TagSpecifications {
+        if aws.StringValue(spec.ResourceType) == ec2.ResourceTypeInstance {
+            t.Errorf("TestPurchasingOptions tags instances of a maintain fleet")
+        }
+    }
+}
+
+func TestPurchasingDefaults(t *testing.T) {
+    configs := purchasingConfigs()
+    configs.OnDemandPercentage = OnDemandPercentageDefault
+    fleet := GetCreateFleetRequestInput(configs.FleetNodes(), LaunchTemplateRef{Id: "lt-1", Version: "1"}, map[string]string{"sub1": "us-east-1a"}, configs, nil)
+    if aws.StringValue(fleet.Type) != "instant" || aws.StringValue(fleet.SpotOptions.AllocationStrategy) != "diversified" ||
+       aws.StringValue(fleet.TargetCapacitySpecification.DefaultTargetCapacityType) != "spot" || fleet.OnDemandOptions != nil {
+        t.Errorf("TestPurchasingDefaults request %v", fleet)
+    }
+}
+
+func TestPurchasingValidate(t *testing.T) {
+    configs := purchasingConfigs()
+    count := 5
+    configs.OnDemandCount = &count
+    configs.OnDemandPercentage = 101
+    configs.SpotAllocationStrategy = "cheapest"
+    configs.OnDemandAllocationStrategy = "diversified"
+    configs.MaxSpotPrice = "free"
+    configs.FleetType = "spot"
+    configs.DefaultCapacityType = "reserved"
+    errs, ok := ValidateConfigs(configs).(ValidationErrors)
+    if !ok || len(errs) != 7 {
+        t.Errorf("TestPurchasingValidate got %v", errs)
+    }
+}
+
+func TestPurchasingWaitForFleetInstances(t *testing.T) {
+    fake := &fakeEC2{}
+    fake.tagged.Fleets = []*ec2.FleetData{{
+        FleetId:                     aws.String("fleet-1"),
+        FulfilledCapacity:           aws.Float64(1),
+        TargetCapacitySpecification: &ec2.TargetCapacitySpecification{TotalTargetCapacity: aws.Int64(1)},
+    }}
+    fake.tagged.Reservations = []*ec2.Reservation{{Instances: []*ec2.Instance{{
+        InstanceId:   aws.String("i-1"),
+        InstanceType: aws.String("t3.micro"),
+        SubnetId:     aws.String("sub1"),
+        Placement:    &ec2.Placement{AvailabilityZone: aws.String("us-east-1a")},
+    }}}}
+    p := NewProvisioner(fake)
+    p.pollInterval = time.Millisecond
+    instances, err := p.WaitForFleetInstances("fleet-1")
+    if err != nil || len(instances) != 1 || instances[0].AvailabilityZone != "us-east-1a" || instances[0].Lifecycle != "on-demand" {
+        t.Errorf("TestPurchasingWaitForFleetInstances got %v, %v", instances, err)
+    }
+
+    fake.tagged.Fleets[0].FulfilledCapacity = aws.Float64(0)
+    _, err = p.WaitForFleetInstances("fleet-1")
+    if _, ok := err.(*TimeoutError); !ok {
+        t.Errorf("TestPurchasingWaitForFleetInstances expected a timeout, got %v", err)
+    }
+}
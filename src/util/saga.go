@@ -0,0 +1,84 @@
+/* Copyright (C) Xiang Wang - All Rights Reserved
+ * Unauthorized copying of this file, via any medium is strictly prohibited
+ * Proprietary and confidential
+ * Written by Xiang Wang <xwang1314@gmail.com>, August 2020
+ */
+
+package util
+
+import "strings"
+import "log"
+
+
+// Saga records a compensating action for every resource created during a
+// run. When a later step fails, Rollback undoes them in reverse order:
+// attachments are detached before their volume is deleted, volumes are
+// deleted before the instances are terminated, and so on.
+type Saga struct {
+    steps []sagaStep
+}
+
+type sagaStep struct {
+    name       string
+    compensate func() error
+}
+
+// RollbackError lists the compensating actions that failed. The resources
+// they name were left behind and must be cleaned up by hand.
+type RollbackError struct {
+    Failed []string
+    Errs   []error
+}
+
+func (e *RollbackError) Error() string {
+    msgs := []string{}
+    for i := range e.Failed {
+        msgs = append(msgs, e.Failed[i] + ": " + e.Errs[i].Error())
+    }
+    return "Rollback left resources behind:\n" + strings.Join(msgs, "\n")
+}
+
+// Record registers the action that undoes the step called name.
+func (s *Saga) Record(name string, compensate func() error) {
+    s.steps = append(s.steps, sagaStep{name: name, compensate: compensate})
+}
+
+// Release forgets the step called name, eg. once the normal flow has
+// already removed the resource or handed it over to the state file.
+func (s *Saga) Release(name string) {
+    for i := len(s.steps) - 1; i >= 0; i-- {
+        if s.steps[i].name == name {
+            s.steps = append(s.steps[:i], s.steps[i+1:]...)
+            return
+        }
+    }
+}
+
+// Pending returns the names of the recorded steps in creation order.
+func (s *Saga) Pending() []string {
+    names := []string{}
+    for _, step := range s.steps {
+        names = append(names, step.name)
+    }
+    return names
+}
+
+// Rollback runs every compensating action in reverse order. A failed action
+// does not stop the rollback; all failures are returned in a RollbackError.
+func (s *Saga) Rollback() error {
+    rollbackErr := &RollbackError{}
+    for i := len(s.steps) - 1; i >= 0; i-- {
+        step := s.steps[i]
+        log.Println("Rolling back", step.name)
+        if err := step.compensate(); err != nil {
+            log.Println("Rollback of", step.name, "failed:", err)
+            rollbackErr.Failed = append(rollbackErr.Failed, step.name)
+            rollbackErr.Errs = append(rollbackErr.Errs, err)
+        }
+    }
+    s.steps = nil
+    if len(rollbackErr.Failed) > 0 {
+        return rollbackErr
+    }
+    return nil
+}
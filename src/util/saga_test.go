@@ -0,0 +1,42 @@
+package util
+
+import "errors"
+import "testing"
+
+
+func TestSagaRollbackReverseOrder(t *testing.T) {
+    saga := &Saga{}
+    order := []string{}
+    for _, name := range []string{"template", "instances", "volume", "attachment"} {
+        name := name
+        saga.Record(name, func() error {
+            order = append(order, name)
+            return nil
+        })
+    }
+    saga.Release("template")
+    if err := saga.Rollback(); err != nil {
+        t.Fatalf("TestSagaRollbackReverseOrder failed: %v", err)
+    }
+    expected := []string{"attachment", "volume", "instances"}
+    if len(order) != len(expected) {
+        t.Fatalf("TestSagaRollbackReverseOrder ran %v", order)
+    }
+    for i := range expected {
+        if order[i] != expected[i] {
+            t.Errorf("TestSagaRollbackReverseOrder ran %v", order)
+        }
+    }
+}
+
+func TestSagaRollbackContinuesOnError(t *testing.T) {
+    saga := &Saga{}
+    ran := 0
+    saga.Record("first", func() error { ran++; return nil })
+    saga.Record("second", func() error { ran++; return errors.New("boom") })
+    err := saga.Rollback()
+    var rollbackErr *RollbackError
+    if ran != 2 || !errors.As(err, &rollbackErr) || rollbackErr.Failed[0] != "second" {
+        t.Errorf("TestSagaRollbackContinuesOnError failed: %v", err)
+    }
+}
@@ -0,0 +1,83 @@
+/* Copyright (C) Xiang Wang - All Rights Reserved
+ * Unauthorized copying of this file, via any medium is strictly prohibited
+ * Proprietary and confidential
+ * Written by Xiang Wang <xwang1314@gmail.com>, August 2020
+ */
+
+package util
+
+import "github.com/aws/aws-sdk-go/service/ec2"
+import "log"
+
+
+// Scalable checks that the fleet of the run can be scaled by adding and
+// removing instances. EC2 keeps the target capacity of request and maintain
+// fleets itself: it replaces the instances a shrink terminates, and a second
+// fleet for a scale up would leave the first one's target unchanged.
+func Scalable(state *RunState) error {
+    if fleetType := state.Config.FleetTypeOrDefault(); fleetType != ec2.FleetTypeInstant {
+        return &ValidationError{Msg: "Run " + state.RunId + " has a " + fleetType + " fleet, only instant fleets can be scaled."}
+    }
+    return nil
+}
+
+// ShrinkRun removes the last count instances of the run: their volumes are
+// detached, the instances terminated, and every volume left without an
+// attachment is deleted. The state file is saved after each step.
+func ShrinkRun(p *Provisioner, stateFile *StateFile, count int) error {
+    state := stateFile.State
+    if err := Scalable(state); err != nil {
+        return err
+    }
+    if count <= 0 || count >= len(state.Instances) {
+        return &ValidationError{Msg: "A run must keep at least one instance, use destroy to remove all of them."}
+    }
+    keep := len(state.Instances) - count
+    removed := state.Instances[keep:]
+    removing := map[string]bool{}
+    for _, instance := range removed {
+        removing[instance.InstanceId] = true
+    }
+
+    attachments := []Attachment{}
+    for _, a := range state.Attachments {
+        if !removing[a.InstanceId] {
+            attachments = append(attachments, a)
+            continue
+        }
+        if _, err := p.DetachVolume(a.InstanceId, a.VolumeId); err != nil {
+            return err
+        }
+    }
+    state.Attachments = attachments
+    if err := stateFile.Save(); err != nil {
+        return err
+    }
+
+    instanceIds := []string{}
+    for _, instance := range removed {
+        instanceIds = append(instanceIds, instance.InstanceId)
+    }
+    if _, err := p.TerminateInstances(instanceIds); err != nil {
+        return err
+    }
+    state.Instances = state.Instances[:keep]
+    if err := stateFile.Save(); err != nil {
+        return err
+    }
+
+    counts := state.AttachmentCounts()
+    volumes := []Volume{}
+    for _, v := range state.Volumes {
+        if counts[v.VolumeId] > 0 {
+            volumes = append(volumes, v)
+            continue
+        }
+        log.Println("Volume", v.VolumeId, "is no longer attached to any instance")
+        if _, err := p.DeleteVolume(v.VolumeId); err != nil {
+            return err
+        }
+    }
+    state.Volumes = volumes
+    return stateFile.Save()
+}
@@ -0,0 +1,56 @@
+package util
+
+import "testing"
+
+
+func TestScaleShrinkRun(t *testing.T) {
+    fake := &fakeEC2{}
+    stateFile := &StateFile{State: &RunState{
+        RunId:     "run-1",
+        Instances: []Instance{{InstanceId: "i-1"}, {InstanceId: "i-2"}, {InstanceId: "i-3"}},
+        Volumes:   []Volume{{VolumeId: "vol-1"}, {VolumeId: "vol-2"}},
+        Attachments: []Attachment{
+            {InstanceId: "i-1", VolumeId: "vol-1"},
+            {InstanceId: "i-2", VolumeId: "vol-1"},
+            {InstanceId: "i-3", VolumeId: "vol-2"},
+        },
+    }}
+    if err := ShrinkRun(NewProvisioner(fake), stateFile, 2); err != nil {
+        t.Fatalf("TestScaleShrinkRun failed: %v", err)
+    }
+    state := stateFile.State
+    if len(state.Instances) != 1 || len(state.Attachments) != 1 || len(state.Volumes) != 1 {
+        t.Errorf("TestScaleShrinkRun left %+v", state)
+    }
+    if len(fake.detached) != 2 || len(fake.terminated) != 2 || len(fake.volDeleted) != 1 || fake.volDeleted[0] != "vol-2" {
+        t.Errorf("TestScaleShrinkRun sent detach %d, terminate %v, delete %v", len(fake.detached), fake.terminated, fake.volDeleted)
+    }
+    if err := ShrinkRun(NewProvisioner(fake), stateFile, 1); err == nil {
+        t.Errorf("TestScaleShrinkRun removed the last instance")
+    }
+}
+
+func TestScaleOnlyInstantFleets(t *testing.T) {
+    fake := &fakeEC2{}
+    stateFile := &StateFile{State: &RunState{
+        RunId:     "run-1",
+        Config:    Configs{FleetType: "maintain"},
+        Instances: []Instance{{InstanceId: "i-1"}, {InstanceId: "i-2"}},
+    }}
+    err := ShrinkRun(NewProvisioner(fake), stateFile, 1)
+    if err == nil || err.Error() != "Run run-1 has a maintain fleet, only instant fleets can be scaled." {
+        t.Errorf("TestScaleOnlyInstantFleets got %v", err)
+    }
+    if len(fake.terminated) != 0 || len(stateFile.State.Instances) != 2 {
+        t.Errorf("TestScaleOnlyInstantFleets terminated %v", fake.terminated)
+    }
+    stateFile.State.Config.FleetType = "request"
+    if Scalable(stateFile.State) == nil {
+        t.Errorf("TestScaleOnlyInstantFleets accepted a request fleet")
+    }
+    // Runs recorded before fleet types default to instant
+    stateFile.State.Config.FleetType = ""
+    if err := Scalable(stateFile.State); err != nil {
+        t.Errorf("TestScaleOnlyInstantFleets rejected an instant fleet: %v", err)
+    }
+}
@@ -0,0 +1,177 @@
+/* Copyright (C) Xiang Wang - All Rights Reserved
+ * Unauthorized copying of this file, via any medium is strictly prohibited
+ * Proprietary and confidential
+ * Written by Xiang Wang <xwang1314@gmail.com>, August 2020
+ */
+
+package util
+
+import "path/filepath"
+import "encoding/json"
+import "crypto/rand"
+import "io/ioutil"
+import "fmt"
+import "time"
+import "os"
+
+
+// Default directory for the state files written by each run
+const StateDirDefault = ".ec2fleet"
+
+// Run status recorded in the state file
+const (
+    StatusCreating       = "creating"
+    StatusCreated        = "created"
+    StatusFailed         = "failed"
+    StatusRolledBack     = "rolled-back"
+    StatusRollbackFailed = "rollback-failed"
+)
+
+// RunState records every resource a run created, together with the inputs
+// it was created from.
+type RunState struct {
+    RunId                 string       `json:"runId"`
+    Status                string       `json:"status"`
+    Config                Configs      `json:"config"`
+    // The launch template created for the run, deleted with it
+    LaunchTemplateId      string       `json:"launchTemplateId,omitempty"`
+    // The version of it the last fleet launched, and the digest of its data
+    LaunchTemplateVersion string       `json:"launchTemplateVersion,omitempty"`
+    LaunchTemplateDigest  string       `json:"launchTemplateDigest,omitempty"`
+    FleetIds              []string     `json:"fleetIds"`
+    Instances             []Instance   `json:"instances"`
+    Volumes               []Volume     `json:"volumes"`
+    Attachments           []Attachment `json:"attachments"`
+}
+
+// Instance is one instance launched by the fleet.
+type Instance struct {
+    InstanceId       string `json:"instanceId"`
+    InstanceType     string `json:"instanceType"`
+    AvailabilityZone string `json:"availabilityZone"`
+    SubnetId         string `json:"subnetId"`
+    Lifecycle        string `json:"lifecycle,omitempty"`
+    // The fleet fallback that launched the instance, empty for the configured nodes
+    Fallback         string `json:"fallback,omitempty"`
+}
+
+// Volume is one multi-attach volume created by the run.
+type Volume struct {
+    VolumeId         string `json:"volumeId"`
+    AvailabilityZone string `json:"availabilityZone"`
+    Size             int    `json:"size,omitempty"`
+    // The shared volume it is one of, empty for the single shared volume
+    Name             string `json:"name,omitempty"`
+    // Where it is attached on every instance, /dev/sdf when empty
+    Device           string `json:"device,omitempty"`
+}
+
+// Attachment is one multi-attach volume attached to one instance.
+type Attachment struct {
+    InstanceId string `json:"instanceId"`
+    VolumeId   string `json:"volumeId"`
+    Device     string `json:"device"`
+}
+
+// NewRunId returns a unique, sortable ID for a run, eg. 20200815-142301-9f1c.
+func NewRunId() string {
+    suffix := make([]byte, 2)
+    rand.Read(suffix)
+    return fmt.Sprintf("%s-%x", time.Now().UTC().Format("20060102-150405"), suffix)
+}
+
+func StateFilePath(stateDir, runId string) string {
+    return filepath.Join(stateDir, runId + ".json")
+}
+
+// SaveRunState writes the state to a temporary file and renames it over
+// filename, so readers never see a partially written file.
+func SaveRunState(filename string, state *RunState) error {
+    data, err := json.MarshalIndent(state, "", "    ")
+    if err != nil {
+        return err
+    }
+    dir := filepath.Dir(filename)
+    if err := os.MkdirAll(dir, 0755); err != nil {
+        return err
+    }
+    tmp, err := ioutil.TempFile(dir, filepath.Base(filename) + ".tmp")
+    if err != nil {
+        return err
+    }
+    defer os.Remove(tmp.Name())
+    if _, err := tmp.Write(data); err != nil {
+        tmp.Close()
+        return err
+    }
+    if err := tmp.Sync(); err != nil {
+        tmp.Close()
+        return err
+    }
+    if err := tmp.Close(); err != nil {
+        return err
+    }
+    if err := os.Chmod(tmp.Name(), 0644); err != nil {
+        return err
+    }
+    return os.Rename(tmp.Name(), filename)
+}
+
+func LoadRunState(filename string) (*RunState, error) {
+    file, err := ioutil.ReadFile(filename)
+    if err != nil {
+        return nil, &ValidationError{Msg: "Unable to read state file " + filename, Err: err}
+    }
+    state := &RunState{}
+    if err := json.Unmarshal(file, state); err != nil {
+        return nil, &ValidationError{Msg: "Invalid state file " + filename, Err: err}
+    }
+    return state, nil
+}
+
+// StateFile keeps a RunState in sync with its file on disk.
+type StateFile struct {
+    Path  string
+    State *RunState
+}
+
+// Save writes the current state; call it after every change to State.
+// A StateFile without a Path is not persisted, eg. during a dry run.
+func (f *StateFile) Save() error {
+    if f.Path == "" {
+        return nil
+    }
+    if err := SaveRunState(f.Path, f.State); err != nil {
+        // Not the input's fault, so not a ValidationError
+        return fmt.Errorf("Unable to write state file %s: %w", f.Path, err)
+    }
+    return nil
+}
+
+// InstanceIds returns the IDs of every instance in the run.
+func (s *RunState) InstanceIds() []string {
+    ids := []string{}
+    for _, instance := range s.Instances {
+        ids = append(ids, instance.InstanceId)
+    }
+    return ids
+}
+
+// AttachmentCounts returns how many instances each volume is attached to.
+func (s *RunState) AttachmentCounts() map[string]int {
+    counts := map[string]int{}
+    for _, v := range s.Volumes {
+        counts[v.VolumeId] = 0
+    }
+    for _, a := range s.Attachments {
+        counts[a.VolumeId]++
+    }
+    return counts
+}
+
+// Empty reports whether the run has no resources left.
+func (s *RunState) Empty() bool {
+    return s.Status == StatusRolledBack ||
+        (s.LaunchTemplateId == "" && len(s.FleetIds) == 0 && len(s.Instances) == 0 &&
+         len(s.Volumes) == 0 && len(s.Attachments) == 0)
+}
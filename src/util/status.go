@@ -0,0 +1,127 @@
+/* Copyright (C) Xiang Wang - All Rights Reserved
+ * Unauthorized copying of this file, via any medium is strictly prohibited
+ * Proprietary and confidential
+ * Written by Xiang Wang <xwang1314@gmail.com>, August 2020
+ */
+
+package util
+
+import "github.com/aws/aws-sdk-go/service/ec2"
+import "github.com/aws/aws-sdk-go/aws"
+import "text/tabwriter"
+import "strings"
+import "bytes"
+import "fmt"
+
+
+// Reported for resources that AWS no longer knows about
+const StateNotFound = "not-found"
+
+// RunStatus is the live state of every resource recorded for a run.
+type RunStatus struct {
+    RunId     string           `json:"runId"`
+    Status    string           `json:"status"`
+    FleetIds  []string         `json:"fleetIds"`
+    Instances []InstanceStatus `json:"instances"`
+    Volumes   []VolumeStatus   `json:"volumes"`
+}
+
+type InstanceStatus struct {
+    Instance
+    State string `json:"state"`
+}
+
+type VolumeStatus struct {
+    Volume
+    State      string   `json:"state"`
+    AttachedTo []string `json:"attachedTo"`
+}
+
+// GetRunStatus describes the instances and volumes recorded in state.
+func (p *Provisioner) GetRunStatus(state *RunState) (*RunStatus, error) {
+    status := &RunStatus{RunId: state.RunId, Status: state.Status, FleetIds: state.FleetIds}
+
+    instanceStates := map[string]string{}
+    if ids := state.InstanceIds(); len(ids) > 0 {
+        // Filters, unlike InstanceIds, do not fail on instances that are long gone
+        input := &ec2.DescribeInstancesInput{
+            Filters: []*ec2.Filter{{Name: aws.String("instance-id"), Values: aws.StringSlice(ids)}},
+        }
+        for {
+            responseBody, err := p.client.DescribeInstances(input)
+            if err != nil {
+                return nil, newAWSError("Describe instances", err)
+            }
+            for _, reservation := range responseBody.Reservations {
+                for _, instance := range reservation.Instances {
+                    instanceStates[aws.StringValue(instance.InstanceId)] = aws.StringValue(instance.State.Name)
+                }
+            }
+            if aws.StringValue(responseBody.NextToken) == "" {
+                break
+            }
+            input.NextToken = responseBody.NextToken
+        }
+    }
+    for _, instance := range state.Instances {
+        instanceState, ok := instanceStates[instance.InstanceId]
+        if !ok {
+            instanceState = StateNotFound
+        }
+        status.Instances = append(status.Instances, InstanceStatus{Instance: instance, State: instanceState})
+    }
+
+    volumes := map[string]*ec2.Volume{}
+    if len(state.Volumes) > 0 {
+        ids := []string{}
+        for _, v := range state.Volumes {
+            ids = append(ids, v.VolumeId)
+        }
+        responseBody, err := p.client.DescribeVolumes(&ec2.DescribeVolumesInput{
+            Filters: []*ec2.Filter{{Name: aws.String("volume-id"), Values: aws.StringSlice(ids)}},
+        })
+        if err != nil {
+            return nil, newAWSError("Describe volumes", err)
+        }
+        for _, volume := range responseBody.Volumes {
+            volumes[aws.StringValue(volume.VolumeId)] = volume
+        }
+    }
+    for _, v := range state.Volumes {
+        volumeStatus := VolumeStatus{Volume: v, State: StateNotFound}
+        if volume, ok := volumes[v.VolumeId]; ok {
+            volumeStatus.State = aws.StringValue(volume.State)
+            for _, a := range volume.Attachments {
+                volumeStatus.AttachedTo = append(volumeStatus.AttachedTo, aws.StringValue(a.InstanceId))
+            }
+        }
+        status.Volumes = append(status.Volumes, volumeStatus)
+    }
+    return status, nil
+}
+
+// FormatRunStatus renders the run status as human-readable tables.
+func FormatRunStatus(status *RunStatus) string {
+    var buf bytes.Buffer
+    fmt.Fprintf(&buf, "Run %s: %s\n", status.RunId, status.Status)
+    if len(status.FleetIds) > 0 {
+        fmt.Fprintf(&buf, "Fleets: %s\n", strings.Join(status.FleetIds, ", "))
+    }
+
+    fmt.Fprintf(&buf, "\nInstances:\n")
+    w := tabwriter.NewWriter(&buf, 0, 4, 2, ' ', 0)
+    fmt.Fprintf(w, "  INSTANCE\tSTATE\tAZ\tSUBNET\tTYPE\n")
+    for _, i := range status.Instances {
+        fmt.Fprintf(w, "  %s\t%s\t%s\t%s\t%s\n", i.InstanceId, i.State, i.AvailabilityZone, i.SubnetId, i.InstanceType)
+    }
+    w.Flush()
+
+    fmt.Fprintf(&buf, "\nMulti-attach volumes:\n")
+    w = tabwriter.NewWriter(&buf, 0, 4, 2, ' ', 0)
+    fmt.Fprintf(w, "  VOLUME\tSTATE\tAZ\tATTACHED TO\n")
+    for _, v := range status.Volumes {
+        fmt.Fprintf(w, "  %s\t%s\t%s\t%s\n", v.VolumeId, v.State, v.AvailabilityZone, strings.Join(v.AttachedTo, ","))
+    }
+    w.Flush()
+    return buf.String()
+}
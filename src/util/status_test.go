@@ -0,0 +1,43 @@
+package util
+
+import "github.com/aws/aws-sdk-go/service/ec2"
+import "github.com/aws/aws-sdk-go/aws"
+import "strings"
+import "testing"
+
+
+func TestStatusRun(t *testing.T) {
+    fake := &fakeEC2{tagged: taggedResources{
+        Reservations: []*ec2.Reservation{
+            {Instances: []*ec2.Instance{
+                {InstanceId: aws.String("i-1"), State: &ec2.InstanceState{Name: aws.String("running")}},
+            }},
+        },
+        Volumes: []*ec2.Volume{
+            {
+                VolumeId: aws.String("vol-1"),
+                State:    aws.String("in-use"),
+                Attachments: []*ec2.VolumeAttachment{{InstanceId: aws.String("i-1")}},
+            },
+        },
+    }}
+    state := &RunState{
+        RunId:     "run-1",
+        Status:    StatusCreated,
+        Instances: []Instance{{InstanceId: "i-1"}, {InstanceId: "i-2"}},
+        Volumes:   []Volume{{VolumeId: "vol-1", AvailabilityZone: "us-east-1a"}},
+    }
+    status, err := NewProvisioner(fake).GetRunStatus(state)
+    if err != nil {
+        t.Fatalf("TestStatusRun failed: %v", err)
+    }
+    if status.Instances[0].State != "running" || status.Instances[1].State != StateNotFound {
+        t.Errorf("TestStatusRun instances %+v", status.Instances)
+    }
+    if status.Volumes[0].State != "in-use" || status.Volumes[0].AttachedTo[0] != "i-1" {
+        t.Errorf("TestStatusRun volumes %+v", status.Volumes)
+    }
+    if !strings.Contains(FormatRunStatus(status), "not-found") {
+        t.Errorf("TestStatusRun table:\n%s", FormatRunStatus(status))
+    }
+}
@@ -0,0 +1,214 @@
+/* Copyright (C) Xiang Wang - All Rights Reserved
+ * Unauthorized copying of this file, via any medium is strictly prohibited
+ * Proprietary and confidential
+ * Written by Xiang Wang <xwang1314@gmail.com>, August 2020
+ */
+
+package util
+
+import "github.com/aws/aws-sdk-go/service/ec2"
+import "github.com/aws/aws-sdk-go/aws"
+import "strings"
+import "sort"
+
+
+// Tag applied to every resource a run creates
+const RunIdTagKey = "ec2fleet:run-id"
+
+// Tag naming the shared volume a multi-attach volume is one of
+const SharedVolumeTagKey = "ec2fleet:shared-volume"
+
+// ParseTags parses tags given as key=value pairs, eg. team=storage,env=dev.
+func ParseTags(tagsStr string) (map[string]string, error) {
+    tags := map[string]string{}
+    if tagsStr == "" {
+        return tags, nil
+    }
+    for _, pair := range strings.Split(tagsStr, ",") {
+        kv := strings.SplitN(pair, "=", 2)
+        if len(kv) != 2 {
+            return nil, &ValidationError{Msg: "Invalid tag " + pair + ", must be key=value."}
+        }
+        tags[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+    }
+    return tags, ValidateTags(tags)
+}
+
+// ValidateTags checks the EC2 tag restrictions on user-defined tags.
+func ValidateTags(tags map[string]string) error {
+    // Two tags are reserved for the run ID and the shared volume name
+    if len(tags) > 48 {
+        return &ValidationError{Msg: "Too many tags, at most 48 are allowed."}
+    }
+    for key, value := range tags {
+        if key == "" {
+            return &ValidationError{Msg: "Tag key can not be empty."}
+        }
+        if len(key) > 128 || len(value) > 256 {
+            return &ValidationError{Msg: "Tag " + key + " is too long, keys are limited to 128 and values to 256 characters."}
+        }
+        if strings.HasPrefix(strings.ToLower(key), "aws:") || key == RunIdTagKey || key == SharedVolumeTagKey {
+            return &ValidationError{Msg: "Tag key " + key + " is reserved."}
+        }
+    }
+    return nil
+}
+
+// RunTags returns the user-defined tags plus the run ID tag.
+func RunTags(runId string, tags map[string]string) map[string]string {
+    all := map[string]string{RunIdTagKey: runId}
+    for key, value := range tags {
+        all[key] = value
+    }
+    return all
+}
+
+func getTags(tags map[string]string) []*ec2.Tag {
+    keys := []string{}
+    for key := range tags {
+        keys = append(keys, key)
+    }
+    sort.Strings(keys)
+    ec2Tags := []*ec2.Tag{}
+    for _, key := range keys {
+        ec2Tags = append(ec2Tags, &ec2.Tag{Key: aws.String(key), Value: aws.String(tags[key])})
+    }
+    return ec2Tags
+}
+
+// GetTagSpecifications applies tags to each resource type, or returns nil
+// when there are no tags.
+func GetTagSpecifications(tags map[string]string, resourceTypes ...string) []*ec2.TagSpecification {
+    if len(tags) == 0 {
+        return nil
+    }
+    specs := []*ec2.TagSpecification{}
+    for _, resourceType := range resourceTypes {
+        specs = append(specs, &ec2.TagSpecification{
+            ResourceType: aws.String(resourceType),
+            Tags:         getTags(tags),
+        })
+    }
+    return specs
+}
+
+func GetLaunchTemplateTagSpecifications(tags map[string]string, resourceTypes ...string) []*ec2.LaunchTemplateTagSpecificationRequest {
+    if len(tags) == 0 {
+        return nil
+    }
+    specs := []*ec2.LaunchTemplateTagSpecificationRequest{}
+    for _, resourceType := range resourceTypes {
+        specs = append(specs, &ec2.LaunchTemplateTagSpecificationRequest{
+            ResourceType: aws.String(resourceType),
+            Tags:         getTags(tags),
+        })
+    }
+    return specs
+}
+
+func runIdFilter(runId string) []*ec2.Filter {
+    return []*ec2.Filter{
+        {Name: aws.String("tag:" + RunIdTagKey), Values: aws.StringSlice([]string{runId})},
+    }
+}
+
+// FindRunResources looks up every live resource tagged with runId, for runs
+// whose state file is missing.
+func (p *Provisioner) FindRunResources(runId string) (*RunState, error) {
+    state := &RunState{RunId: runId}
+
+    templates, err := p.client.DescribeLaunchTemplates(&ec2.DescribeLaunchTemplatesInput{
+        Filters: runIdFilter(runId),
+    })
+    if err != nil {
+        return nil, newAWSError("Describe launch templates", err)
+    }
+    for _, template := range templates.LaunchTemplates {
+        state.LaunchTemplateId = aws.StringValue(template.LaunchTemplateId)
+    }
+
+    fleetsInput := &ec2.DescribeFleetsInput{}
+    for {
+        fleets, err := p.client.DescribeFleets(fleetsInput)
+        if err != nil {
+            return nil, newAWSError("Describe fleets", err)
+        }
+        // DescribeFleets can not filter by tag
+        for _, fleet := range fleets.Fleets {
+            for _, tag := range fleet.Tags {
+                if aws.StringValue(tag.Key) == RunIdTagKey && aws.StringValue(tag.Value) == runId &&
+                    aws.StringValue(fleet.FleetState) != ec2.FleetStateCodeDeleted {
+                    state.FleetIds = append(state.FleetIds, aws.StringValue(fleet.FleetId))
+                }
+            }
+        }
+        if aws.StringValue(fleets.NextToken) == "" {
+            break
+        }
+        fleetsInput.NextToken = fleets.NextToken
+    }
+
+    instancesInput := &ec2.DescribeInstancesInput{
+        Filters: append(runIdFilter(runId), &ec2.Filter{
+            Name:   aws.String("instance-state-name"),
+            Values: aws.StringSlice([]string{"pending", "running", "stopping", "stopped"}),
+        }),
+    }
+    for {
+        instances, err := p.client.DescribeInstances(instancesInput)
+        if err != nil {
+            return nil, newAWSError("Describe instances", err)
+        }
+        for _, reservation := range instances.Reservations {
+            for _, instance := range reservation.Instances {
+                state.Instances = append(state.Instances, Instance{
+                    InstanceId:       aws.StringValue(instance.InstanceId),
+                    InstanceType:     aws.StringValue(instance.InstanceType),
+                    AvailabilityZone: aws.StringValue(instance.Placement.AvailabilityZone),
+                    SubnetId:         aws.StringValue(instance.SubnetId),
+                    Lifecycle:        aws.StringValue(instance.InstanceLifecycle),
+                })
+            }
+        }
+        if aws.StringValue(instances.NextToken) == "" {
+            break
+        }
+        instancesInput.NextToken = instances.NextToken
+    }
+
+    volumes, err := p.client.DescribeVolumes(&ec2.DescribeVolumesInput{
+        Filters: runIdFilter(runId),
+    })
+    if err != nil {
+        return nil, newAWSError("Describe volumes", err)
+    }
+    for _, volume := range volumes.Volumes {
+        // Root volumes go away with their instance
+        if !aws.BoolValue(volume.MultiAttachEnabled) {
+            continue
+        }
+        volumeId := aws.StringValue(volume.VolumeId)
+        recovered := Volume{
+            VolumeId:         volumeId,
+            AvailabilityZone: aws.StringValue(volume.AvailabilityZone),
+            Size:             int(aws.Int64Value(volume.Size)),
+        }
+        for _, tag := range volume.Tags {
+            if aws.StringValue(tag.Key) == SharedVolumeTagKey {
+                recovered.Name = aws.StringValue(tag.Value)
+            }
+        }
+        if len(volume.Attachments) > 0 {
+            recovered.Device = aws.StringValue(volume.Attachments[0].Device)
+        }
+        state.Volumes = append(state.Volumes, recovered)
+        for _, a := range volume.Attachments {
+            state.Attachments = append(state.Attachments, Attachment{
+                InstanceId: aws.StringValue(a.InstanceId),
+                VolumeId:   volumeId,
+                Device:     aws.StringValue(a.Device),
+            })
+        }
+    }
+    return state, nil
+}
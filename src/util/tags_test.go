@@ -0,0 +1,64 @@
+package util
+
+import "github.com/aws/aws-sdk-go/service/ec2"
+import "github.com/aws/aws-sdk-go/aws"
+import "testing"
+
+
+func TestTagsParse(t *testing.T) {
+    tags, err := ParseTags("team=storage, env=dev")
+    if err != nil || len(tags) != 2 || tags["team"] != "storage" || tags["env"] != "dev" {
+        t.Errorf("TestTagsParse failed: %v %v", tags, err)
+    }
+    for _, invalid := range []string{"team", "=dev", "aws:name=x", RunIdTagKey + "=x"} {
+        if _, err := ParseTags(invalid); err == nil {
+            t.Errorf("TestTagsParse accepted %s", invalid)
+        }
+    }
+}
+
+func TestTagsOnVolume(t *testing.T) {
+    fake := &fakeEC2{}
+    p := NewProvisioner(fake)
+    p.CreateVolume(VolumeSpec{Size: 8}, "us-east-1a", RunTags("run-1", map[string]string{"team": "storage"}))
+    specs := fake.volumes[0].TagSpecifications
+    if len(specs) != 1 || *specs[0].ResourceType != ec2.ResourceTypeVolume || len(specs[0].Tags) != 2 {
+        t.Fatalf("TestTagsOnVolume failed: %v", specs)
+    }
+    if *specs[0].Tags[0].Key != RunIdTagKey || *specs[0].Tags[0].Value != "run-1" {
+        t.Errorf("TestTagsOnVolume missing run ID tag: %v", specs[0].Tags)
+    }
+}
+
+func TestTagsFindRunResources(t *testing.T) {
+    runTag := []*ec2.Tag{{Key: aws.String(RunIdTagKey), Value: aws.String("run-1")}}
+    fake := &fakeEC2{tagged: taggedResources{
+        Fleets: []*ec2.FleetData{
+            {FleetId: aws.String("fleet-1"), FleetState: aws.String("active"), Tags: runTag},
+            {FleetId: aws.String("fleet-2"), FleetState: aws.String("active")},
+        },
+        Reservations: []*ec2.Reservation{
+            {Instances: []*ec2.Instance{
+                {InstanceId: aws.String("i-1"), Placement: &ec2.Placement{AvailabilityZone: aws.String("us-east-1a")}},
+                {InstanceId: aws.String("i-2"), Placement: &ec2.Placement{AvailabilityZone: aws.String("us-east-1b")}},
+            }},
+        },
+        Volumes: []*ec2.Volume{
+            {
+                VolumeId:           aws.String("vol-1"),
+                MultiAttachEnabled: aws.Bool(true),
+                Attachments: []*ec2.VolumeAttachment{
+                    {InstanceId: aws.String("i-1"), Device: aws.String("/dev/sdf")},
+                },
+            },
+            {VolumeId: aws.String("vol-root"), MultiAttachEnabled: aws.Bool(false)},
+        },
+    }}
+    state, err := NewProvisioner(fake).FindRunResources("run-1")
+    if err != nil {
+        t.Fatalf("TestTagsFindRunResources failed: %v", err)
+    }
+    if len(state.FleetIds) != 1 || state.FleetIds[0] != "fleet-1" || len(state.Instances) != 2 || len(state.Volumes) != 1 || len(state.Attachments) != 1 {
+        t.Errorf("TestTagsFindRunResources found %+v", state)
+    }
+}
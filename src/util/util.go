@@ -10,70 +10,195 @@ import "github.com/aws/aws-sdk-go/service/ec2"
 import "github.com/aws/aws-sdk-go/aws/session"
 import "github.com/aws/aws-sdk-go/aws/awserr"
 import "github.com/aws/aws-sdk-go/aws"
-import "encoding/json"
-import "io/ioutil"
-import "errors"
 import "time"
 import "log"
 import "os"
 
 
-type Configs struct {
-    Nodes int `json:"nodes"`
-    AmiId string `json:"amiId"`
-    VolumeSize int `json:"volumeSize"`
-    Subnets []string `json:"subnets"`
-    SecurityGroups []string `json:"securityGroups"`
-    InstanceTypes []string `json:"instanceTypes"`
+// Multi-attach is only supported on Provisioned IOPS volumes
+const volumeTypeDefault = "io1"
+const volumeIopsDefault = 200
+
+// EC2API is the subset of the EC2 client used by the Provisioner.
+// *ec2.EC2 and ec2iface.EC2API both satisfy it.
+type EC2API interface {
+    CreateLaunchTemplate(*ec2.CreateLaunchTemplateInput) (*ec2.CreateLaunchTemplateOutput, error)
+    DeleteLaunchTemplate(*ec2.DeleteLaunchTemplateInput) (*ec2.DeleteLaunchTemplateOutput, error)
+    CreateLaunchTemplateVersion(*ec2.CreateLaunchTemplateVersionInput) (*ec2.CreateLaunchTemplateVersionOutput, error)
+    CreateFleet(*ec2.CreateFleetInput) (*ec2.CreateFleetOutput, error)
+    CreateVolume(*ec2.CreateVolumeInput) (*ec2.Volume, error)
+    AttachVolume(*ec2.AttachVolumeInput) (*ec2.VolumeAttachment, error)
+    DetachVolume(*ec2.DetachVolumeInput) (*ec2.VolumeAttachment, error)
+    DeleteVolume(*ec2.DeleteVolumeInput) (*ec2.DeleteVolumeOutput, error)
+    DescribeVolumes(*ec2.DescribeVolumesInput) (*ec2.DescribeVolumesOutput, error)
+    TerminateInstances(*ec2.TerminateInstancesInput) (*ec2.TerminateInstancesOutput, error)
+    DeleteFleets(*ec2.DeleteFleetsInput) (*ec2.DeleteFleetsOutput, error)
+    DescribeFleets(*ec2.DescribeFleetsInput) (*ec2.DescribeFleetsOutput, error)
+    DescribeInstances(*ec2.DescribeInstancesInput) (*ec2.DescribeInstancesOutput, error)
+    DescribeLaunchTemplates(*ec2.DescribeLaunchTemplatesInput) (*ec2.DescribeLaunchTemplatesOutput, error)
+    DescribeInstanceStatus(*ec2.DescribeInstanceStatusInput) (*ec2.DescribeInstanceStatusOutput, error)
+    DescribeSubnets(*ec2.DescribeSubnetsInput) (*ec2.DescribeSubnetsOutput, error)
 }
 
-func GetJsonObjectFromFile(filename string) Configs {
-    file, err := ioutil.ReadFile(filename)
-    if err != nil {
-        log.Fatal(err)
-        os.Exit(1)
+// Provisioner runs the EC2 operations needed to build a fleet
+// against a single client.
+type Provisioner struct {
+    client EC2API
+    // Wait between instance and volume status checks
+    pollInterval time.Duration
+    // Send every mutating call with DryRun: true and continue with placeholder IDs
+    DryRun bool
+    dryRunResults  []DryRunResult
+    placeholders   int
+    placeholderIds map[string]bool
+}
+
+func NewProvisioner(client EC2API) *Provisioner {
+    return &Provisioner{
+        client:       client,
+        pollInterval: 30 * time.Second,
     }
-    data := Configs{}
-    log.Println(string([]byte(file)))
-	_ = json.Unmarshal([]byte(file), &data)
-    return data
 }
 
+// NewDefaultProvisioner builds a Provisioner on one shared session
+// configured from the environment.
+func NewDefaultProvisioner() *Provisioner {
+    return NewProvisioner(ec2.New(session.New()))
+}
+
+// Configs holds every input of a run. Each field can be set in the config
+// file and on the command line under its json name, and in the environment
+// under its env name; see LoadConfigs. The yaml and toml tags repeat the
+// json name for the other config file formats.
+type Configs struct {
+    Nodes int `json:"nodes" yaml:"nodes" toml:"nodes" env:"NUMBER_OF_NODES"`
+    AmiId string `json:"amiId" yaml:"amiId" toml:"amiId" env:"AMI_ID"`
+    VolumeSize int `json:"volumeSize" yaml:"volumeSize" toml:"volumeSize" env:"VOLUME_SIZE"`
+    // The shared volumes, see volumes.go for the defaults
+    VolumeType string `json:"volumeType,omitempty" yaml:"volumeType" toml:"volumeType" env:"VOLUME_TYPE"`
+    VolumeIops int `json:"volumeIops,omitempty" yaml:"volumeIops" toml:"volumeIops" env:"VOLUME_IOPS"`
+    VolumeEncrypted bool `json:"volumeEncrypted,omitempty" yaml:"volumeEncrypted" toml:"volumeEncrypted" env:"VOLUME_ENCRYPTED"`
+    VolumeKmsKeyId string `json:"volumeKmsKeyId,omitempty" yaml:"volumeKmsKeyId" toml:"volumeKmsKeyId" env:"VOLUME_KMS_KEY_ID"`
+    // Several named shared volumes instead of the one above
+    SharedVolumes []VolumeSpec `json:"sharedVolumes,omitempty" yaml:"sharedVolumes" toml:"sharedVolumes" env:"SHARED_VOLUMES"`
+    Subnets []string `json:"subnets" yaml:"subnets" toml:"subnets" env:"SUBNET_IDS"`
+    SecurityGroups []string `json:"securityGroups" yaml:"securityGroups" toml:"securityGroups" env:"SECURITY_GROUP_IDS"`
+    InstanceTypes []string `json:"instanceTypes" yaml:"instanceTypes" toml:"instanceTypes" env:"INSTANCE_TYPES"`
+    Tags map[string]string `json:"tags" yaml:"tags" toml:"tags" env:"TAGS"`
+    // Replaces nodes, subnets and instanceTypes when set
+    NodeGroups []NodeGroup `json:"nodeGroups,omitempty" yaml:"nodeGroups" toml:"nodeGroups" env:"NODE_GROUPS"`
+    // One of the Distribution strategies
+    Distribution string `json:"distribution,omitempty" yaml:"distribution" toml:"distribution" env:"DISTRIBUTION"`
+    SubnetWeights map[string]int `json:"subnetWeights,omitempty" yaml:"subnetWeights" toml:"subnetWeights" env:"SUBNET_WEIGHTS"`
+    // AZ of each subnet, for a plan that does not look them up
+    SubnetZones map[string]string `json:"subnetZones,omitempty" yaml:"subnetZones" toml:"subnetZones" env:"SUBNET_ZONES"`
+    // Purchasing options; empty strings take the defaults in purchasing.go
+    OnDemandPercentage int `json:"onDemandPercentage" yaml:"onDemandPercentage" toml:"onDemandPercentage" env:"ON_DEMAND_PERCENTAGE"`
+    // Replaces onDemandPercentage when set
+    OnDemandCount *int `json:"onDemandCount,omitempty" yaml:"onDemandCount" toml:"onDemandCount" env:"ON_DEMAND_COUNT"`
+    SpotAllocationStrategy string `json:"spotAllocationStrategy,omitempty" yaml:"spotAllocationStrategy" toml:"spotAllocationStrategy" env:"SPOT_ALLOCATION_STRATEGY"`
+    OnDemandAllocationStrategy string `json:"onDemandAllocationStrategy,omitempty" yaml:"onDemandAllocationStrategy" toml:"onDemandAllocationStrategy" env:"ON_DEMAND_ALLOCATION_STRATEGY"`
+    // Per instance, in USD per hour
+    MaxSpotPrice string `json:"maxSpotPrice,omitempty" yaml:"maxSpotPrice" toml:"maxSpotPrice" env:"MAX_SPOT_PRICE"`
+    FleetType string `json:"fleetType,omitempty" yaml:"fleetType" toml:"fleetType" env:"FLEET_TYPE"`
+    DefaultCapacityType string `json:"defaultCapacityType,omitempty" yaml:"defaultCapacityType" toml:"defaultCapacityType" env:"DEFAULT_CAPACITY_TYPE"`
+    // What to do when an instant fleet launches less than its target
+    // capacity; one of the PartialFulfillment policies
+    PartialFulfillment string `json:"partialFulfillment,omitempty" yaml:"partialFulfillment" toml:"partialFulfillment" env:"PARTIAL_FULFILLMENT"`
+    // 0 is the whole target capacity
+    MinTargetCapacity int `json:"minTargetCapacity,omitempty" yaml:"minTargetCapacity" toml:"minTargetCapacity" env:"MIN_TARGET_CAPACITY"`
+    // Tried in order for the missing capacity when EC2 runs out of it
+    FallbackInstanceTypes []string `json:"fallbackInstanceTypes,omitempty" yaml:"fallbackInstanceTypes" toml:"fallbackInstanceTypes" env:"FALLBACK_INSTANCE_TYPES"`
+    // Subnets in other AZs
+    FallbackSubnets []string `json:"fallbackSubnets,omitempty" yaml:"fallbackSubnets" toml:"fallbackSubnets" env:"FALLBACK_SUBNETS"`
+    FallbackOnDemand bool `json:"fallbackOnDemand,omitempty" yaml:"fallbackOnDemand" toml:"fallbackOnDemand" env:"FALLBACK_ON_DEMAND"`
+    // Launch template options, see launchtemplate.go
+    KeyName string `json:"keyName,omitempty" yaml:"keyName" toml:"keyName" env:"KEY_NAME"`
+    // Name or ARN
+    IamInstanceProfile string `json:"iamInstanceProfile,omitempty" yaml:"iamInstanceProfile" toml:"iamInstanceProfile" env:"IAM_INSTANCE_PROFILE"`
+    // Read and base64 encoded when the launch template is created
+    UserDataFile string `json:"userDataFile,omitempty" yaml:"userDataFile" toml:"userDataFile" env:"USER_DATA_FILE"`
+    RequireImdsv2 bool `json:"requireImdsv2,omitempty" yaml:"requireImdsv2" toml:"requireImdsv2" env:"REQUIRE_IMDSV2"`
+    DetailedMonitoring bool `json:"detailedMonitoring,omitempty" yaml:"detailedMonitoring" toml:"detailedMonitoring" env:"DETAILED_MONITORING"`
+    EbsOptimized bool `json:"ebsOptimized,omitempty" yaml:"ebsOptimized" toml:"ebsOptimized" env:"EBS_OPTIMIZED"`
+    // Root and data volumes of every instance, see blockdevices.go
+    BlockDevices *BlockDevices `json:"blockDevices,omitempty" yaml:"blockDevices" toml:"blockDevices" env:"BLOCK_DEVICES"`
+    // An existing launch template, by ID or name, used as is instead of
+    // creating one for the run
+    LaunchTemplateId string `json:"launchTemplateId,omitempty" yaml:"launchTemplateId" toml:"launchTemplateId" env:"LAUNCH_TEMPLATE_ID"`
+    LaunchTemplateName string `json:"launchTemplateName,omitempty" yaml:"launchTemplateName" toml:"launchTemplateName" env:"LAUNCH_TEMPLATE_NAME"`
+    // A version number, $Latest or $Default
+    LaunchTemplateVersion string `json:"launchTemplateVersion,omitempty" yaml:"launchTemplateVersion" toml:"launchTemplateVersion" env:"LAUNCH_TEMPLATE_VERSION"`
+}
+
+// GetJsonObjectFromFile strictly decodes a JSON config file; see
+// LoadConfigs for the layered inputs.
+func GetJsonObjectFromFile(filename string) (Configs, error) {
+    data, _, err := readConfigFile(ConfigFile{Name: filename, Format: ConfigFormatJSON}, os.Getenv)
+    return data, err
+}
+
+// ValidateInputs checks the fleet inputs and reports every problem found,
+// not just the first one.
 func ValidateInputs(nodes, volumeSize int, subnets, securityGroups, instanceTypes []string) error {
+    return validateInputs(nodes, []VolumeSpec{{Size: volumeSize}}, subnets, securityGroups, instanceTypes, false, true).errOrNil()
+}
+
+// validateInputs is ValidateInputs, without requiring security groups when an
+// existing launch template brings them. Listed nodes take one subnet and
+// instance type each; with a distribution strategy the subnets are candidates
+// and the instance types are taken in turn.
+func validateInputs(nodes int, volumes []VolumeSpec, subnets, securityGroups, instanceTypes []string, existingTemplate, listed bool) ValidationErrors {
+    errs := ValidationErrors{}
     if nodes <= 0 {
-        return errors.New("Number of nodes is invalid.")
+        errs = append(errs, &ValidationError{Msg: "Number of nodes is invalid."})
     }
-    if volumeSize < 4 || volumeSize > 16384 {
-        return errors.New("Invalid volume size, must be between 4-16384 Gib inclusively.")
+    errs = append(errs, validateShared(volumes, securityGroups, existingTemplate)...)
+    if containsEmpty(subnets) {
+        errs = append(errs, &ValidationError{Msg: "Subnet can not be empty."})
     }
-    for _, sub := range subnets {
-        if sub == "" {
-            return errors.New("Subnet can not be empty.")
-        }
+    if containsEmpty(instanceTypes) {
+        errs = append(errs, &ValidationError{Msg: "Instance type can not be empty."})
     }
-    if len(securityGroups) == 0 {
-        return errors.New("Need at least one security group.")
+    if nodes > 0 && listed && (len(subnets) != nodes || len(instanceTypes) != nodes) {
+        errs = append(errs, &ValidationError{Msg: "Number of subnets and instanceTypes must equal to number of nodes."})
     }
-    for _, sg := range securityGroups {
-        if sg == "" {
-            return errors.New("Security group can not be empty.")
-        }
+    if nodes > 0 && !listed && (len(subnets) == 0 || len(instanceTypes) == 0) {
+        errs = append(errs, &ValidationError{Msg: "Need at least one subnet and one instance type."})
     }
-    for _, it := range instanceTypes {
-        if it == "" {
-            return errors.New("Instance type can not be empty.")
-        }
+    return errs
+}
+
+// validateShared checks the inputs that do not depend on how the nodes are
+// described. An existing launch template brings its own security groups.
+func validateShared(volumes []VolumeSpec, securityGroups []string, existingTemplate bool) ValidationErrors {
+    errs := ValidationErrors{}
+    for _, volume := range volumes {
+        errs = append(errs, validateVolume(volume)...)
+    }
+    if len(securityGroups) == 0 && !existingTemplate {
+        errs = append(errs, &ValidationError{Msg: "Need at least one security group."})
     }
-    if  len(subnets) != nodes || len(instanceTypes) != nodes {
-        return errors.New("Number of subnets and instanceTypes must equal to number of nodes.")
+    if containsEmpty(securityGroups) {
+        errs = append(errs, &ValidationError{Msg: "Security group can not be empty."})
     }
-    return nil
+    return errs
+}
+
+func containsEmpty(values []string) bool {
+    for _, value := range values {
+        if value == "" {
+            return true
+        }
+    }
+    return false
 }
 
 func GetCreateLaunchTemplateInput(templateName string,
                                   amiId string,
                                   instanceTypeDefault string,
-                                  securityGroups []string) *ec2.CreateLaunchTemplateInput {
+                                  securityGroups []string,
+                                  tags map[string]string) *ec2.CreateLaunchTemplateInput {
     secGroups := []*string{}
     for i := range securityGroups {
         secGroups = append(secGroups, &securityGroups[i])
@@ -83,218 +208,354 @@ func GetCreateLaunchTemplateInput(templateName string,
             ImageId:        aws.String(amiId),
             InstanceType:   aws.String(instanceTypeDefault),
             SecurityGroupIds: secGroups,
-            Placement: &ec2.LaunchTemplatePlacementRequest {
-                // TODO: remove this hardcoded az
-                AvailabilityZone: aws.String("us-east-1a"),
-            },
+            // Root volumes; instances are tagged by the fleet
+            TagSpecifications: GetLaunchTemplateTagSpecifications(tags, ec2.ResourceTypeVolume),
         },
         LaunchTemplateName: aws.String(templateName),
+        TagSpecifications:  GetTagSpecifications(tags, ec2.ResourceTypeLaunchTemplate),
     }
     return input
 }
 
-func CreateLaunchTemplate(input *ec2.CreateLaunchTemplateInput) *ec2.CreateLaunchTemplateOutput {
-    svc := ec2.New(session.New())
-    responseBody, err := svc.CreateLaunchTemplate(input)
+func (p *Provisioner) CreateLaunchTemplate(input *ec2.CreateLaunchTemplateInput) (*ec2.CreateLaunchTemplateOutput, error) {
+    input.DryRun = aws.Bool(p.DryRun)
+    responseBody, err := p.client.CreateLaunchTemplate(input)
+    if p.DryRun {
+        p.recordDryRun("Create Launch Template", err)
+        return &ec2.CreateLaunchTemplateOutput{
+            LaunchTemplate: &ec2.LaunchTemplate{LaunchTemplateId: aws.String(p.placeholderId("lt"))},
+        }, nil
+    }
     if err != nil {
         log.Println("Create Launch Template error:")
         if aerr, ok := err.(awserr.Error); ok {
-            switch aerr.Code() {
-            case "DryRunOperation":
-                log.Println("Create Launch Template DryRun succeeded.")
-            default:
-                log.Println("Create Launch Template status code: ", aerr.Code())
-                log.Fatal(aerr.Error())
-            }
-        } else {
-            log.Fatal(err.Error())
+            log.Println("Create Launch Template status code: ", aerr.Code())
         }
-        os.Exit(1)
+        return nil, newAWSError("Create Launch Template", err)
     }
     log.Println("Launch Template created successfully:\n", responseBody)
-    return responseBody
+    return responseBody, nil
 }
 
-func DeleteLaunchTemplate(templateId string) *ec2.DeleteLaunchTemplateOutput {
-    svc := ec2.New(session.New())
+func (p *Provisioner) DeleteLaunchTemplate(templateId string) (*ec2.DeleteLaunchTemplateOutput, error) {
     input := &ec2.DeleteLaunchTemplateInput {
+        DryRun:           aws.Bool(p.DryRun),
         LaunchTemplateId: aws.String(templateId),
     }
-    responseBody, err := svc.DeleteLaunchTemplate(input)
+    responseBody, err := p.client.DeleteLaunchTemplate(input)
+    if p.DryRun {
+        p.recordDryRun("Delete Launch Template", err, templateId)
+        return &ec2.DeleteLaunchTemplateOutput{}, nil
+    }
     if err != nil {
         log.Println("Delete Launch Template error:")
         if aerr, ok := err.(awserr.Error); ok {
-            switch aerr.Code() {
-            default:
-                log.Println("Delete Launch Template status code: ", aerr.Code())
-                log.Fatal(aerr.Error())
-            }
-        } else {
-            log.Fatal(err.Error())
+            log.Println("Delete Launch Template status code: ", aerr.Code())
         }
-        os.Exit(1)
+        return nil, newAWSError("Delete Launch Template", err)
     }
     log.Println("Launch template", templateId, "was delete successfully.")
-    return responseBody
+    return responseBody, nil
 }
 
-func GetCreateFleetRequestInput(nodes int64,
-                                launchTemplateId string,
-                                subnets []string,
-                                instanceTypes []string,
-                                availabilityZones []string,
-                                onDemandPercentage int64) *ec2.CreateFleetInput {
-    onDemand := onDemandPercentage*nodes/100
-    spot := nodes - onDemand
+// GetCreateFleetRequestInput builds a fleet with one override per node and
+// the purchasing options of configs. A node with a weight counts for that
+// many capacity units.
+func GetCreateFleetRequestInput(nodes []FleetNode,
+                                template LaunchTemplateRef,
+                                subnetZones map[string]string,
+                                configs Configs,
+                                tags map[string]string) *ec2.CreateFleetInput {
+    capacity := int64(0)
     overrides := []*ec2.FleetLaunchTemplateOverridesRequest {}
-    size := int(nodes)
-    for i := 0; i < size; i++ {
-        az := availabilityZones[0]
-        if i >= size/2 {
-            az = availabilityZones[1]
+    for _, node := range nodes {
+        // Each node is placed in the AZ of its own subnet
+        override := &ec2.FleetLaunchTemplateOverridesRequest {
+            AvailabilityZone: aws.String(subnetZones[node.SubnetId]),
+            InstanceType: aws.String(node.InstanceType),
+            SubnetId: aws.String(node.SubnetId),
+        }
+        if node.Weight > 0 {
+            override.WeightedCapacity = aws.Float64(float64(node.Weight))
+        }
+        if configs.MaxSpotPrice != "" {
+            override.MaxPrice = aws.String(configs.MaxSpotPrice)
         }
-        overrides = append(overrides, &ec2.FleetLaunchTemplateOverridesRequest {
-            AvailabilityZone: aws.String(az),
-            InstanceType: aws.String(instanceTypes[i]),
-            SubnetId: aws.String(subnets[i]),
-        })
+        overrides = append(overrides, override)
+        capacity += int64(node.Capacity())
     }
+    onDemand := configs.onDemandCapacity(capacity)
+    spot := capacity - onDemand
 
+    fleetType := configs.FleetTypeOrDefault()
+    // Only instant fleets can tag their instances, the others tag them
+    // through the launch template
+    tagTypes := []string{ec2.ResourceTypeFleet}
+    if fleetType == ec2.FleetTypeInstant {
+        tagTypes = append(tagTypes, ec2.ResourceTypeInstance)
+    }
     input := &ec2.CreateFleetInput {
-        // TODO: add DryRun option for testing
-        // DryRun: aws.Bool(true),
         LaunchTemplateConfigs: []*ec2.FleetLaunchTemplateConfigRequest {
             {
-                LaunchTemplateSpecification: &ec2.FleetLaunchTemplateSpecificationRequest {
-                    LaunchTemplateId: aws.String(launchTemplateId),
-                    Version: aws.String("1"),
-                },
+                LaunchTemplateSpecification: template.specification(),
                 Overrides: overrides,
             },
         },
         SpotOptions: &ec2.SpotOptionsRequest {
-            AllocationStrategy: aws.String("diversified"),
+            AllocationStrategy: aws.String(orDefault(configs.SpotAllocationStrategy, SpotAllocationDefault)),
         },
-        Type: aws.String("instant"),
+        Type: aws.String(fleetType),
+        TagSpecifications: GetTagSpecifications(tags, tagTypes...),
         TargetCapacitySpecification: &ec2.TargetCapacitySpecificationRequest {
             OnDemandTargetCapacity: aws.Int64(onDemand),
             SpotTargetCapacity: aws.Int64(spot),
-            TotalTargetCapacity: aws.Int64(nodes),
-            DefaultTargetCapacityType: aws.String("spot"),
+            TotalTargetCapacity: aws.Int64(capacity),
+            DefaultTargetCapacityType: aws.String(orDefault(configs.DefaultCapacityType, DefaultCapacityTypeDefault)),
         },
     }
+    if configs.OnDemandAllocationStrategy != "" {
+        input.OnDemandOptions = &ec2.OnDemandOptionsRequest {
+            AllocationStrategy: aws.String(configs.OnDemandAllocationStrategy),
+        }
+    }
     return input
 }
 
-func CreateFleet(requestBody *ec2.CreateFleetInput) (*ec2.CreateFleetOutput, error) {
-    svc := ec2.New(session.New())
-    responseBody, err := svc.CreateFleet(requestBody)
+func (p *Provisioner) CreateFleet(requestBody *ec2.CreateFleetInput) (*ec2.CreateFleetOutput, error) {
+    requestBody.DryRun = aws.Bool(p.DryRun)
+    responseBody, err := p.client.CreateFleet(requestBody)
+    if p.DryRun {
+        template := requestBody.LaunchTemplateConfigs[0].LaunchTemplateSpecification
+        p.recordDryRun("Create Fleet", err, aws.StringValue(template.LaunchTemplateId))
+        return p.dryRunFleet(requestBody), nil
+    }
     if err != nil {
         log.Println("Create Fleet error:")
         if aerr, ok := err.(awserr.Error); ok {
-            switch aerr.Code() {
-            case "DryRunOperation":
-                log.Println("Create Fleet DryRun succeeded.")
-            default:
-                log.Println("Create Fleet status code: ", aerr.Code())
-                log.Fatal(aerr.Error())
-            }
-        } else {
-            log.Fatal(err.Error())
+            log.Println("Create Fleet status code: ", aerr.Code())
         }
+        return nil, newAWSError("Create Fleet", err)
     }
     log.Println("EC2 fleet created successfully:", responseBody)
-    return responseBody, err
+    return responseBody, nil
 }
 
-func CreateVolume(vSize int64, aZone string) *ec2.Volume {
-    svc := ec2.New(session.New())
-    input := &ec2.CreateVolumeInput {
-        Size:               aws.Int64(vSize),
-        Iops:               aws.Int64(200),
-        VolumeType:         aws.String("io1"),
-        AvailabilityZone:   aws.String(aZone),
-        MultiAttachEnabled: aws.Bool(true),
-    }
-    responseBody, err := svc.CreateVolume(input)
+func (p *Provisioner) CreateVolume(spec VolumeSpec, aZone string, tags map[string]string) (*ec2.Volume, error) {
+    input := spec.createVolumeInput(aZone)
+    input.DryRun = aws.Bool(p.DryRun)
+    if spec.Name != "" {
+        named := map[string]string{SharedVolumeTagKey: spec.Name}
+        for key, value := range tags {
+            named[key] = value
+        }
+        tags = named
+    }
+    input.TagSpecifications = GetTagSpecifications(tags, ec2.ResourceTypeVolume)
+    responseBody, err := p.client.CreateVolume(input)
+    if p.DryRun {
+        p.recordDryRun("Create volume", err)
+        return &ec2.Volume{VolumeId: aws.String(p.placeholderId("vol")), AvailabilityZone: aws.String(aZone)}, nil
+    }
     if err != nil {
         log.Println("Create volume error:")
         if aerr, ok := err.(awserr.Error); ok {
-            switch aerr.Code() {
-            case "DryRunOperation":
-                log.Println("Create volume DryRun succeeded.")
-            default:
-                log.Println("Create volume status code: ", aerr.Code())
-                log.Fatal(aerr.Error())
-            }
-        } else {
-            log.Fatal(err.Error())
+            log.Println("Create volume status code: ", aerr.Code())
         }
-        os.Exit(1)
+        return nil, newAWSError("Create volume", err)
     }
     log.Println("Created volume in", aZone," successfully.")
-    return responseBody
+    return responseBody, nil
 }
 
-func AttachVolume(instanceId, volumeId string) *ec2.VolumeAttachment {
-    svc := ec2.New(session.New())
+func (p *Provisioner) AttachVolume(instanceId, volumeId, device string) (*ec2.VolumeAttachment, error) {
     input := &ec2.AttachVolumeInput {
-        Device:     aws.String("/dev/sdf"),
+        DryRun:     aws.Bool(p.DryRun),
+        Device:     aws.String(device),
         InstanceId: aws.String(instanceId),
         VolumeId:   aws.String(volumeId),
     }
+    if p.DryRun {
+        // Placeholder instances never run
+        _, err := p.client.AttachVolume(input)
+        p.recordDryRun("Attach volume", err, instanceId, volumeId)
+        return &ec2.VolumeAttachment{Device: input.Device, InstanceId: input.InstanceId, VolumeId: input.VolumeId}, nil
+    }
     // Check for instance status for 180 seconds or 3 mins
+    running := false
     for i := 0; i < 6; i++ {
-        if GetInstanceStatus(instanceId) == "running" {
+        status, err := p.GetInstanceStatus(instanceId)
+        if err != nil {
+            return nil, err
+        }
+        if status == "running" {
+            running = true
             break
         }
-        log.Println("Checking instance status before attaching volume. Sleep 30 seconds...")
-        time.Sleep(30 * time.Second)
+        log.Println("Checking instance status before attaching volume. Sleep", p.pollInterval, "...")
+        time.Sleep(p.pollInterval)
+    }
+    if !running {
+        return nil, &TimeoutError{Op: "Waiting for instance " + instanceId + " to run", Waited: 6 * p.pollInterval}
     }
-    responseBody, err := svc.AttachVolume(input)
+    responseBody, err := p.client.AttachVolume(input)
     if err != nil {
         log.Println("Attach volume error:")
         if aerr, ok := err.(awserr.Error); ok {
-            switch aerr.Code() {
-            default:
-                log.Println("Attach volume status code: ", aerr.Code())
-                log.Fatal(aerr.Error())
-            }
-        } else {
-            log.Fatal(err.Error())
+            log.Println("Attach volume status code: ", aerr.Code())
         }
-        os.Exit(1)
+        return nil, newAWSError("Attach volume", err)
     }
     log.Println("Volume attached successfully.")
-    return responseBody
+    return responseBody, nil
+}
+
+func (p *Provisioner) DetachVolume(instanceId, volumeId string) (*ec2.VolumeAttachment, error) {
+    input := &ec2.DetachVolumeInput {
+        InstanceId: aws.String(instanceId),
+        VolumeId:   aws.String(volumeId),
+    }
+    responseBody, err := p.client.DetachVolume(input)
+    if err != nil {
+        log.Println("Detach volume error:")
+        if aerr, ok := err.(awserr.Error); ok {
+            log.Println("Detach volume status code: ", aerr.Code())
+        }
+        return nil, newAWSError("Detach volume", err)
+    }
+    log.Println("Volume", volumeId, "detached from", instanceId, "successfully.")
+    return responseBody, nil
+}
+
+// DeleteVolume waits for the volume to be detached from every instance
+// and then deletes it.
+func (p *Provisioner) DeleteVolume(volumeId string) (*ec2.DeleteVolumeOutput, error) {
+    if err := p.WaitForVolumeState(volumeId, "available"); err != nil {
+        return nil, err
+    }
+    input := &ec2.DeleteVolumeInput {
+        VolumeId: aws.String(volumeId),
+    }
+    responseBody, err := p.client.DeleteVolume(input)
+    if err != nil {
+        log.Println("Delete volume error:")
+        if aerr, ok := err.(awserr.Error); ok {
+            log.Println("Delete volume status code: ", aerr.Code())
+        }
+        return nil, newAWSError("Delete volume", err)
+    }
+    log.Println("Volume", volumeId, "was deleted successfully.")
+    return responseBody, nil
 }
 
-func GetInstanceStatus(instanceId string) string{
-    svc := ec2.New(session.New())
+// WaitForVolumeState checks the volume state for 180 seconds or 3 mins.
+func (p *Provisioner) WaitForVolumeState(volumeId, state string) error {
+    input := &ec2.DescribeVolumesInput {
+        VolumeIds: []*string{
+            aws.String(volumeId),
+        },
+    }
+    for i := 0; i < 6; i++ {
+        responseBody, err := p.client.DescribeVolumes(input)
+        if err != nil {
+            return newAWSError("Describe volumes", err)
+        }
+        if len(responseBody.Volumes) > 0 && *responseBody.Volumes[0].State == state {
+            return nil
+        }
+        log.Println("Waiting for volume", volumeId, "to be", state, ". Sleep", p.pollInterval, "...")
+        time.Sleep(p.pollInterval)
+    }
+    return &TimeoutError{Op: "Waiting for volume " + volumeId + " to be " + state, Waited: 6 * p.pollInterval}
+}
+
+func (p *Provisioner) TerminateInstances(instanceIds []string) (*ec2.TerminateInstancesOutput, error) {
+    input := &ec2.TerminateInstancesInput {
+        InstanceIds: aws.StringSlice(instanceIds),
+    }
+    responseBody, err := p.client.TerminateInstances(input)
+    if err != nil {
+        log.Println("Terminate instances error:")
+        if aerr, ok := err.(awserr.Error); ok {
+            log.Println("Terminate instances status code: ", aerr.Code())
+        }
+        return nil, newAWSError("Terminate instances", err)
+    }
+    log.Println("Instances", instanceIds, "are terminating.")
+    return responseBody, nil
+}
+
+// DeleteFleets deletes the fleets and terminates their instances, which
+// AWS requires for instant fleets.
+func (p *Provisioner) DeleteFleets(fleetIds []string) (*ec2.DeleteFleetsOutput, error) {
+    input := &ec2.DeleteFleetsInput {
+        FleetIds:           aws.StringSlice(fleetIds),
+        TerminateInstances: aws.Bool(true),
+    }
+    responseBody, err := p.client.DeleteFleets(input)
+    if err != nil {
+        log.Println("Delete fleets error:")
+        if aerr, ok := err.(awserr.Error); ok {
+            log.Println("Delete fleets status code: ", aerr.Code())
+        }
+        return nil, newAWSError("Delete fleets", err)
+    }
+    log.Println("Fleets", fleetIds, "were deleted successfully.")
+    return responseBody, nil
+}
+
+func (p *Provisioner) GetInstanceStatus(instanceId string) (string, error) {
     input := &ec2.DescribeInstanceStatusInput{
         InstanceIds: []*string{
             aws.String(instanceId),
         },
     }
     log.Println("GetInstanceStatus for instance ID:", instanceId)
-    responseBody, err := svc.DescribeInstanceStatus(input)
+    responseBody, err := p.client.DescribeInstanceStatus(input)
     if err != nil {
         log.Println("GetInstanceStatus error:")
         if aerr, ok := err.(awserr.Error); ok {
-            switch aerr.Code() {
-            default:
-                log.Println("GetInstanceStatus status code: ", aerr.Code())
-                log.Fatal(aerr.Error())
-            }
-        } else {
-            log.Fatal(err.Error())
+            log.Println("GetInstanceStatus status code: ", aerr.Code())
         }
-        return ""
+        return "", newAWSError("GetInstanceStatus", err)
     }
     log.Println("GetInstanceStatus successfully.", responseBody)
     if len(responseBody.InstanceStatuses) > 0 {
-        return *responseBody.InstanceStatuses[0].InstanceState.Name
+        return *responseBody.InstanceStatuses[0].InstanceState.Name, nil
     }else {
-        return ""
+        return "", nil
+    }
+}
+
+// GetSubnetAvailabilityZones maps every subnet to the AZ it lives in.
+func (p *Provisioner) GetSubnetAvailabilityZones(subnets []string) (map[string]string, error) {
+    unique := []string{}
+    seen := map[string]bool{}
+    for _, subnet := range subnets {
+        if !seen[subnet] {
+            seen[subnet] = true
+            unique = append(unique, subnet)
+        }
+    }
+    input := &ec2.DescribeSubnetsInput{
+        SubnetIds: aws.StringSlice(unique),
+    }
+    responseBody, err := p.client.DescribeSubnets(input)
+    if err != nil {
+        log.Println("DescribeSubnets error:")
+        if aerr, ok := err.(awserr.Error); ok {
+            log.Println("DescribeSubnets status code: ", aerr.Code())
+        }
+        return nil, newAWSError("DescribeSubnets", err)
+    }
+    subnetZones := map[string]string{}
+    for _, subnet := range responseBody.Subnets {
+        subnetZones[*subnet.SubnetId] = *subnet.AvailabilityZone
+    }
+    for _, subnet := range unique {
+        if _, ok := subnetZones[subnet]; !ok {
+            return nil, &ValidationError{Msg: "Subnet " + subnet + " was not found."}
+        }
     }
+    log.Println("Subnet availability zones:", subnetZones)
+    return subnetZones, nil
 }
@@ -0,0 +1,216 @@
+/* Copyright (C) Xiang Wang - All Rights Reserved
+ * Unauthorized copying of this file, via any medium is strictly prohibited
+ * Proprietary and confidential
+ * Written by Xiang Wang <xwang1314@gmail.com>, August 2020
+ */
+
+package util
+
+import "github.com/aws/aws-sdk-go/service/ec2"
+import "github.com/aws/aws-sdk-go/aws"
+import "strings"
+import "regexp"
+import "fmt"
+
+
+var (
+    // A KMS key ID, alias or ARN of either
+    kmsKeyId         = regexp.MustCompile(`^([0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}|mrk-[0-9a-f]{32}|alias/[\w/-]+|arn:aws[a-z-]*:kms:[a-z0-9-]+:\d{12}:(key|alias)/[\w/-]+)$`)
+    sharedVolumeName = regexp.MustCompile(`^[\w-]{1,64}$`)
+)
+
+// Shared volumes are attached at /dev/sdf to /dev/sdp, the device names AWS
+// recommends for EBS data volumes, in the order they are defined.
+const sharedVolumeDeviceLetters = "fghijklmnop"
+
+// VolumeSpec describes a shared multi-attach volume. Zero values take the
+// defaults, an io1 volume with 200 IOPS.
+type VolumeSpec struct {
+    // Tells the shared volumes apart, eg. data or log; empty for the one
+    // described by volumeSize and friends
+    Name      string `json:"name,omitempty" yaml:"name" toml:"name"`
+    // GiB
+    Size      int    `json:"size" yaml:"size" toml:"size"`
+    Type      string `json:"type,omitempty" yaml:"type" toml:"type"`
+    Iops      int    `json:"iops,omitempty" yaml:"iops" toml:"iops"`
+    Encrypted bool   `json:"encrypted,omitempty" yaml:"encrypted" toml:"encrypted"`
+    // Implies Encrypted
+    KmsKeyId  string `json:"kmsKeyId,omitempty" yaml:"kmsKeyId" toml:"kmsKeyId"`
+    // Allocated by VolumeSpecs, see AllocateDevices
+    Device    string `json:"-" yaml:"-" toml:"-"`
+}
+
+// withDefaults fills in the type and IOPS of s.
+func (s VolumeSpec) withDefaults() VolumeSpec {
+    s.Type = orDefault(s.Type, volumeTypeDefault)
+    if s.Iops == 0 {
+        s.Iops = volumeIopsDefault
+    }
+    s.Encrypted = s.Encrypted || s.KmsKeyId != ""
+    return s
+}
+
+// String describes s in one line, eg. "4 GiB io1, 200 iops, encrypted".
+func (s VolumeSpec) String() string {
+    s = s.withDefaults()
+    description := fmt.Sprintf("%d GiB %s, %d iops", s.Size, s.Type, s.Iops)
+    if s.KmsKeyId != "" {
+        description += ", encrypted with " + s.KmsKeyId
+    } else if s.Encrypted {
+        description += ", encrypted"
+    }
+    return description
+}
+
+// SharedVolume is the spec of the single shared multi-attach volume described
+// by volumeSize, volumeType, volumeIops and the encryption settings.
+func (c Configs) SharedVolume() VolumeSpec {
+    return VolumeSpec{
+        Size:      c.VolumeSize,
+        Type:      c.VolumeType,
+        Iops:      c.VolumeIops,
+        Encrypted: c.VolumeEncrypted,
+        KmsKeyId:  c.VolumeKmsKeyId,
+    }.withDefaults()
+}
+
+// VolumeSpecs returns the shared volumes every node is attached to, with
+// their devices: the sharedVolumes of configs, or the single SharedVolume.
+func (c Configs) VolumeSpecs() []VolumeSpec {
+    volumes := []VolumeSpec{c.SharedVolume()}
+    if len(c.SharedVolumes) > 0 {
+        volumes = []VolumeSpec{}
+        for _, volume := range c.SharedVolumes {
+            volumes = append(volumes, volume.withDefaults())
+        }
+    }
+    return AllocateDevices(volumes, c.BlockDevices)
+}
+
+// deviceLetters returns the drive letters of a device name, eg. "g" for
+// /dev/sdg, /dev/sdg1 and /dev/xvdg, which all name the same drive.
+func deviceLetters(device string) string {
+    letters := strings.TrimPrefix(device, "/dev/")
+    if strings.HasPrefix(letters, "xvd") {
+        letters = strings.TrimPrefix(letters, "xvd")
+    } else {
+        letters = strings.TrimPrefix(letters, "sd")
+    }
+    return strings.TrimRight(letters, "0123456789")
+}
+
+// AllocateDevices gives every volume the next free device from /dev/sdf to
+// /dev/sdp, skipping the devices of the block devices of the launch template.
+// Volumes left without a device when they run out have an empty Device.
+func AllocateDevices(volumes []VolumeSpec, blockDevices *BlockDevices) []VolumeSpec {
+    used := map[string]bool{}
+    if blockDevices != nil {
+        if root := blockDevices.Root; root != nil {
+            used[deviceLetters(orDefault(root.DeviceName, RootDeviceNameDefault))] = true
+        }
+        for _, volume := range blockDevices.Volumes {
+            used[deviceLetters(volume.DeviceName)] = true
+        }
+    }
+    allocated := []VolumeSpec{}
+    letters := sharedVolumeDeviceLetters
+    for _, volume := range volumes {
+        volume.Device = ""
+        for volume.Device == "" && letters != "" {
+            letter := letters[:1]
+            letters = letters[1:]
+            if !used[letter] {
+                volume.Device = "/dev/sd" + letter
+            }
+        }
+        allocated = append(allocated, volume)
+    }
+    return allocated
+}
+
+// createVolumeInput builds the request for a multi-attach volume of spec in aZone.
+func (s VolumeSpec) createVolumeInput(aZone string) *ec2.CreateVolumeInput {
+    s = s.withDefaults()
+    input := &ec2.CreateVolumeInput {
+        Size:               aws.Int64(int64(s.Size)),
+        Iops:               aws.Int64(int64(s.Iops)),
+        VolumeType:         aws.String(s.Type),
+        AvailabilityZone:   aws.String(aZone),
+        MultiAttachEnabled: aws.Bool(true),
+    }
+    if s.Encrypted {
+        input.Encrypted = aws.Bool(true)
+    }
+    if s.KmsKeyId != "" {
+        input.KmsKeyId = aws.String(s.KmsKeyId)
+    }
+    return input
+}
+
+// validateVolume checks the size and IOPS of a shared volume against the
+// limits of its type, and its KMS key. Problems with a named volume are
+// prefixed with its name.
+func validateVolume(spec VolumeSpec) ValidationErrors {
+    errs := ValidationErrors{}
+    invalid := func(format string, args ...interface{}) {
+        msg := fmt.Sprintf(format, args...)
+        if spec.Name != "" {
+            msg = "Shared volume " + spec.Name + ": " + msg
+        }
+        errs = append(errs, &ValidationError{Msg: msg})
+    }
+    s := spec.withDefaults()
+    // Multi-attach is only supported on Provisioned IOPS volumes
+    if s.Type != ec2.VolumeTypeIo1 && s.Type != ec2.VolumeTypeIo2 {
+        invalid("Invalid volume type %q, multi-attach volumes must be io1 or io2.", s.Type)
+        return errs
+    }
+    limits := ebsLimits[s.Type]
+    sizeOk := s.Size >= limits.minSize && s.Size <= limits.maxSize
+    if !sizeOk {
+        invalid("Invalid volume size, must be between %d-%d Gib inclusively.", limits.minSize, limits.maxSize)
+    }
+    if s.Iops < limits.minIops || s.Iops > limits.maxIops {
+        invalid("Invalid volume IOPS, %s volumes take %d-%d IOPS.", s.Type, limits.minIops, limits.maxIops)
+    } else if sizeOk && s.Iops > limits.iopsPerGib * s.Size {
+        invalid("Invalid volume IOPS, %s volumes allow at most %d IOPS per GiB, %d for %d GiB.", s.Type, limits.iopsPerGib, limits.iopsPerGib * s.Size, s.Size)
+    }
+    if s.KmsKeyId != "" && !kmsKeyId.MatchString(s.KmsKeyId) {
+        invalid("Invalid volume KMS key %q, must be a key ID, alias or ARN.", s.KmsKeyId)
+    }
+    return errs
+}
+
+// validateSharedVolumes checks the names of the sharedVolumes, and that each
+// of them gets a device.
+func validateSharedVolumes(c Configs) ValidationErrors {
+    errs := ValidationErrors{}
+    names := map[string]bool{}
+    for i, volume := range c.SharedVolumes {
+        switch {
+        case volume.Name == "":
+            errs = append(errs, &ValidationError{Msg: fmt.Sprintf("Shared volume %d needs a name.", i + 1)})
+        case !sharedVolumeName.MatchString(volume.Name):
+            errs = append(errs, &ValidationError{Msg: fmt.Sprintf("Invalid shared volume name %q, use letters, digits, - and _.", volume.Name)})
+        case names[volume.Name]:
+            errs = append(errs, &ValidationError{Msg: fmt.Sprintf("Shared volume name %q is used more than once.", volume.Name)})
+        }
+        names[volume.Name] = true
+    }
+    volumes := c.VolumeSpecs()
+    if last := volumes[len(volumes) - 1]; last.Device == "" {
+        errs = append(errs, &ValidationError{Msg: fmt.Sprintf("Too many shared volumes, %d devices of /dev/sdf-/dev/sdp are left by the block devices.", countDevices(volumes))})
+    }
+    return errs
+}
+
+// countDevices counts the volumes that got a device.
+func countDevices(volumes []VolumeSpec) int {
+    count := 0
+    for _, volume := range volumes {
+        if volume.Device != "" {
+            count++
+        }
+    }
+    return count
+}
@@ -0,0 +1,169 @@
+package util
+
+import "github.com/aws/aws-sdk-go/aws"
+import "strings"
+import "testing"
+
+
+func TestVolumeSpecCreateVolume(t *testing.T) {
+    configs := purchasingConfigs()
+    configs.VolumeSize = 100
+    configs.VolumeType = "io2"
+    configs.VolumeIops = 20000
+    configs.VolumeKmsKeyId = "alias/storage"
+    if err := ValidateConfigs(configs); err != nil {
+        t.Fatalf("TestVolumeSpecCreateVolume failed: %v", err)
+    }
+    fake := &fakeEC2{}
+    p := NewProvisioner(fake)
+    if _, err := p.CreateVolume(configs.SharedVolume(), "us-east-1a", nil); err != nil {
+        t.Fatalf("TestVolumeSpecCreateVolume failed: %v", err)
+    }
+    in := fake.volumes[0]
+    if aws.StringValue(in.VolumeType) != "io2" || aws.Int64Value(in.Iops) != 20000 || aws.Int64Value(in.Size) != 100 ||
+       !aws.BoolValue(in.Encrypted) || aws.StringValue(in.KmsKeyId) != "alias/storage" || !aws.BoolValue(in.MultiAttachEnabled) {
+        t.Errorf("TestVolumeSpecCreateVolume sent unexpected input: %v", in)
+    }
+
+    // The defaults keep the volumes created so far
+    p.CreateVolume(VolumeSpec{Size: 8}, "us-east-1a", nil)
+    in = fake.volumes[1]
+    if aws.StringValue(in.VolumeType) != "io1" || aws.Int64Value(in.Iops) != 200 || in.Encrypted != nil || in.KmsKeyId != nil {
+        t.Errorf("TestVolumeSpecCreateVolume sent unexpected default input: %v", in)
+    }
+}
+
+func TestVolumeSpecValidate(t *testing.T) {
+    cases := []struct {
+        spec     VolumeSpec
+        expected []string
+    }{
+        {VolumeSpec{Size: 4}, nil},
+        {VolumeSpec{Size: 4, Type: "io2", Iops: 2000, Encrypted: true}, nil},
+        {VolumeSpec{Size: 4, KmsKeyId: "arn:aws:kms:us-east-1:123456789012:key/1234abcd-12ab-34cd-56ef-1234567890ab"}, nil},
+        {VolumeSpec{Size: 100, Type: "gp3"}, []string{"Invalid volume type \"gp3\", multi-attach volumes must be io1 or io2."}},
+        {VolumeSpec{Size: 4, Iops: 1000}, []string{"Invalid volume IOPS, io1 volumes allow at most 50 IOPS per GiB, 200 for 4 GiB."}},
+        {VolumeSpec{Size: 20000, Type: "io2", Iops: 70000}, []string{
+            "Invalid volume size, must be between 4-16384 Gib inclusively.",
+            "Invalid volume IOPS, io2 volumes take 100-64000 IOPS.",
+        }},
+        {VolumeSpec{Size: 4, KmsKeyId: "storage"}, []string{"Invalid volume KMS key \"storage\", must be a key ID, alias or ARN."}},
+    }
+    for _, c := range cases {
+        errs := validateVolume(c.spec)
+        if len(errs) != len(c.expected) {
+            t.Errorf("TestVolumeSpecValidate %+v got %v", c.spec, errs)
+            continue
+        }
+        for i, msg := range c.expected {
+            if errs[i].Error() != msg {
+                t.Errorf("TestVolumeSpecValidate %+v: got %q, expected %q", c.spec, errs[i], msg)
+            }
+        }
+    }
+}
+
+func TestVolumeSpecPlan(t *testing.T) {
+    configs := purchasingConfigs()
+    configs.VolumeSize = 10
+    configs.VolumeType = "io2"
+    configs.VolumeIops = 3000
+    configs.VolumeKmsKeyId = "alias/storage"
+    template := GetCreateLaunchTemplateInput("name", "ami-1", "t3.micro", []string{"sg1"}, nil)
+    fleet := GetCreateFleetRequestInput(configs.FleetNodes(), LaunchTemplateRef{Id: "lt-1", Version: "1"}, map[string]string{"sub1": "us-east-1a"}, configs, nil)
+    plan := NewPlan(template, fleet, configs.VolumeSpecs(), nil)
+    if len(plan.Volumes) != 1 || plan.Volumes[0].VolumeType != "io2" || plan.Volumes[0].Iops != 3000 || !plan.Volumes[0].Encrypted {
+        t.Fatalf("TestVolumeSpecPlan got %+v", plan.Volumes)
+    }
+    table := FormatPlan(plan)
+    if !strings.Contains(table, "ENCRYPTION") || !strings.Contains(table, "alias/storage") {
+        t.Errorf("TestVolumeSpecPlan table:\n%s", table)
+    }
+}
+
+func TestVolumeSpecAllocateDevices(t *testing.T) {
+    configs := purchasingConfigs()
+    configs.SharedVolumes = []VolumeSpec{{Name: "data", Size: 100}, {Name: "log", Size: 10, Type: "io2"}}
+    configs.BlockDevices = &BlockDevices{Volumes: []BlockDevice{{DeviceName: "/dev/sdf", Size: 10}, {DeviceName: "/dev/xvdg", Size: 10}}}
+    if err := ValidateConfigs(configs); err != nil {
+        t.Fatalf("TestVolumeSpecAllocateDevices failed: %v", err)
+    }
+    volumes := configs.VolumeSpecs()
+    if len(volumes) != 2 || volumes[0].Device != "/dev/sdh" || volumes[1].Device != "/dev/sdi" || volumes[1].Iops != 200 {
+        t.Errorf("TestVolumeSpecAllocateDevices got %+v", volumes)
+    }
+
+    // The single shared volume keeps /dev/sdf
+    configs.SharedVolumes = nil
+    configs.BlockDevices = nil
+    if volumes := configs.VolumeSpecs(); len(volumes) != 1 || volumes[0].Device != "/dev/sdf" || volumes[0].Name != "" {
+        t.Errorf("TestVolumeSpecAllocateDevices single volume got %+v", volumes)
+    }
+}
+
+func TestVolumeSpecValidateSharedVolumes(t *testing.T) {
+    configs := purchasingConfigs()
+    configs.SharedVolumes = []VolumeSpec{{Size: 4}, {Name: "data", Size: 4}, {Name: "data", Size: 4}, {Name: "log files", Size: 2}}
+    errs, ok := ValidateConfigs(configs).(ValidationErrors)
+    expected := []string{
+        "Shared volume 1 needs a name.",
+        "Shared volume name \"data\" is used more than once.",
+        "Invalid shared volume name \"log files\", use letters, digits, - and _.",
+        "Shared volume log files: Invalid volume size, must be between 4-16384 Gib inclusively.",
+    }
+    if !ok || len(errs) != len(expected) {
+        t.Fatalf("TestVolumeSpecValidateSharedVolumes got %v", errs)
+    }
+    for i, msg := range expected {
+        if errs[i].Error() != msg {
+            t.Errorf("TestVolumeSpecValidateSharedVolumes error %d: got %q, expected %q", i, errs[i], msg)
+        }
+    }
+
+    configs.SharedVolumes = []VolumeSpec{}
+    for _, name := range []string{"a", "b", "c", "d", "e", "f", "g", "h", "i", "j"} {
+        configs.SharedVolumes = append(configs.SharedVolumes, VolumeSpec{Name: name, Size: 4})
+    }
+    configs.BlockDevices = &BlockDevices{Volumes: []BlockDevice{{DeviceName: "/dev/sdp", Size: 10}, {DeviceName: "/dev/sdo", Size: 10}}}
+    err := ValidateConfigs(configs)
+    if err == nil || err.Error() != "Too many shared volumes, 9 devices of /dev/sdf-/dev/sdp are left by the block devices." {
+        t.Errorf("TestVolumeSpecValidateSharedVolumes with too many volumes got %v", err)
+    }
+}
+
+func TestVolumeSpecPlanSharedVolumes(t *testing.T) {
+    configs := purchasingConfigs()
+    configs.SharedVolumes = []VolumeSpec{{Name: "data", Size: 100}, {Name: "log", Size: 10}}
+    template := GetCreateLaunchTemplateInput("name", "ami-1", "t3.micro", []string{"sg1"}, nil)
+    fleet := GetCreateFleetRequestInput(configs.FleetNodes(), LaunchTemplateRef{Id: "lt-1", Version: "1"}, map[string]string{"sub1": "us-east-1a"}, configs, nil)
+    plan := NewPlan(template, fleet, configs.VolumeSpecs(), nil)
+    if len(plan.Volumes) != 2 || plan.Volumes[0].Name != "data-1" || plan.Volumes[1].Device != "/dev/sdg" || plan.Zones[0].Volumes != 2 {
+        t.Fatalf("TestVolumeSpecPlanSharedVolumes got %+v", plan.Volumes)
+    }
+    if plan.Overrides[0].Volume != "data-1,log-1" {
+        t.Errorf("TestVolumeSpecPlanSharedVolumes override %+v", plan.Overrides[0])
+    }
+}
+
+func TestVolumeSpecNameTag(t *testing.T) {
+    fake := &fakeEC2{}
+    p := NewProvisioner(fake)
+    tags := RunTags("run-1", nil)
+    p.CreateVolume(VolumeSpec{Name: "data", Size: 8}, "us-east-1a", tags)
+    specs := fake.volumes[0].TagSpecifications
+    if len(specs) != 1 || len(specs[0].Tags) != 2 || aws.StringValue(specs[0].Tags[1].Key) != SharedVolumeTagKey ||
+       aws.StringValue(specs[0].Tags[1].Value) != "data" {
+        t.Errorf("TestVolumeSpecNameTag got %v", specs)
+    }
+    if len(tags) != 1 {
+        t.Errorf("TestVolumeSpecNameTag changed the run tags: %v", tags)
+    }
+}
+
+func TestVolumeSpecSharedVolumesEnv(t *testing.T) {
+    env := map[string]string{"SHARED_VOLUMES": `[{"name": "data", "size": 100, "type": "io2", "iops": 5000}, {"name": "log", "size": 10}]`}
+    configs, _, err := LoadConfigs(Configs{}, ConfigFile{}, func(key string) string { return env[key] }, nil)
+    if err != nil || len(configs.SharedVolumes) != 2 || configs.SharedVolumes[0].Iops != 5000 || configs.SharedVolumes[1].Name != "log" {
+        t.Errorf("TestVolumeSpecSharedVolumesEnv got %+v, %v", configs.SharedVolumes, err)
+    }
+}
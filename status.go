@@ -0,0 +1,45 @@
+/* Copyright (C) Xiang Wang - All Rights Reserved
+ * Unauthorized copying of this file, via any medium is strictly prohibited
+ * Proprietary and confidential
+ * Written by Xiang Wang <xwang1314@gmail.com>, August 2020
+ */
+
+package main
+
+import "encoding/json"
+import "util"
+import "fmt"
+import "os"
+
+
+// status implements `ec2fleet status`: it shows the live state of every
+// instance and volume of a run.
+func status(args []string) {
+    flags := newFlagSet("status", "Show the live state of the instances and volumes of a run.")
+    runs := addRunFlags(flags)
+    outputPtr := flags.String("output", "table", "Output format, table or json\n(Optional) Default: table\neg. -output=json")
+    flags.Parse(args)
+
+    provisioner := util.NewDefaultProvisioner()
+    stateFile, err := runs.load(provisioner)
+    if err != nil {
+        fail(err)
+    }
+    runStatus, err := provisioner.GetRunStatus(stateFile.State)
+    if err != nil {
+        fail(err)
+    }
+    switch *outputPtr {
+    case "table":
+        fmt.Print(util.FormatRunStatus(runStatus))
+    case "json":
+        data, err := json.MarshalIndent(runStatus, "", "    ")
+        if err != nil {
+            fail(err)
+        }
+        fmt.Println(string(data))
+    default:
+        fail(&util.ValidationError{Msg: "Invalid output format " + *outputPtr + ", must be table or json."})
+    }
+    os.Exit(exitOK)
+}
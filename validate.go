@@ -0,0 +1,33 @@
+/* Copyright (C) Xiang Wang - All Rights Reserved
+ * Unauthorized copying of this file, via any medium is strictly prohibited
+ * Proprietary and confidential
+ * Written by Xiang Wang <xwang1314@gmail.com>, August 2020
+ */
+
+package main
+
+import "util"
+import "fmt"
+import "os"
+
+
+// validate implements `ec2fleet validate`: it checks the inputs without
+// creating anything.
+func validate(args []string) {
+    flags := newFlagSet("validate", "Check the inputs without creating anything.")
+    inputs := addInputFlags(flags)
+    offlinePtr := flags.Bool("offline", false, "Skip the checks that call AWS, eg. that every subnet exists\n(Optional) Default: false\neg. -offline")
+    flags.Parse(args)
+
+    configs, err := inputs.load()
+    if err != nil {
+        fail(err)
+    }
+    if !*offlinePtr {
+        if _, err := util.NewDefaultProvisioner().GetSubnetAvailabilityZones(configs.SubnetIds()); err != nil {
+            fail(err)
+        }
+    }
+    fmt.Println("Inputs are valid.")
+    os.Exit(exitOK)
+}